@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hardvlad/ypdiploma1/internal/handler"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// fakeAccrual система начислений для тестов: отвечает на запросы только по заказам теста,
+// остальные заказы общей базы данных для нее неизвестны, поэтому их опрос прекращается без изменения начислений
+type fakeAccrual struct {
+	URL string
+
+	mu             sync.Mutex
+	orders         map[string]handler.AccrualResponse
+	registered     map[string][]repository.OrderGood
+	registerStatus int
+	registerCalls  map[string]int
+}
+
+// newFakeAccrual запуск системы начислений для теста, останавливается по завершении теста
+func newFakeAccrual(t *testing.T) *fakeAccrual {
+	accrual := &fakeAccrual{
+		orders:        map[string]handler.AccrualResponse{},
+		registered:    map[string][]repository.OrderGood{},
+		registerCalls: map[string]int{},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(accrual.serveHTTP))
+	t.Cleanup(server.Close)
+	accrual.URL = server.URL
+	return accrual
+}
+
+// SetOrder установка статуса и начисления по заказу
+func (a *fakeAccrual) SetOrder(number string, status string, accrual float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.orders[number] = handler.AccrualResponse{Order: number, Status: status, Accrual: accrual}
+}
+
+// FailRegistration ответ code на запросы регистрации заказов, 0 - регистрация принимается
+func (a *fakeAccrual) FailRegistration(code int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.registerStatus = code
+}
+
+// Registered товары, с которыми заказ был зарегистрирован, и количество запросов регистрации заказа
+func (a *fakeAccrual) Registered(number string) ([]repository.OrderGood, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.registered[number], a.registerCalls[number]
+}
+
+func (a *fakeAccrual) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if r.Method == http.MethodPost && r.URL.Path == "/api/orders" {
+		var request struct {
+			Order string                 `json:"order"`
+			Goods []repository.OrderGood `json:"goods"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		a.registerCalls[request.Order]++
+		if a.registerStatus != 0 {
+			w.WriteHeader(a.registerStatus)
+			return
+		}
+		a.registered[request.Order] = request.Goods
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	order, ok := a.orders[strings.TrimPrefix(r.URL.Path, "/api/orders/")]
+	if r.Method != http.MethodGet || !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
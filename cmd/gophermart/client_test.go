@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hardvlad/ypdiploma1/internal/config"
+	"github.com/hardvlad/ypdiploma1/internal/handler"
+	"github.com/hardvlad/ypdiploma1/internal/repository/pg"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+// testPassword пароль пользователей, которых регистрирует testClient
+const testPassword = "xxxxyyyy"
+
+// testClient клиент экземпляра сервиса в тестах, выполняющий запросы от имени зарегистрированного пользователя
+// Login и UserID - пользователь клиента, Cookies - cookie его входа,
+// Header - заголовки, добавляемые к каждому запросу клиента, RemoteAddr - адрес клиента, если задан
+type testClient struct {
+	t          *testing.T
+	mux        http.Handler
+	Login      string
+	UserID     int
+	Cookies    []*http.Cookie
+	Header     http.Header
+	RemoteAddr string
+}
+
+// newTestServer регистрация нового пользователя в общем экземпляре сервиса, возвращает клиент с его входом
+func newTestServer(t *testing.T) *testClient {
+	return newTestClient(t, globalMux)
+}
+
+// newTestClient регистрация нового пользователя в экземпляре сервиса mux, возвращает клиент с его входом
+func newTestClient(t *testing.T, mux http.Handler) *testClient {
+	return newAnonymousClient(t, mux).Register()
+}
+
+// Register регистрация нового пользователя от имени клиента, клиент получает его вход
+func (c *testClient) Register() *testClient {
+	c.Login = "testuser" + util.GenerateRandomString(8)
+
+	w := c.DoWith(nil, http.MethodPost, "/api/user/register", `{"login":"`+c.Login+`","password":"`+testPassword+`"}`)
+	require.Equal(c.t, http.StatusOK, w.Code)
+	c.Cookies = w.Result().Cookies()
+
+	userID, err := testStore().GetUserIDByLogin(context.Background(), c.Login)
+	require.NoError(c.t, err)
+	c.UserID = userID
+
+	return c
+}
+
+// newAnonymousClient клиент экземпляра сервиса mux без входа
+func newAnonymousClient(t *testing.T, mux http.Handler) *testClient {
+	return &testClient{t: t, mux: mux, Header: http.Header{}}
+}
+
+// Do выполнение запроса с cookie входа клиента
+func (c *testClient) Do(method, target, body string) *httptest.ResponseRecorder {
+	return c.DoWith(c.Cookies, method, target, body)
+}
+
+// DoJSON выполнение запроса с телом в формате JSON с cookie входа клиента
+func (c *testClient) DoJSON(method, target, body string) *httptest.ResponseRecorder {
+	return c.DoWithHeader(c.Cookies, http.Header{"Content-Type": {"application/json"}}, method, target, body)
+}
+
+// DoWith выполнение запроса с переданными cookie, nil - запрос без входа
+func (c *testClient) DoWith(cookies []*http.Cookie, method, target, body string) *httptest.ResponseRecorder {
+	return c.DoWithHeader(cookies, nil, method, target, body)
+}
+
+// DoWithHeader выполнение запроса с переданными cookie и дополнительными заголовками
+func (c *testClient) DoWithHeader(cookies []*http.Cookie, header http.Header, method, target, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if c.RemoteAddr != "" {
+		request.RemoteAddr = c.RemoteAddr
+	}
+	for name, values := range c.Header {
+		request.Header[name] = values
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	c.mux.ServeHTTP(w, request)
+	return w
+}
+
+// Relogin вход пользователя клиента по паролю, возвращает cookie нового входа, не заменяя cookie клиента
+func (c *testClient) Relogin() []*http.Cookie {
+	w := c.DoWith(nil, http.MethodPost, "/api/user/login", `{"login":"`+c.Login+`","password":"`+testPassword+`"}`)
+	require.Equal(c.t, http.StatusOK, w.Code)
+	return w.Result().Cookies()
+}
+
+// WithRole назначение роли пользователю клиента, смена роли отзывает входы,
+// поэтому клиент входит заново
+func (c *testClient) WithRole(role string) *testClient {
+	found, err := testStore().SetUserRoleByLogin(context.Background(), c.Login, role)
+	require.NoError(c.t, err)
+	require.True(c.t, found)
+
+	c.Cookies = c.Relogin()
+	return c
+}
+
+// Cookie поиск cookie с именем name среди cookie входа клиента
+func (c *testClient) Cookie(name string) *http.Cookie {
+	for _, cookie := range c.Cookies {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// newTestInstance отдельный экземпляр сервиса с конфигурацией conf для тестов с особыми настройками,
+// воркеры экземпляра останавливаются по завершении теста
+func newTestInstance(t *testing.T, conf *config.Config) http.Handler {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var wg sync.WaitGroup
+	store := testStore()
+	return handler.AuthorizationMiddleware(
+		handler.NewHandlers(ctx, conf, store, globalLogger, make(chan string, 1), &wg, 1),
+		globalLogger, conf.CookieName, conf.TokenKeys, store,
+	)
+}
+
+// testStore хранилище общей тестовой базы данных
+func testStore() *pg.Storage {
+	return pg.NewPGStorage(globalDB, globalLogger)
+}
+
+// luhnNumber случайный номер заказа из digits+1 цифр с верной контрольной цифрой Луна
+func luhnNumber(t *testing.T, digits int) string {
+	prefix := util.DigitString(digits, digits+1)
+	number, err := strconv.Atoi(prefix)
+	require.NoError(t, err)
+	return prefix + strconv.Itoa((10-util.CalcChecksumLuhn(number))%10)
+}
+
+// uniqueRemoteAddr адрес клиента из документационной сети IPv6, не совпадающий с адресами других тестов,
+// чтобы счетчики и блокировки по IP-адресу не влияли на другие тесты
+func uniqueRemoteAddr() string {
+	return fmt.Sprintf("[2001:db8::%x:%x]:1234", rand.Intn(1<<16), rand.Intn(1<<16))
+}
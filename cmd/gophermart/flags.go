@@ -2,18 +2,93 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"log"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/auth"
+	"github.com/hardvlad/ypdiploma1/internal/config"
+	"github.com/hardvlad/ypdiploma1/internal/oidc"
+	"github.com/hardvlad/ypdiploma1/internal/password"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/validator"
+	"github.com/hardvlad/ypdiploma1/internal/webauthn"
 )
 
 // programFlags определяет структуру для хранения аргументов сервиса
 // RunAddress - адрес, на котором запускается HTTP сервер
 // Dsn - строка подключения к базе данных
 // AccrualAddress - адрес системы расчёта начислений
+// WithdrawMaxSingle, WithdrawMaxDaily, WithdrawMaxWeekly, WithdrawMinBalance - глобальные ограничения на списания
+// AccrualPollInterval - пауза между запросами в систему начислений по необработанному заказу
+// ReconcileWindow, ReconcileInterval - окно и периодичность сверки завершенных заказов с системой начислений
+// WebhookMaxAttempts - количество попыток доставки вебхука
+// DeletionGrace - период до удаления учетной записи, в течение которого удаление можно отменить
+// OrderValidator - схема проверки номеров заказов по умолчанию
+// AdminLogins - логины пользователей, получающих роль admin при запуске
+// JWTKeys, JWTKeysFile - набор ключей подписи JWT токенов строкой kid:base64secret[ kid:base64secret...] или файлом
+// JWTRandomKey - запуск со случайным ключом подписи JWT токенов, если ключи не заданы (только для разработки)
+// AccessTokenTTL, RefreshTokenTTL - время жизни access и refresh токенов
+// CookieDomain, CookieSecure, CookieSameSite - атрибуты cookie токенов
+// CSRFMode, CSRFTrustedOrigins - режим защиты от CSRF и доверенные источники запросов
+// PasswordMinLength, PasswordMinClasses - политика сложности паролей
+// BreachedPasswordsDir - каталог диапазонов хэшей утекших паролей
+// LoginMaxFailures, LoginIPMaxFailures, LoginLockout - пороги неудачных попыток входа и начальная блокировка
+// OIDCIssuer, OIDCClientID, OIDCClientSecret, OIDCRedirectURL, OIDCScopes - настройки входа через провайдера OpenID Connect
+// OIDCAutoCreate - создание пользователя при первом входе через провайдера
+// TOTPWithdrawAbove - сумма списания, выше которой нужен код TOTP
+// WebAuthnRPID, WebAuthnRPName, WebAuthnOrigins - настройки входа по ключам доступа WebAuthn
+// UploadMaxPerUser, UploadMaxPerIP, UploadBlockDuration - ограничения частоты загрузки заказов в минуту и длительность блокировки
 type programFlags struct {
-	RunAddress     string
-	Dsn            string
-	AccrualAddress string
+	RunAddress           string
+	Dsn                  string
+	AccrualAddress       string
+	WithdrawMaxSingle    float64
+	WithdrawMaxDaily     float64
+	WithdrawMaxWeekly    float64
+	WithdrawMinBalance   float64
+	AccrualPollInterval  time.Duration
+	ReconcileWindow      time.Duration
+	ReconcileInterval    time.Duration
+	WebhookMaxAttempts   int
+	DeletionGrace        time.Duration
+	OrderValidator       string
+	AdminLogins          string
+	UploadMaxPerUser     int
+	UploadMaxPerIP       int
+	UploadBlockDuration  time.Duration
+	JWTKeys              string
+	JWTKeysFile          string
+	JWTRandomKey         bool
+	AccessTokenTTL       time.Duration
+	RefreshTokenTTL      time.Duration
+	CookieDomain         string
+	CookieSecure         bool
+	CookieSameSite       string
+	CSRFMode             string
+	CSRFTrustedOrigins   string
+	PasswordMinLength    int
+	PasswordMinClasses   int
+	BreachedPasswordsDir string
+	LoginMaxFailures     int
+	LoginIPMaxFailures   int
+	LoginLockout         time.Duration
+	OIDCIssuer           string
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCRedirectURL      string
+	OIDCScopes           string
+	OIDCAutoCreate       bool
+	TOTPWithdrawAbove    float64
+	WebAuthnRPID         string
+	WebAuthnRPName       string
+	WebAuthnOrigins      string
 }
 
 // Функция parseFlags парсит аргументы командной строки и переменные окружения
@@ -43,7 +118,356 @@ func parseFlags() programFlags {
 		flags.AccrualAddress = envAccrual
 	}
 
+	// получение глобальных ограничений на списания, 0 - без ограничения
+	flag.Float64Var(&flags.WithdrawMaxSingle, "withdraw-max-single", 0, "максимальная сумма одного списания")
+	lookupEnvFloat("WITHDRAW_MAX_SINGLE", &flags.WithdrawMaxSingle)
+
+	flag.Float64Var(&flags.WithdrawMaxDaily, "withdraw-max-daily", 0, "максимальная сумма списаний за сутки")
+	lookupEnvFloat("WITHDRAW_MAX_DAILY", &flags.WithdrawMaxDaily)
+
+	flag.Float64Var(&flags.WithdrawMaxWeekly, "withdraw-max-weekly", 0, "максимальная сумма списаний за неделю")
+	lookupEnvFloat("WITHDRAW_MAX_WEEKLY", &flags.WithdrawMaxWeekly)
+
+	flag.Float64Var(&flags.WithdrawMinBalance, "withdraw-min-balance", 0, "минимальный остаток на счету после списания")
+	lookupEnvFloat("WITHDRAW_MIN_BALANCE", &flags.WithdrawMinBalance)
+
+	// получение паузы между запросами в систему начислений по необработанному заказу
+	flag.DurationVar(&flags.AccrualPollInterval, "accrual-poll-interval", time.Second, "пауза между запросами статуса заказа в систему начислений")
+	lookupEnvDuration("ACCRUAL_POLL_INTERVAL", &flags.AccrualPollInterval)
+
+	// получение параметров сверки начислений, окно 0 - сверка отключена
+	flag.DurationVar(&flags.ReconcileWindow, "reconcile-window", 72*time.Hour, "окно сверки завершенных заказов с системой начислений")
+	lookupEnvDuration("RECONCILE_WINDOW", &flags.ReconcileWindow)
+
+	flag.DurationVar(&flags.ReconcileInterval, "reconcile-interval", 10*time.Minute, "периодичность сверки заказа с системой начислений")
+	lookupEnvDuration("RECONCILE_INTERVAL", &flags.ReconcileInterval)
+
+	// получение количества попыток доставки вебхука
+	flag.IntVar(&flags.WebhookMaxAttempts, "webhook-max-attempts", 8, "количество попыток доставки вебхука")
+	lookupEnvInt("WEBHOOK_MAX_ATTEMPTS", &flags.WebhookMaxAttempts)
+
+	// получение периода до удаления учетной записи по запросу пользователя
+	flag.DurationVar(&flags.DeletionGrace, "account-deletion-grace", 30*24*time.Hour, "период до удаления учетной записи, в течение которого удаление можно отменить")
+	lookupEnvDuration("ACCOUNT_DELETION_GRACE", &flags.DeletionGrace)
+
+	// получение схемы проверки номеров заказов: luhn, damm, verhoeff или regex:<выражение>
+	flag.StringVar(&flags.OrderValidator, "order-validator", "luhn", "схема проверки номеров заказов")
+	if env, ok := os.LookupEnv("ORDER_VALIDATOR"); ok {
+		flags.OrderValidator = env
+	}
+
+	// получение логинов администраторов из аргумента командной строки -admin-logins
+	// или из переменной окружения ADMIN_LOGINS
+	flag.StringVar(&flags.AdminLogins, "admin-logins", "", "логины пользователей с ролью admin через запятую")
+	if env, ok := os.LookupEnv("ADMIN_LOGINS"); ok {
+		flags.AdminLogins = env
+	}
+
+	// получение ограничений частоты загрузки заказов пользователем и с IP-адреса, 0 - без ограничения
+	flag.IntVar(&flags.UploadMaxPerUser, "upload-max-per-user", 1000, "максимальное количество загружаемых пользователем номеров заказов в минуту")
+	lookupEnvInt("UPLOAD_MAX_PER_USER", &flags.UploadMaxPerUser)
+
+	flag.IntVar(&flags.UploadMaxPerIP, "upload-max-per-ip", 2000, "максимальное количество загружаемых с IP-адреса номеров заказов в минуту")
+	lookupEnvInt("UPLOAD_MAX_PER_IP", &flags.UploadMaxPerIP)
+
+	// получение длительности блокировки загрузки заказов при подозрении на перебор номеров, 0 - блокировки отключены
+	flag.DurationVar(&flags.UploadBlockDuration, "upload-block-duration", time.Hour, "длительность блокировки загрузки заказов")
+	lookupEnvDuration("UPLOAD_BLOCK_DURATION", &flags.UploadBlockDuration)
+
+	// получение набора ключей подписи JWT токенов из аргумента командной строки -jwt-keys
+	// или из переменной окружения JWT_KEYS, секреты задаются в base64, ключи разделяются пробелами или переводами строк,
+	// первый ключ подписывает новые токены, остальные только проверяют выданные ранее токены до вывода ключа из набора
+	flag.StringVar(&flags.JWTKeys, "jwt-keys", "", "ключи подписи JWT токенов в виде kid:base64secret[ kid:base64secret...]")
+	if env, ok := os.LookupEnv("JWT_KEYS"); ok {
+		flags.JWTKeys = env
+	}
+
+	// получение пути к файлу с ключами подписи JWT токенов, по одному kid:base64secret в строке
+	flag.StringVar(&flags.JWTKeysFile, "jwt-keys-file", "", "файл с ключами подписи JWT токенов")
+	if env, ok := os.LookupEnv("JWT_KEYS_FILE"); ok {
+		flags.JWTKeysFile = env
+	}
+
+	// получение разрешения запуститься без ключей подписи JWT токенов со случайным ключом до перезапуска сервиса,
+	// без него сервис без ключей не запускается
+	flag.BoolVar(&flags.JWTRandomKey, "jwt-random-key", false, "случайный ключ подписи JWT токенов, если ключи не заданы (только для разработки)")
+	if env, ok := os.LookupEnv("JWT_RANDOM_KEY"); ok {
+		flags.JWTRandomKey = env == "true"
+	}
+
+	// получение времени жизни access и refresh токенов
+	flag.DurationVar(&flags.AccessTokenTTL, "access-token-ttl", 15*time.Minute, "время жизни access токена")
+	lookupEnvDuration("ACCESS_TOKEN_TTL", &flags.AccessTokenTTL)
+
+	flag.DurationVar(&flags.RefreshTokenTTL, "refresh-token-ttl", 30*24*time.Hour, "время жизни refresh токена")
+	lookupEnvDuration("REFRESH_TOKEN_TTL", &flags.RefreshTokenTTL)
+
+	// получение атрибутов cookie токенов: домен, передача только по HTTPS и политика SameSite (lax, strict, none)
+	flag.StringVar(&flags.CookieDomain, "cookie-domain", "", "домен cookie токенов")
+	if env, ok := os.LookupEnv("COOKIE_DOMAIN"); ok {
+		flags.CookieDomain = env
+	}
+
+	flag.BoolVar(&flags.CookieSecure, "cookie-secure", false, "передавать cookie токенов только по HTTPS")
+	if env, ok := os.LookupEnv("COOKIE_SECURE"); ok {
+		if value, err := strconv.ParseBool(env); err == nil {
+			flags.CookieSecure = value
+		}
+	}
+
+	flag.StringVar(&flags.CookieSameSite, "cookie-samesite", "lax", "политика SameSite cookie токенов: lax, strict или none")
+	if env, ok := os.LookupEnv("COOKIE_SAMESITE"); ok {
+		flags.CookieSameSite = env
+	}
+
+	// получение режима защиты от CSRF: origin, double-submit или off, и доверенных источников через запятую
+	flag.StringVar(&flags.CSRFMode, "csrf-mode", config.CSRFModeOrigin, "режим защиты от CSRF: origin, double-submit или off")
+	if env, ok := os.LookupEnv("CSRF_MODE"); ok {
+		flags.CSRFMode = env
+	}
+
+	flag.StringVar(&flags.CSRFTrustedOrigins, "csrf-trusted-origins", "", "доверенные источники запросов через запятую")
+	if env, ok := os.LookupEnv("CSRF_TRUSTED_ORIGINS"); ok {
+		flags.CSRFTrustedOrigins = env
+	}
+
+	// получение политики сложности паролей: минимальной длины и количества классов символов
+	flag.IntVar(&flags.PasswordMinLength, "password-min-length", 8, "минимальная длина пароля")
+	lookupEnvInt("PASSWORD_MIN_LENGTH", &flags.PasswordMinLength)
+
+	flag.IntVar(&flags.PasswordMinClasses, "password-min-classes", 1, "минимальное количество классов символов в пароле")
+	lookupEnvInt("PASSWORD_MIN_CLASSES", &flags.PasswordMinClasses)
+
+	// получение каталога диапазонов SHA-1 хэшей утекших паролей, пустой - проверка отключена
+	flag.StringVar(&flags.BreachedPasswordsDir, "breached-passwords-dir", "", "каталог диапазонов хэшей утекших паролей")
+	if env, ok := os.LookupEnv("BREACHED_PASSWORDS_DIR"); ok {
+		flags.BreachedPasswordsDir = env
+	}
+
+	// получение порогов неудачных попыток входа по логину и с IP-адреса и начальной длительности блокировки,
+	// порог 0 - без ограничения
+	flag.IntVar(&flags.LoginMaxFailures, "login-max-failures", 5, "количество неудачных попыток входа по логину до блокировки")
+	lookupEnvInt("LOGIN_MAX_FAILURES", &flags.LoginMaxFailures)
+
+	flag.IntVar(&flags.LoginIPMaxFailures, "login-ip-max-failures", 50, "количество неудачных попыток входа с IP-адреса до блокировки")
+	lookupEnvInt("LOGIN_IP_MAX_FAILURES", &flags.LoginIPMaxFailures)
+
+	flag.DurationVar(&flags.LoginLockout, "login-lockout", 30*time.Second, "начальная длительность блокировки входа")
+	lookupEnvDuration("LOGIN_LOCKOUT", &flags.LoginLockout)
+
+	// получение настроек входа через провайдера OpenID Connect, пустой адрес провайдера - вход отключен
+	flag.StringVar(&flags.OIDCIssuer, "oidc-issuer", "", "адрес провайдера OpenID Connect")
+	if env, ok := os.LookupEnv("OIDC_ISSUER"); ok {
+		flags.OIDCIssuer = env
+	}
+
+	flag.StringVar(&flags.OIDCClientID, "oidc-client-id", "", "идентификатор клиента у провайдера OpenID Connect")
+	if env, ok := os.LookupEnv("OIDC_CLIENT_ID"); ok {
+		flags.OIDCClientID = env
+	}
+
+	flag.StringVar(&flags.OIDCClientSecret, "oidc-client-secret", "", "секрет клиента у провайдера OpenID Connect")
+	if env, ok := os.LookupEnv("OIDC_CLIENT_SECRET"); ok {
+		flags.OIDCClientSecret = env
+	}
+
+	flag.StringVar(&flags.OIDCRedirectURL, "oidc-redirect-url", "", "адрес возврата с кодом авторизации, например https://host/api/user/oidc/callback")
+	if env, ok := os.LookupEnv("OIDC_REDIRECT_URL"); ok {
+		flags.OIDCRedirectURL = env
+	}
+
+	flag.StringVar(&flags.OIDCScopes, "oidc-scopes", "openid,email,profile", "запрашиваемые у провайдера области доступа через запятую")
+	if env, ok := os.LookupEnv("OIDC_SCOPES"); ok {
+		flags.OIDCScopes = env
+	}
+
+	flag.BoolVar(&flags.OIDCAutoCreate, "oidc-auto-create", false, "создавать пользователя при первом входе через провайдера")
+	if env, ok := os.LookupEnv("OIDC_AUTO_CREATE"); ok {
+		if value, err := strconv.ParseBool(env); err == nil {
+			flags.OIDCAutoCreate = value
+		}
+	}
+
+	// получение суммы списания, выше которой пользователи с двухфакторной аутентификацией подтверждают списание кодом TOTP
+	flag.Float64Var(&flags.TOTPWithdrawAbove, "totp-withdraw-threshold", 1000, "сумма списания, выше которой нужен код TOTP")
+	lookupEnvFloat("TOTP_WITHDRAW_THRESHOLD", &flags.TOTPWithdrawAbove)
+
+	// получение настроек входа по ключам доступа WebAuthn, пустой идентификатор сервиса отключает вход
+	flag.StringVar(&flags.WebAuthnRPID, "webauthn-rp-id", "", "идентификатор сервиса для ключей доступа WebAuthn, домен сайта")
+	if env, ok := os.LookupEnv("WEBAUTHN_RP_ID"); ok {
+		flags.WebAuthnRPID = env
+	}
+
+	flag.StringVar(&flags.WebAuthnRPName, "webauthn-rp-name", "Gophermart", "название сервиса, показываемое при создании ключа доступа")
+	if env, ok := os.LookupEnv("WEBAUTHN_RP_NAME"); ok {
+		flags.WebAuthnRPName = env
+	}
+
+	flag.StringVar(&flags.WebAuthnOrigins, "webauthn-origins", "", "источники страниц входа по ключам доступа через запятую, например https://host")
+	if env, ok := os.LookupEnv("WEBAUTHN_ORIGINS"); ok {
+		flags.WebAuthnOrigins = env
+	}
+
 	flag.Parse()
 
 	return flags
 }
+
+// lookupEnvFloat записывает в target значение переменной окружения name, если она задана и является числом
+func lookupEnvFloat(name string, target *float64) {
+	if env, ok := os.LookupEnv(name); ok {
+		if value, err := strconv.ParseFloat(env, 64); err == nil {
+			*target = value
+		}
+	}
+}
+
+// lookupEnvInt записывает в target значение переменной окружения name, если она задана и является целым числом
+func lookupEnvInt(name string, target *int) {
+	if env, ok := os.LookupEnv(name); ok {
+		if value, err := strconv.Atoi(env); err == nil {
+			*target = value
+		}
+	}
+}
+
+// lookupEnvDuration записывает в target значение переменной окружения name, если она задана и является длительностью
+func lookupEnvDuration(name string, target *time.Duration) {
+	if env, ok := os.LookupEnv(name); ok {
+		if value, err := time.ParseDuration(env); err == nil {
+			*target = value
+		}
+	}
+}
+
+// newConfig создание конфига программы из аргументов запуска сервиса
+func newConfig(flags programFlags) *config.Config {
+	conf := config.NewConfig(flags.Dsn, flags.AccrualAddress)
+	conf.WithdrawalLimits = repository.WithdrawalLimits{
+		MaxSingle:  flags.WithdrawMaxSingle,
+		MaxDaily:   flags.WithdrawMaxDaily,
+		MaxWeekly:  flags.WithdrawMaxWeekly,
+		MinBalance: flags.WithdrawMinBalance,
+	}
+	conf.AccrualPollInterval = flags.AccrualPollInterval
+	conf.ReconcileWindow = flags.ReconcileWindow
+	conf.ReconcileInterval = flags.ReconcileInterval
+	conf.WebhookMaxAttempts = flags.WebhookMaxAttempts
+	conf.DeletionGrace = flags.DeletionGrace
+	conf.AccessTokenTTL = flags.AccessTokenTTL
+	conf.RefreshTokenTTL = flags.RefreshTokenTTL
+	conf.UploadAbuse.MaxPerUser = flags.UploadMaxPerUser
+	conf.UploadAbuse.MaxPerIP = flags.UploadMaxPerIP
+	conf.UploadAbuse.BlockDuration = flags.UploadBlockDuration
+
+	conf.CookieDomain = flags.CookieDomain
+	conf.CookieSecure = flags.CookieSecure
+	switch strings.ToLower(flags.CookieSameSite) {
+	case "lax":
+		conf.CookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		conf.CookieSameSite = http.SameSiteStrictMode
+	case "none":
+		// браузеры принимают SameSite=None только вместе с Secure
+		conf.CookieSameSite = http.SameSiteNoneMode
+		conf.CookieSecure = true
+	default:
+		log.Fatalf("неизвестная политика SameSite cookie: %s", flags.CookieSameSite)
+	}
+
+	if !slices.Contains([]string{config.CSRFModeOrigin, config.CSRFModeDoubleSubmit, config.CSRFModeOff}, flags.CSRFMode) {
+		log.Fatalf("неизвестный режим защиты от CSRF: %s", flags.CSRFMode)
+	}
+	conf.CSRFMode = flags.CSRFMode
+	for _, origin := range strings.Split(flags.CSRFTrustedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			conf.CSRFTrustedOrigins = append(conf.CSRFTrustedOrigins, origin)
+		}
+	}
+
+	for _, login := range strings.Split(flags.AdminLogins, ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			conf.AdminLogins = append(conf.AdminLogins, login)
+		}
+	}
+
+	conf.TOTPWithdrawAbove = flags.TOTPWithdrawAbove
+
+	conf.LoginLockout.LoginThreshold = flags.LoginMaxFailures
+	conf.LoginLockout.IPThreshold = flags.LoginIPMaxFailures
+	conf.LoginLockout.BaseLockout = flags.LoginLockout
+	conf.PasswordPolicy.MinLength = flags.PasswordMinLength
+	conf.PasswordPolicy.MinClasses = flags.PasswordMinClasses
+	if flags.BreachedPasswordsDir != "" {
+		breached, err := password.NewBreachedList(flags.BreachedPasswordsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.BreachedPasswords = breached
+	}
+
+	if flags.OIDCIssuer != "" {
+		if flags.OIDCClientID == "" || flags.OIDCRedirectURL == "" {
+			log.Fatal("для входа через провайдера OpenID Connect нужны идентификатор клиента и адрес возврата")
+		}
+		conf.OIDC = &oidc.Config{
+			Issuer:       flags.OIDCIssuer,
+			ClientID:     flags.OIDCClientID,
+			ClientSecret: flags.OIDCClientSecret,
+			RedirectURL:  flags.OIDCRedirectURL,
+		}
+		for _, scope := range strings.Split(flags.OIDCScopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				conf.OIDC.Scopes = append(conf.OIDC.Scopes, scope)
+			}
+		}
+		conf.OIDCAutoCreate = flags.OIDCAutoCreate
+	}
+
+	if flags.WebAuthnRPID != "" {
+		conf.WebAuthn = &webauthn.Config{RPID: flags.WebAuthnRPID, RPName: flags.WebAuthnRPName}
+		for _, origin := range strings.Split(flags.WebAuthnOrigins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				conf.WebAuthn.Origins = append(conf.WebAuthn.Origins, origin)
+			}
+		}
+		if len(conf.WebAuthn.Origins) == 0 {
+			log.Fatal("для входа по ключам доступа нужны источники страниц входа")
+		}
+	}
+
+	tokenKeys, err := newTokenKeys(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.TokenKeys = tokenKeys
+
+	orderValidator, err := validator.Parse(flags.OrderValidator)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.OrderValidator = orderValidator
+
+	return conf
+}
+
+// newTokenKeys создание набора ключей подписи JWT токенов из аргумента, переменной окружения или файла,
+// без ключей случайный ключ создается только с разрешением -jwt-random-key,
+// после перезапуска сервиса с таким ключом пользователям придется войти заново
+func newTokenKeys(flags programFlags) (*auth.KeySet, error) {
+	switch {
+	case flags.JWTKeys != "":
+		return auth.ParseKeySet(flags.JWTKeys)
+	case flags.JWTKeysFile != "":
+		return auth.LoadKeySet(flags.JWTKeysFile)
+	case flags.JWTRandomKey:
+		return auth.NewRandomKeySet()
+	}
+
+	return nil, errors.New("ключи подписи JWT токенов не заданы (-jwt-keys, -jwt-keys-file), для разработки используйте -jwt-random-key")
+}
+
+// randomTokenKeys признак запуска сервиса со случайным ключом подписи JWT токенов
+func randomTokenKeys(flags programFlags) bool {
+	return flags.JWTKeys == "" && flags.JWTKeysFile == "" && flags.JWTRandomKey
+}
@@ -12,7 +12,7 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/hardvlad/ypdiploma1/internal/config"
+	"github.com/hardvlad/ypdiploma1/internal/auth"
 	"github.com/hardvlad/ypdiploma1/internal/handler"
 	"github.com/hardvlad/ypdiploma1/internal/logger"
 	"github.com/hardvlad/ypdiploma1/internal/repository/pg"
@@ -43,7 +43,10 @@ func main() {
 	idleConnsClosed := make(chan struct{})
 
 	// создание конфига программы с основными аргументами
-	conf := config.NewConfig(flags.Dsn, flags.AccrualAddress)
+	conf := newConfig(flags)
+	if randomTokenKeys(flags) {
+		sugarLogger.Warnw("ключи подписи JWT токенов не заданы, используется случайный ключ до перезапуска сервиса", "event", "ключи подписи JWT токенов")
+	}
 
 	// инициализация базы данных
 	db, err := conf.DBConfig.InitDB()
@@ -72,6 +75,17 @@ func main() {
 		sugarLogger.Fatalw(err.Error(), "event", "применение миграции")
 	}
 
+	// назначение роли admin пользователям из конфигурации
+	for _, login := range conf.AdminLogins {
+		found, err := store.SetUserRoleByLogin(context.Background(), login, auth.RoleAdmin)
+		if err != nil {
+			sugarLogger.Fatalw(err.Error(), "event", "назначение администратора", "login", login)
+		}
+		if !found {
+			sugarLogger.Warnw("Пользователь для роли admin не найден", "login", login)
+		}
+	}
+
 	var wg sync.WaitGroup
 	numWorkers := 3
 	ch := make(chan string, numWorkers)
@@ -89,7 +103,7 @@ func main() {
 				),
 				sugarLogger,
 			),
-			sugarLogger, conf.CookieName, conf.TokenSecret, db,
+			sugarLogger, conf.CookieName, conf.TokenKeys, store,
 		),
 		sugarLogger,
 	)
@@ -108,6 +122,9 @@ func main() {
 		IdleTimeout:  15 * time.Second,
 	}
 
+	// при остановке сервера завершаем долгоживущие потоки событий, которых Shutdown не дожидается
+	srv.RegisterOnShutdown(cancel)
+
 	go func() {
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -1,22 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/hardvlad/ypdiploma1/internal/config"
+	"github.com/hardvlad/ypdiploma1/internal/auth"
 	"github.com/hardvlad/ypdiploma1/internal/handler"
 	"github.com/hardvlad/ypdiploma1/internal/logger"
+	"github.com/hardvlad/ypdiploma1/internal/oidc"
+	"github.com/hardvlad/ypdiploma1/internal/oidc/oidctest"
 	"github.com/hardvlad/ypdiploma1/internal/repository"
 	"github.com/hardvlad/ypdiploma1/internal/repository/pg"
+	"github.com/hardvlad/ypdiploma1/internal/totp"
 	"github.com/hardvlad/ypdiploma1/internal/util"
+	"github.com/hardvlad/ypdiploma1/internal/webauthn"
+	"github.com/hardvlad/ypdiploma1/internal/webauthn/webauthntest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -56,10 +67,13 @@ func prepareMux() (*sql.DB, http.Handler, error) {
 
 	flags := parseFlags()
 
+	// тесты запускаются со случайным ключом подписи JWT токенов, если ключи не заданы
+	flags.JWTRandomKey = true
+
 	sugarLogger := myLogger.Sugar()
 	sugarLogger.Infow("Старт сервера", "addr", flags.RunAddress)
 
-	conf := config.NewConfig(flags.Dsn, flags.AccrualAddress)
+	conf := newConfig(flags)
 
 	var store repository.StorageInterface
 
@@ -84,7 +98,7 @@ func prepareMux() (*sql.DB, http.Handler, error) {
 				),
 				sugarLogger,
 			),
-			sugarLogger, conf.CookieName, conf.TokenSecret, db,
+			sugarLogger, conf.CookieName, conf.TokenKeys, store,
 		),
 		sugarLogger,
 	)
@@ -127,6 +141,24 @@ func TestRegister(t *testing.T) {
 				code: 200,
 			},
 		},
+		{
+			name:   "register short password #1",
+			method: http.MethodPost,
+			target: "/api/user/register",
+			body:   `{"login":"` + login + `x","password":"short"}`,
+			want: want{
+				code: 400,
+			},
+		},
+		{
+			name:   "register password with login #1",
+			method: http.MethodPost,
+			target: "/api/user/register",
+			body:   `{"login":"` + login + `x","password":"` + login + `x"}`,
+			want: want{
+				code: 400,
+			},
+		},
 		{
 			name:   "register user conflict #1",
 			method: http.MethodPost,
@@ -302,6 +334,195 @@ func TestOrders(t *testing.T) {
 				code: http.StatusNoContent,
 			},
 		},
+		{
+			name:   "order withdraw insufficient funds #1",
+			method: http.MethodPost,
+			target: "/api/user/balance/withdraw",
+			body:   `{"order":"` + orderNumber + `","sum":100}`,
+			want: want{
+				code: http.StatusPaymentRequired,
+			},
+		},
+		{
+			name:   "order get orders page #1",
+			method: http.MethodGet,
+			target: "/api/user/orders?limit=1",
+			body:   "",
+			want: want{
+				code: http.StatusOK,
+			},
+		},
+		{
+			name:   "order get orders bad limit #1",
+			method: http.MethodGet,
+			target: "/api/user/orders?limit=0",
+			body:   "",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "order get orders bad limit #2",
+			method: http.MethodGet,
+			target: "/api/user/orders?limit=1001",
+			body:   "",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "order get single order #1",
+			method: http.MethodGet,
+			target: "/api/user/orders/" + orderNumber,
+			body:   "",
+			want: want{
+				code: http.StatusOK,
+			},
+		},
+		{
+			name:   "order get unknown order #1",
+			method: http.MethodGet,
+			target: "/api/user/orders/" + badOrderNumber,
+			body:   "",
+			want: want{
+				code: http.StatusNotFound,
+			},
+		},
+		{
+			name:   "order post batch unsupported format #1",
+			method: http.MethodPost,
+			target: "/api/user/orders/batch",
+			body:   orderNumber,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post bad url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"ftp://example.com","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post loopback url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"http://127.0.0.1:8080/hook","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post metadata url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"http://169.254.169.254/latest/meta-data","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post cgnat url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"http://100.64.12.34/hook","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post benchmark url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"http://198.18.0.1/hook","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post reserved url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"http://240.0.0.1/hook","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook post nat64 url #1",
+			method: http.MethodPost,
+			target: "/api/user/webhooks",
+			body:   `{"url":"http://[64:ff9b::a00:1]/hook","events":["accrual"]}`,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "webhook get no webhooks #1",
+			method: http.MethodGet,
+			target: "/api/user/webhooks",
+			body:   "",
+			want: want{
+				code: http.StatusNoContent,
+			},
+		},
+		{
+			name:   "order get withdrawals grouped #1",
+			method: http.MethodGet,
+			target: "/api/user/withdrawals?group_by=month&from=2020-01-01",
+			body:   "",
+			want: want{
+				code: http.StatusNoContent,
+			},
+		},
+		{
+			name:   "order get withdrawals bad group #1",
+			method: http.MethodGet,
+			target: "/api/user/withdrawals?group_by=year",
+			body:   "",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "order get withdrawals bad limit #1",
+			method: http.MethodGet,
+			target: "/api/user/withdrawals?limit=1001",
+			body:   "",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "order dispute unknown order #1",
+			method: http.MethodPost,
+			target: "/api/user/orders/12345678903/dispute",
+			body:   `{"reason":"начисление не поступило"}`,
+			want: want{
+				code: http.StatusNotFound,
+			},
+		},
+		{
+			name:   "order get disputes #1",
+			method: http.MethodGet,
+			target: "/api/user/disputes",
+			body:   "",
+			want: want{
+				code: http.StatusNoContent,
+			},
+		},
+		{
+			name:   "admin disputes as user #1",
+			method: http.MethodGet,
+			target: "/api/admin/disputes",
+			body:   "",
+			want: want{
+				code: http.StatusForbidden,
+			},
+		},
 	}
 
 	mux := globalMux
@@ -341,6 +562,1405 @@ func TestOrders(t *testing.T) {
 	}
 }
 
+func TestOrdersBatch(t *testing.T) {
+	client := newTestServer(t)
+	orderNumber := luhnNumber(t, 8)
+
+	// ответ не ждет опроса системы начислений, принятые заказы стоят в очереди опроса
+	w := client.DoJSON(http.MethodPost, "/api/user/orders/batch", `["`+orderNumber+`","12345"]`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var response handler.BatchOrdersResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, 1, response.Accepted)
+	require.Len(t, response.Results, 2)
+	assert.Equal(t, repository.OrderResultAccepted, response.Results[0].Result)
+	assert.Equal(t, repository.OrderResultInvalid, response.Results[1].Result)
+
+	var queued bool
+	err := globalDB.QueryRow("SELECT next_poll_at IS NOT NULL FROM orders WHERE number = $1", orderNumber).Scan(&queued)
+	require.NoError(t, err)
+	assert.True(t, queued)
+
+	w = client.DoJSON(http.MethodPost, "/api/user/orders/batch", `[`+strings.Repeat(`"1",`, 1000)+`"1"]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOrdersPagination(t *testing.T) {
+	client := newTestServer(t)
+
+	// заказы загружены в разные месяцы, последний из них уже рассчитан, заказы добавляются
+	// в базу данных без очереди опроса, чтобы воркеры не меняли статусы во время теста
+	numbers := []string{luhnNumber(t, 11), luhnNumber(t, 11), luhnNumber(t, 11)}
+	statuses := []string{"NEW", "NEW", "PROCESSED"}
+	for i, number := range numbers {
+		_, err := globalDB.Exec(`INSERT INTO orders (number, user_id, status_id, uploaded_at)
+                  VALUES ($1, $2, (select id from statuses where name = $3), $4)`,
+			number, client.UserID, statuses[i], time.Date(2024, time.Month(i+1), 10, 12, 0, 0, 0, time.UTC))
+		require.NoError(t, err)
+	}
+
+	getOrders := func(target string) (*httptest.ResponseRecorder, []string) {
+		w := client.Do(http.MethodGet, target, "")
+		if w.Code != http.StatusOK {
+			return w, nil
+		}
+		var orders []repository.OrdersResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&orders))
+		result := make([]string, 0, len(orders))
+		for _, order := range orders {
+			result = append(result, order.OrderNumber)
+		}
+		return w, result
+	}
+
+	// без limit и cursor выдается весь список без ссылки на следующую страницу
+	w, orders := getOrders("/api/user/orders")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[2], numbers[1], numbers[0]}, orders)
+	assert.Empty(t, w.Header().Get("Link"))
+	assert.Empty(t, w.Header().Get("X-Next-Cursor"))
+
+	// первая страница ссылается на следующую
+	w, firstPage := getOrders("/api/user/orders?limit=2")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[2], numbers[1]}, firstPage)
+	cursor := w.Header().Get("X-Next-Cursor")
+	require.NotEmpty(t, cursor)
+	link := w.Header().Get("Link")
+	assert.Equal(t, `</api/user/orders?cursor=`+url.QueryEscape(cursor)+`&limit=2>; rel="next"`, link)
+
+	// следующая страница по ссылке продолжает выдачу без повторов и оказывается последней
+	nextURL, _, found := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+	require.True(t, found)
+	w, secondPage := getOrders(nextURL)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[0]}, secondPage)
+	assert.Empty(t, w.Header().Get("Link"))
+	assert.Empty(t, w.Header().Get("X-Next-Cursor"))
+
+	// cursor без limit продолжает выдачу страницей размера по умолчанию
+	w, orders = getOrders("/api/user/orders?cursor=" + url.QueryEscape(cursor))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[0]}, orders)
+
+	// фильтры по статусу и дате загрузки сужают выдачу
+	w, orders = getOrders("/api/user/orders?status=PROCESSED")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[2]}, orders)
+
+	w, orders = getOrders("/api/user/orders?status=NEW&from=2024-01-01&to=2024-02-28")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[1], numbers[0]}, orders)
+
+	w, orders = getOrders("/api/user/orders?from=2024-02-01T00:00:00Z&to=2024-02-10")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{numbers[1]}, orders)
+
+	w, _ = getOrders("/api/user/orders?status=INVALID")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w, _ = getOrders("/api/user/orders?status=UNKNOWN")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWithdrawalsPagination(t *testing.T) {
+	client := newTestServer(t)
+
+	// списания за два месяца, два из них в один день
+	withdrawals := []struct {
+		number string
+		sum    float64
+		at     time.Time
+	}{
+		{number: luhnNumber(t, 11), sum: 10, at: time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC)},
+		{number: luhnNumber(t, 11), sum: 20, at: time.Date(2024, 1, 20, 9, 0, 0, 0, time.UTC)},
+		{number: luhnNumber(t, 11), sum: 5, at: time.Date(2024, 2, 5, 9, 0, 0, 0, time.UTC)},
+		{number: luhnNumber(t, 11), sum: 7.5, at: time.Date(2024, 2, 5, 18, 0, 0, 0, time.UTC)},
+	}
+	for _, withdrawal := range withdrawals {
+		_, err := globalDB.Exec("INSERT INTO withdrawals (user_id, number, amount, processed_at) VALUES ($1, $2, $3, $4)",
+			client.UserID, withdrawal.number, withdrawal.sum, withdrawal.at)
+		require.NoError(t, err)
+	}
+
+	getWithdrawals := func(target string) (*httptest.ResponseRecorder, []string) {
+		w := client.Do(http.MethodGet, target, "")
+		if w.Code != http.StatusOK {
+			return w, nil
+		}
+		var page []repository.WithdrawalsResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		result := make([]string, 0, len(page))
+		for _, withdrawal := range page {
+			result = append(result, withdrawal.OrderNumber)
+		}
+		return w, result
+	}
+
+	w, all := getWithdrawals("/api/user/withdrawals")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{withdrawals[3].number, withdrawals[2].number, withdrawals[1].number, withdrawals[0].number}, all)
+	assert.Empty(t, w.Header().Get("X-Next-Cursor"))
+
+	// выдача страницами продолжается по курсору без повторов и пропусков
+	var paged []string
+	target := "/api/user/withdrawals?limit=3"
+	for pages := 0; target != ""; pages++ {
+		require.Less(t, pages, 2)
+		w, page := getWithdrawals(target)
+		require.Equal(t, http.StatusOK, w.Code)
+		paged = append(paged, page...)
+
+		target = ""
+		if cursor := w.Header().Get("X-Next-Cursor"); cursor != "" {
+			assert.Len(t, page, 3)
+			assert.Contains(t, w.Header().Get("Link"), `rel="next"`)
+			target = "/api/user/withdrawals?limit=3&cursor=" + url.QueryEscape(cursor)
+		}
+	}
+	assert.Equal(t, all, paged)
+
+	// дата в to включается в диапазон целиком
+	w, page := getWithdrawals("/api/user/withdrawals?from=2024-01-15&to=2024-02-05")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{withdrawals[3].number, withdrawals[2].number, withdrawals[1].number}, page)
+
+	w, page = getWithdrawals("/api/user/withdrawals?from=2024-01-01T00:00:00Z&to=2024-01-20T09:00:00Z")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{withdrawals[0].number}, page)
+
+	w, _ = getWithdrawals("/api/user/withdrawals?from=2025-01-01")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	getAggregates := func(target string) []repository.WithdrawalsAggregate {
+		w := client.Do(http.MethodGet, target, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var aggregates []repository.WithdrawalsAggregate
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&aggregates))
+		return aggregates
+	}
+
+	assert.Equal(t, []repository.WithdrawalsAggregate{
+		{Period: "2024-02-05", Sum: 12.5, Count: 2},
+		{Period: "2024-01-20", Sum: 20, Count: 1},
+		{Period: "2024-01-10", Sum: 10, Count: 1},
+	}, getAggregates("/api/user/withdrawals?group_by=day"))
+
+	assert.Equal(t, []repository.WithdrawalsAggregate{
+		{Period: "2024-02", Sum: 12.5, Count: 2},
+		{Period: "2024-01", Sum: 30, Count: 2},
+	}, getAggregates("/api/user/withdrawals?group_by=month"))
+
+	// группировка учитывает диапазон времени
+	assert.Equal(t, []repository.WithdrawalsAggregate{
+		{Period: "2024-01", Sum: 20, Count: 1},
+	}, getAggregates("/api/user/withdrawals?group_by=month&from=2024-01-15&to=2024-01-31"))
+}
+
+func TestOrderGoodsRegistration(t *testing.T) {
+	accrual := newFakeAccrual(t)
+
+	// отдельный экземпляр сервиса с системой начислений теста
+	conf := newConfig(globalFlags)
+	conf.AccrualAddress = accrual.URL
+	client := newTestClient(t, newTestInstance(t, conf))
+
+	orderState := func(number string) (status string, orderAccrual float64, registered bool, queued bool) {
+		const sqlStmt = `
+        SELECT s.name, o.accrual, o.accrual_registered_at IS NOT NULL, o.next_poll_at IS NOT NULL
+        FROM orders o JOIN statuses s ON o.status_id = s.id WHERE o.number = $1
+`
+		err := globalDB.QueryRow(sqlStmt, number).Scan(&status, &orderAccrual, &registered, &queued)
+		require.NoError(t, err)
+		return
+	}
+
+	// заказ с товарами регистрируется в системе начислений до запроса начислений
+	number := luhnNumber(t, 11)
+	accrual.SetOrder(number, "PROCESSED", 500)
+	w := client.DoJSON(http.MethodPost, "/api/user/orders", `{"order":"`+number+`","goods":[{"description":"Чайник Bork","price":7000},{"description":"Чашка","price":500.5}]}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	require.Eventually(t, func() bool {
+		status, _, _, _ := orderState(number)
+		return status == "PROCESSED"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, orderAccrual, registered, queued := orderState(number)
+	assert.Equal(t, 500.0, orderAccrual)
+	assert.True(t, registered)
+	assert.False(t, queued)
+
+	// заказ может одновременно взять и воркер очереди опроса, поэтому запросов регистрации может быть несколько
+	goods, calls := accrual.Registered(number)
+	assert.GreaterOrEqual(t, calls, 1)
+	assert.Equal(t, []repository.OrderGood{{Description: "Чайник Bork", Price: 7000}, {Description: "Чашка", Price: 500.5}}, goods)
+
+	// заказ без товаров не регистрируется
+	plain := luhnNumber(t, 11)
+	accrual.SetOrder(plain, "PROCESSED", 10)
+	require.Equal(t, http.StatusAccepted, client.Do(http.MethodPost, "/api/user/orders", plain).Code)
+	require.Eventually(t, func() bool {
+		status, _, _, _ := orderState(plain)
+		return status == "PROCESSED"
+	}, 10*time.Second, 100*time.Millisecond)
+	_, calls = accrual.Registered(plain)
+	assert.Equal(t, 0, calls)
+
+	// товары проверяются при загрузке
+	assert.Equal(t, http.StatusBadRequest, client.DoJSON(http.MethodPost, "/api/user/orders", `{"order":"`+luhnNumber(t, 11)+`","goods":[{"description":"Чашка","price":0}]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, client.DoJSON(http.MethodPost, "/api/user/orders", `{"order":`).Code)
+
+	// неудачная регистрация оставляет заказ в очереди опроса для повторной попытки
+	failed := luhnNumber(t, 11)
+	accrual.FailRegistration(http.StatusInternalServerError)
+	w = client.DoJSON(http.MethodPost, "/api/user/orders", `{"order":"`+failed+`","goods":[{"description":"Чайник Bork","price":7000}]}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	require.Eventually(t, func() bool {
+		_, calls := accrual.Registered(failed)
+		return calls > 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	status, _, registered, queued := orderState(failed)
+	assert.Equal(t, "NEW", status)
+	assert.False(t, registered)
+	assert.True(t, queued)
+}
+
+func TestReconcileDebt(t *testing.T) {
+	accrual := newFakeAccrual(t)
+
+	// отдельный экземпляр сервиса с системой начислений теста и частой сверкой
+	conf := newConfig(globalFlags)
+	conf.AccrualAddress = accrual.URL
+	conf.ReconcileInterval = 200 * time.Millisecond
+	client := newTestClient(t, newTestInstance(t, conf))
+
+	getBalance := func() handler.GetBalanceResponse {
+		w := client.Do(http.MethodGet, "/api/user/balance", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var balance handler.GetBalanceResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&balance))
+		return balance
+	}
+
+	// без заказов баланс складывается из корректировок
+	_, err := globalDB.Exec("INSERT INTO balance_adjustments (user_id, amount, source, reason) VALUES ($1, 25, 'dispute', 'тест')", client.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, 25.0, getBalance().Current)
+
+	// завершенные заказы добавляются в базу данных без очереди опроса, система начислений их пока не знает
+	const insertStmt = `
+    INSERT INTO orders (number, user_id, status_id, accrual, processed_at)
+    VALUES ($1, $2, (select id from statuses where name = 'PROCESSED'), $3, now())
+`
+	number := luhnNumber(t, 11)
+	_, err = globalDB.Exec(insertStmt, number, client.UserID, 500)
+	require.NoError(t, err)
+	unknown := luhnNumber(t, 11)
+	_, err = globalDB.Exec(insertStmt, unknown, client.UserID, 50)
+	require.NoError(t, err)
+
+	// неудачная сверка отмечается, чтобы заказ не задерживал очередь сверки, начисление не меняется
+	reconciled := func(number string) bool {
+		var stamped bool
+		err := globalDB.QueryRow("SELECT reconciled_at IS NOT NULL FROM orders WHERE number = $1", number).Scan(&stamped)
+		require.NoError(t, err)
+		return stamped
+	}
+	require.Eventually(t, func() bool { return reconciled(number) && reconciled(unknown) }, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, 575.0, getBalance().Current)
+
+	w := client.DoJSON(http.MethodPost, "/api/user/balance/withdraw", `{"order":"`+luhnNumber(t, 11)+`","sum":400}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// система начислений пересмотрела начисление в меньшую сторону - баланс уходит в минус
+	accrual.SetOrder(number, "PROCESSED", 100)
+	require.Eventually(t, func() bool { return getBalance().Flagged }, 10*time.Second, 100*time.Millisecond)
+
+	balance := getBalance()
+	assert.Equal(t, -225.0, balance.Current)
+	assert.Equal(t, 225.0, balance.Debt)
+	assert.Equal(t, 400.0, balance.Withdrawn)
+
+	var adjustment float64
+	err = globalDB.QueryRow(`
+        SELECT sum(a.amount) FROM balance_adjustments a JOIN orders o ON a.order_id = o.id
+        WHERE o.number = $1 AND a.source = $2`, number, repository.AdjustmentSourceReconcile).Scan(&adjustment)
+	require.NoError(t, err)
+	assert.Equal(t, -400.0, adjustment)
+
+	// при задолженности списания заблокированы
+	w = client.DoJSON(http.MethodPost, "/api/user/balance/withdraw", `{"order":"`+luhnNumber(t, 11)+`","sum":1}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "negative_balance")
+}
+
+func TestRefreshLogout(t *testing.T) {
+	client := newTestServer(t)
+	conf := newConfig(globalFlags)
+
+	// cookie поиск cookie с именем name в ответе
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	// serve выполняет запрос с одной переданной cookie
+	serve := func(method, target, body string, c *http.Cookie) int {
+		return client.DoWith([]*http.Cookie{c}, method, target, body).Code
+	}
+
+	refresh := client.Cookie(conf.RefreshCookieName)
+	require.NotNil(t, refresh)
+
+	// обновление токенов заменяет refresh токен
+	w := client.DoWith([]*http.Cookie{refresh}, http.MethodPost, "/api/user/token/refresh", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	access := cookie(w, conf.CookieName)
+	require.NotNil(t, access)
+	assert.NotNil(t, cookie(w, conf.RefreshCookieName))
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/user/balance", "", access))
+
+	// повторное использование замененного refresh токена отзывает вход вместе с access токеном
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "/api/user/token/refresh", "", refresh))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/api/user/balance", "", access))
+
+	// после выхода access токен не принимается
+	client.Cookies = client.Relogin()
+	access = client.Cookie(conf.CookieName)
+	require.NotNil(t, access)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "/api/user/logout", "", access))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/api/user/balance", "", access))
+
+	// смена пароля завершает прежние входы и выдает новые токены
+	client.Cookies = client.Relogin()
+	access = client.Cookie(conf.CookieName)
+	require.NotNil(t, access)
+
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, "/api/user/password", `{"old_password":"wrong-password","new_password":"zzzzwwww1"}`, access))
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/api/user/password", `{"old_password":"xxxxyyyy","new_password":"short"}`, access))
+
+	w = client.DoWith([]*http.Cookie{access}, http.MethodPost, "/api/user/password", `{"old_password":"xxxxyyyy","new_password":"zzzzwwww1"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	newAccess := cookie(w, conf.CookieName)
+	require.NotNil(t, newAccess)
+
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/api/user/balance", "", access))
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/user/balance", "", newAccess))
+}
+
+func TestBearerToken(t *testing.T) {
+	client := newAnonymousClient(t, globalMux)
+	client.Login = "testuser" + util.GenerateRandomString(6)
+	acceptJSON := http.Header{"Accept": {"application/json"}}
+
+	// по запросу клиента токены выдаются в JSON
+	w := client.DoWithHeader(nil, acceptJSON, http.MethodPost, "/api/user/register", `{"login":"`+client.Login+`","password":"`+testPassword+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens handler.TokenResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tokens))
+	require.NotEmpty(t, tokens.AccessToken)
+	require.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, "Bearer", tokens.TokenType)
+
+	w = client.DoWithHeader(nil, http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// refresh токен передается в теле запроса
+	w = client.DoWithHeader(nil, acceptJSON, http.MethodPost, "/api/user/token/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = client.DoWithHeader(nil, http.Header{"Authorization": {"Bearer invalid"}}, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCSRFOrigin(t *testing.T) {
+	client := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		origin string
+		bearer bool
+		code   int
+	}{
+		{name: "csrf foreign origin", origin: "https://evil.example", code: http.StatusForbidden},
+		{name: "csrf same origin", origin: "http://example.com", code: http.StatusBadRequest},
+		{name: "csrf foreign origin with bearer", origin: "https://evil.example", bearer: true, code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{
+				"Content-Type": {"application/json"},
+				"Origin":       {test.origin},
+			}
+			if test.bearer {
+				header.Set("Authorization", "Bearer "+client.Cookie("yp_diploma_one_token").Value)
+			}
+
+			// тело не является номером заказа - прошедший проверку CSRF запрос завершается StatusBadRequest
+			w := client.DoWithHeader(client.Cookies, header, http.MethodPost, "/api/user/orders", `{`)
+			assert.Equal(t, test.code, w.Code)
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	client := newAnonymousClient(t, globalMux)
+	// отдельный адрес, чтобы неудачные попытки теста не блокировали вход другим тестам
+	client.RemoteAddr = "198.51.100." + strconv.Itoa(1+rand.Intn(250)) + ":1234"
+	client.Register()
+	unknownLogin := "testuser" + util.GenerateRandomString(10)
+
+	login := func(name, password string) int {
+		return client.DoWith(nil, http.MethodPost, "/api/user/login", `{"login":"`+name+`","password":"`+password+`"}`).Code
+	}
+
+	// существующий и несуществующий логины блокируются одинаково
+	for _, name := range []string{client.Login, unknownLogin} {
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusUnauthorized, login(name, "wrong-password"))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, login(name, "wrong-password"))
+	}
+
+	// во время блокировки не принимается и верный пароль
+	assert.Equal(t, http.StatusTooManyRequests, login(client.Login, testPassword))
+}
+
+func TestAPIKeys(t *testing.T) {
+	client := newTestServer(t)
+
+	// withKey выполняет запрос без cookie с API ключом в заголовке name
+	withKey := func(name, value, method, target, body string) int {
+		return client.DoWithHeader(nil, http.Header{name: {value}}, method, target, body).Code
+	}
+
+	w := client.Do(http.MethodPost, "/api/user/api-keys", `{"name":"partner","scopes":["unknown"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = client.Do(http.MethodPost, "/api/user/api-keys", `{"name":"partner","scopes":["balance:read"]}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var apiKey repository.APIKey
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&apiKey))
+	require.NotEmpty(t, apiKey.Key)
+
+	// ключ дает доступ только к методам своих областей доступа
+	assert.Equal(t, http.StatusOK, withKey("X-API-Key", apiKey.Key, http.MethodGet, "/api/user/balance", ""))
+	assert.Equal(t, http.StatusOK, withKey("Authorization", "Bearer "+apiKey.Key, http.MethodGet, "/api/user/balance", ""))
+	assert.Equal(t, http.StatusForbidden, withKey("X-API-Key", apiKey.Key, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":1}`))
+	assert.Equal(t, http.StatusForbidden, withKey("X-API-Key", apiKey.Key, http.MethodGet, "/api/user/api-keys", ""))
+
+	// отозванный ключ не принимается
+	w = client.Do(http.MethodDelete, "/api/user/api-keys/"+strconv.Itoa(apiKey.ID), "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, withKey("X-API-Key", apiKey.Key, http.MethodGet, "/api/user/balance", ""))
+}
+
+func TestRoles(t *testing.T) {
+	w := newAnonymousClient(t, globalMux).Do(http.MethodGet, "/api/admin/disputes", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	client := newTestServer(t)
+
+	// обычному пользователю административные методы недоступны
+	w = client.Do(http.MethodGet, "/api/admin/disputes", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// смена роли отзывает выданные токены
+	cookies := client.Cookies
+	client.WithRole(auth.RoleSupport)
+	w = client.DoWith(cookies, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = client.Do(http.MethodGet, "/api/admin/disputes", "")
+	assert.Contains(t, []int{http.StatusOK, http.StatusNoContent}, w.Code)
+
+	// поддержка не начисляет корректировки и не управляет ролями
+	w = client.Do(http.MethodPost, "/api/admin/disputes/1/resolve", `{"amount":1}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = client.Do(http.MethodPut, "/api/admin/users/1/role", `{"role":"admin"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider, err := oidctest.NewProvider("gophermart", "client-secret")
+	require.NoError(t, err)
+	defer provider.Close()
+
+	subject := "employee-" + util.GenerateRandomString(6)
+	provider.SetIdentity(oidctest.Identity{Subject: subject, Email: subject + "@example.com", PreferredUsername: subject})
+
+	// отдельный экземпляр сервиса с входом через тестового провайдера
+	conf := newConfig(globalFlags)
+	conf.OIDC = &oidc.Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     "gophermart",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://example.com/api/user/oidc/callback",
+	}
+	conf.OIDCAutoCreate = true
+	client := newAnonymousClient(t, newTestInstance(t, conf))
+	store := testStore()
+
+	login := func() (*url.URL, []*http.Cookie) {
+		w := client.Do(http.MethodGet, "/api/user/oidc/login", "")
+		require.Equal(t, http.StatusFound, w.Code)
+
+		callback, err := provider.Authorize(w.Header().Get("Location"))
+		require.NoError(t, err)
+		return callback, w.Result().Cookies()
+	}
+
+	// возврат без cookie state начатого входа отклоняется
+	callback, _ := login()
+	w := client.Do(http.MethodGet, callback.RequestURI(), "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	callback, stateCookies := login()
+	w = client.DoWith(stateCookies, http.MethodGet, callback.RequestURI(), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+
+	// повторный возврат с тем же state не принимается
+	w = client.DoWith(stateCookies, http.MethodGet, callback.RequestURI(), "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = client.DoWith(cookies, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// повторный вход находит связанного пользователя
+	callback, stateCookies = login()
+	w = client.DoWith(stateCookies, http.MethodGet, callback.RequestURI(), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	userID, err := store.GetUserIDByLogin(context.Background(), subject)
+	require.NoError(t, err)
+	linkedUserID, err := store.GetUserIDByIdentity(context.Background(), repository.Identity{Issuer: provider.Issuer(), Subject: subject})
+	require.NoError(t, err)
+	assert.Equal(t, userID, linkedUserID)
+
+	// пользователь без пароля устанавливает пароль только вскоре после входа
+	_, err = globalDB.Exec("UPDATE token_families SET created_at = created_at - interval '1 hour' WHERE user_id = $1", userID)
+	require.NoError(t, err)
+	w = client.DoWith(cookies, http.MethodPost, "/api/user/password", `{"new_password":"zzzzwwww1"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "reauthentication_required")
+
+	callback, stateCookies = login()
+	w = client.DoWith(stateCookies, http.MethodGet, callback.RequestURI(), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	w = client.DoWith(w.Result().Cookies(), http.MethodPost, "/api/user/password", `{"new_password":"zzzzwwww1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// установка пароля завершает прежние входы
+	w = client.DoWith(cookies, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestTOTP(t *testing.T) {
+	client := newTestServer(t)
+
+	w := client.Do(http.MethodPost, "/api/user/2fa/totp", "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	var enroll handler.TOTPEnrollResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&enroll))
+	assert.Contains(t, enroll.ProvisioningURI, "otpauth://totp/")
+
+	w = client.Do(http.MethodPost, "/api/user/2fa/totp/confirm", `{"code":"000000x"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	code, err := totp.Code(enroll.Secret, time.Now())
+	require.NoError(t, err)
+	w = client.Do(http.MethodPost, "/api/user/2fa/totp/confirm", `{"code":"`+code+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var recovery handler.RecoveryCodesResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&recovery))
+	require.Len(t, recovery.RecoveryCodes, 10)
+
+	// крупное списание требует свежий код, код подтверждения подключения повторно не принимается
+	w = client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":5000}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":5000,"totp_code":"`+code+`"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	nextCode, err := totp.Code(enroll.Secret, time.Now().Add(totp.Period))
+	require.NoError(t, err)
+	w = client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":5000,"totp_code":"`+nextCode+`"}`)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+
+	// вход становится двухшаговым
+	loginFirstStep := func() string {
+		w := client.DoWith(nil, http.MethodPost, "/api/user/login", `{"login":"`+client.Login+`","password":"`+testPassword+`"}`)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		var mfa handler.MFARequiredResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&mfa))
+		require.NotEmpty(t, mfa.MFAToken)
+		return mfa.MFAToken
+	}
+
+	mfaToken := loginFirstStep()
+	w = client.DoWith(nil, http.MethodPost, "/api/user/login/2fa", `{"mfa_token":"`+mfaToken+`","code":"`+code+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = client.DoWith(nil, http.MethodPost, "/api/user/login/2fa", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+recovery.RecoveryCodes[0]+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	client.Cookies = w.Result().Cookies()
+
+	// код восстановления одноразовый
+	mfaToken = loginFirstStep()
+	w = client.DoWith(nil, http.MethodPost, "/api/user/login/2fa", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+recovery.RecoveryCodes[0]+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = client.Do(http.MethodDelete, "/api/user/2fa/totp", `{"recovery_code":"`+recovery.RecoveryCodes[1]+`"}`)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	client.Relogin()
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	client := newTestServer(t)
+
+	w := client.Do(http.MethodPost, "/api/user/2fa/totp", "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	var enroll handler.TOTPEnrollResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&enroll))
+
+	code, err := totp.Code(enroll.Secret, time.Now())
+	require.NoError(t, err)
+	w = client.Do(http.MethodPost, "/api/user/2fa/totp/confirm", `{"code":"`+code+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var recovery handler.RecoveryCodesResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&recovery))
+
+	// неверный код не совпадает с кодами соседних шагов времени, которые принимает проверка
+	wrongCode := "000000"
+	for _, shift := range []time.Duration{-totp.Period, 0, totp.Period, 2 * totp.Period} {
+		valid, err := totp.Code(enroll.Secret, time.Now().Add(shift))
+		require.NoError(t, err)
+		if valid == wrongCode {
+			wrongCode = "999999"
+		}
+	}
+
+	withdraw := func(code string) *httptest.ResponseRecorder {
+		return client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"`+luhnNumber(t, 9)+`","sum":5000,"totp_code":"`+code+`"}`)
+	}
+
+	limit := newConfig(globalFlags).SecondFactorLockout.Threshold
+	for i := 0; i < limit; i++ {
+		w = withdraw(wrongCode)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_totp_code")
+	}
+
+	// после порога не принимается даже верный код, блокировка общая для всех проверок второго фактора пользователя
+	nextCode, err := totp.Code(enroll.Secret, time.Now().Add(totp.Period))
+	require.NoError(t, err)
+	w = withdraw(nextCode)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "second_factor_locked")
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Positive(t, retryAfter)
+
+	w = client.Do(http.MethodDelete, "/api/user/2fa/totp", `{"recovery_code":"`+recovery.RecoveryCodes[0]+`"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// по окончании блокировки верный код принимается и сбрасывает счетчик
+	_, err = globalDB.Exec("UPDATE second_factor_lockouts SET locked_until = now() WHERE user_id = $1", client.UserID)
+	require.NoError(t, err)
+	w = withdraw(nextCode)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+
+	var counters int
+	err = globalDB.QueryRow("SELECT count(*) FROM second_factor_lockouts WHERE user_id = $1", client.UserID).Scan(&counters)
+	require.NoError(t, err)
+	assert.Zero(t, counters)
+}
+
+func TestSessions(t *testing.T) {
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	const iphone = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"
+
+	client := newAnonymousClient(t, globalMux)
+	client.Header.Set("User-Agent", firefox)
+	desktop := client.Register().Cookies
+
+	client.Header.Set("User-Agent", iphone)
+	phone := client.Relogin()
+	client.Header.Set("User-Agent", firefox)
+
+	w := client.Do(http.MethodGet, "/api/user/sessions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []repository.Session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sessions))
+	require.Len(t, sessions, 2)
+
+	var current, other repository.Session
+	for _, session := range sessions {
+		if session.Current {
+			current = session
+		} else {
+			other = session
+		}
+	}
+	assert.Equal(t, "Firefox, Linux", current.Device)
+	assert.Equal(t, firefox, current.UserAgent)
+	assert.Equal(t, "Safari, iOS", other.Device)
+	assert.NotEmpty(t, other.IP)
+
+	// отозванная сессия перестает приниматься сразу, не дожидаясь истечения access токена
+	w = client.Do(http.MethodDelete, "/api/user/sessions/"+other.ID, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	client.Header.Set("User-Agent", iphone)
+	w = client.DoWith(phone, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = client.DoWith(phone, http.MethodPost, "/api/user/token/refresh", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	client.Header.Set("User-Agent", firefox)
+
+	w = client.Do(http.MethodDelete, "/api/user/sessions/"+other.ID, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// чужую сессию отозвать нельзя
+	stranger := newTestServer(t)
+	w = stranger.Do(http.MethodDelete, "/api/user/sessions/"+current.ID, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = client.DoWith(desktop, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestWebAuthn(t *testing.T) {
+	// отдельный экземпляр сервиса с входом по ключам доступа
+	conf := newConfig(globalFlags)
+	conf.WebAuthn = &webauthn.Config{RPID: "localhost", RPName: "Gophermart", Origins: []string{"http://localhost:8080"}}
+	client := newTestClient(t, newTestInstance(t, conf))
+	cookies := client.Cookies
+
+	// serve выполняет запрос с телом body в формате JSON
+	serve := func(method, target string, body any, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		raw, err := json.Marshal(body)
+		require.NoError(t, err)
+		return client.DoWith(cookies, method, target, string(raw))
+	}
+
+	w := serve(http.MethodGet, "/api/user/webauthn/credentials", nil, cookies)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	authenticator := webauthntest.NewAuthenticator("http://localhost:8080")
+
+	register := func() *httptest.ResponseRecorder {
+		w := serve(http.MethodPost, "/api/user/webauthn/register/begin", nil, cookies)
+		require.Equal(t, http.StatusOK, w.Code)
+		var options webauthn.RegistrationOptions
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&options))
+
+		response, err := authenticator.Register(options)
+		require.NoError(t, err)
+		return serve(http.MethodPost, "/api/user/webauthn/register/finish", handler.WebAuthnRegisterRequest{Name: "laptop", RegistrationResponse: *response}, cookies)
+	}
+
+	w = register()
+	require.Equal(t, http.StatusCreated, w.Code)
+	var credential repository.WebAuthnCredential
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&credential))
+	assert.Equal(t, "laptop", credential.Name)
+
+	beginLogin := func(body any) webauthn.LoginOptions {
+		w := serve(http.MethodPost, "/api/user/webauthn/login/begin", body, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var options webauthn.LoginOptions
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&options))
+		return options
+	}
+
+	// вход по логину предлагает ключи пользователя
+	options := beginLogin(map[string]string{"login": client.Login})
+	require.Len(t, options.AllowCredentials, 1)
+	assert.Equal(t, credential.CredentialID, options.AllowCredentials[0].ID)
+
+	response, err := authenticator.Login(options)
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(http.MethodGet, "/api/user/balance", nil, w.Result().Cookies())
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// вызов одноразовый
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// копия ключа со старым счетчиком отклоняется
+	authenticator.Credentials[0].SignCount = 0
+	response, err = authenticator.Login(beginLogin(nil))
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// вход без логина по ключу, хранящему пользователя на аутентификаторе
+	authenticator.Credentials[0].SignCount = 10
+	response, err = authenticator.Login(beginLogin(nil))
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// ключ без проверки пользователя - один фактор, при подключенном TOTP нужен второй шаг входа
+	w = serve(http.MethodPost, "/api/user/2fa/totp", nil, cookies)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var enroll handler.TOTPEnrollResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&enroll))
+	code, err := totp.Code(enroll.Secret, time.Now())
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/2fa/totp/confirm", map[string]string{"code": code}, cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	authenticator.UserVerified = false
+	response, err = authenticator.Login(beginLogin(nil))
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// ключ другого пользователя не принимается при входе по логину
+	other := newTestClient(t, client.mux)
+	options = beginLogin(map[string]string{"login": other.Login})
+	assert.Empty(t, options.AllowCredentials)
+	response, err = authenticator.Login(options)
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = serve(http.MethodDelete, "/api/user/webauthn/credentials/"+strconv.Itoa(credential.ID), nil, cookies)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	response, err = authenticator.Login(beginLogin(nil))
+	require.NoError(t, err)
+	w = serve(http.MethodPost, "/api/user/webauthn/login/finish", response, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAccountDeletion(t *testing.T) {
+	ctx := context.Background()
+	store := testStore()
+	orderNumber := luhnNumber(t, 8)
+
+	// отдельный экземпляр сервиса без льготного периода удаления
+	conf := newConfig(globalFlags)
+	conf.DeletionGrace = 0
+	client := newTestClient(t, newTestInstance(t, conf))
+
+	exportData := func() repository.UserExport {
+		w := client.Do(http.MethodGet, "/api/user/export", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+		var export repository.UserExport
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&export))
+		return export
+	}
+
+	export := exportData()
+	assert.Equal(t, client.Login, export.Profile.Login)
+	assert.Equal(t, client.UserID, export.Profile.ID)
+	assert.Empty(t, export.Orders)
+	assert.Empty(t, export.Ledger)
+
+	// заказ с начислением заводится напрямую, без опроса системы начислений
+	require.NoError(t, store.InsertNewOrder(ctx, orderNumber, client.UserID))
+	require.NoError(t, store.SetOrderStatusAccrual(ctx, orderNumber, "PROCESSED", 500))
+
+	w := client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":100}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	export = exportData()
+	require.Len(t, export.Orders, 1)
+	assert.Equal(t, orderNumber, export.Orders[0].OrderNumber)
+	assert.Equal(t, 500.0, export.Orders[0].Accrual)
+	require.Len(t, export.Withdrawals, 1)
+	require.Len(t, export.Ledger, 2)
+	assert.Equal(t, repository.LedgerAccrual, export.Ledger[0].Type)
+	assert.Equal(t, 500.0, export.Ledger[0].Balance)
+	assert.Equal(t, repository.LedgerWithdrawal, export.Ledger[1].Type)
+	assert.Equal(t, -100.0, export.Ledger[1].Amount)
+	assert.Equal(t, 400.0, export.Ledger[1].Balance)
+
+	// некорректный номер попадает в журнал загрузок заказов
+	w = client.Do(http.MethodPost, "/api/user/orders", "12345")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	otherCookies := client.Relogin()
+
+	// удаление подтверждается паролем и может быть отменено до истечения льготного периода
+	w = client.Do(http.MethodDelete, "/api/user", `{"password":"wrong"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = client.Do(http.MethodDelete, "/api/user/deletion", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = client.Do(http.MethodDelete, "/api/user", `{"password":"xxxxyyyy"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	// запрос удаления завершает остальные входы пользователя
+	w = client.DoWith(otherCookies, http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = client.Do(http.MethodDelete, "/api/user/deletion", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	purged, err := store.PurgeUser(ctx, client.UserID)
+	require.NoError(t, err)
+	assert.False(t, purged)
+
+	w = client.Do(http.MethodDelete, "/api/user", `{"password":"xxxxyyyy"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	assert.NotNil(t, exportData().Profile.DeletionScheduledAt)
+
+	purged, err = store.PurgeUser(ctx, client.UserID)
+	require.NoError(t, err)
+	assert.True(t, purged)
+
+	// учетная запись и входы удалены
+	w = client.Do(http.MethodGet, "/api/user/balance", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = client.DoWith(nil, http.MethodPost, "/api/user/login", `{"login":"`+client.Login+`","password":"xxxxyyyy"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	var attempts int
+	err = globalDB.QueryRow("SELECT count(*) FROM order_upload_attempts WHERE user_id = $1", client.UserID).Scan(&attempts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts)
+
+	// финансовые записи сохранены без связи с пользователем
+	var orders, withdrawals int
+	err = globalDB.QueryRow("SELECT count(*) FROM orders WHERE number = $1 AND user_id IS NULL", orderNumber).Scan(&orders)
+	require.NoError(t, err)
+	assert.Equal(t, 1, orders)
+	err = globalDB.QueryRow("SELECT count(*) FROM withdrawals WHERE number = '2377225624' AND user_id IS NULL AND amount = 100").Scan(&withdrawals)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, withdrawals, 1)
+
+	// номер заказа удаленного пользователя остается занятым
+	w = newTestClient(t, client.mux).Do(http.MethodPost, "/api/user/orders", orderNumber)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestDisputeReview(t *testing.T) {
+	ctx := context.Background()
+	store := testStore()
+	orderNumber := luhnNumber(t, 8)
+	client := newTestServer(t)
+
+	require.NoError(t, store.InsertNewOrder(ctx, orderNumber, client.UserID))
+	require.NoError(t, store.SetOrderStatusAccrual(ctx, orderNumber, "PROCESSED", 100))
+
+	w := client.Do(http.MethodPost, "/api/user/orders/"+orderNumber+"/dispute", `{"reason":"начислено меньше"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var dispute repository.Dispute
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&dispute))
+
+	support := newTestServer(t).WithRole(auth.RoleSupport)
+	admin := newTestServer(t).WithRole(auth.RoleAdmin)
+
+	w = support.Do(http.MethodPost, "/api/admin/disputes/"+strconv.Itoa(dispute.ID)+"/review", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = admin.Do(http.MethodPost, "/api/admin/disputes/"+strconv.Itoa(dispute.ID)+"/resolve", `{"resolution":"доначислено","amount":25}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&dispute))
+	assert.Equal(t, support.UserID, dispute.ReviewedBy)
+	assert.NotNil(t, dispute.ReviewedAt)
+	assert.Equal(t, admin.UserID, dispute.ResolvedBy)
+	assert.Equal(t, 25.0, dispute.Adjustment)
+
+	// корректировка записана от имени администратора
+	var createdBy int
+	err := globalDB.QueryRow("SELECT created_by FROM balance_adjustments WHERE user_id = $1 AND source = 'dispute'", client.UserID).Scan(&createdBy)
+	require.NoError(t, err)
+	assert.Equal(t, admin.UserID, createdBy)
+
+	// пользователю администраторы спора не показываются
+	w = client.Do(http.MethodGet, "/api/user/disputes", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var disputes []repository.Dispute
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&disputes))
+	require.Len(t, disputes, 1)
+	assert.Zero(t, disputes[0].ReviewedBy)
+	assert.Zero(t, disputes[0].ResolvedBy)
+}
+
+func TestAdminWithdrawalLimits(t *testing.T) {
+	ctx := context.Background()
+	store := testStore()
+	orderNumber := luhnNumber(t, 8)
+	client := newTestServer(t)
+	admin := newTestServer(t).WithRole(auth.RoleAdmin)
+
+	require.NoError(t, store.InsertNewOrder(ctx, orderNumber, client.UserID))
+	require.NoError(t, store.SetOrderStatusAccrual(ctx, orderNumber, "PROCESSED", 500))
+
+	target := "/api/admin/users/" + strconv.Itoa(client.UserID) + "/withdrawal-limits"
+
+	// ограничения устанавливает только администратор
+	w := client.Do(http.MethodPut, target, `{"max_single":50}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = admin.Do(http.MethodPut, target, `{"max_single":-1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = admin.Do(http.MethodPut, "/api/admin/users/0/withdrawal-limits", `{"max_single":50}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = admin.Do(http.MethodPut, target, `{"max_single":50}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), repository.LimitRuleMaxSingle)
+
+	// после удаления действуют ограничения из конфигурации
+	w = admin.Do(http.MethodDelete, target, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = admin.Do(http.MethodDelete, target, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = client.Do(http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminOrderValidator(t *testing.T) {
+	client := newTestServer(t)
+	admin := newTestServer(t).WithRole(auth.RoleAdmin)
+
+	// номер из 12 цифр с неверной контрольной цифрой Луна
+	invalidLuhn := func() string {
+		number := luhnNumber(t, 11)
+		last := int(number[len(number)-1] - '0')
+		return number[:len(number)-1] + strconv.Itoa((last+1)%10)
+	}
+
+	target := "/api/admin/users/" + strconv.Itoa(client.UserID) + "/order-validator"
+
+	w := client.Do(http.MethodPost, "/api/user/orders", invalidLuhn())
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// схему устанавливает только администратор, некорректная схема не сохраняется
+	w = client.Do(http.MethodPut, target, `{"validator":"regex:[0-9]{12}"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = admin.Do(http.MethodPut, target, `{"validator":"crc32"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = admin.Do(http.MethodPut, target, `{"validator":"regex:[0-9"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = admin.Do(http.MethodPut, "/api/admin/users/0/order-validator", `{"validator":"damm"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = admin.Do(http.MethodPut, target, `{"validator":"regex:[0-9]{12}"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = client.Do(http.MethodPost, "/api/user/orders", invalidLuhn())
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// после удаления действует схема из конфигурации
+	w = admin.Do(http.MethodDelete, target, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = client.Do(http.MethodPost, "/api/user/orders", invalidLuhn())
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestUploadVelocity(t *testing.T) {
+	// отдельный экземпляр сервиса с ограничением в три загрузки пользователем за окно
+	conf := newConfig(globalFlags)
+	conf.UploadAbuse.MaxPerUser = 3
+	conf.UploadAbuse.MaxPerIP = 0
+	mux := newTestInstance(t, conf)
+
+	client := newAnonymousClient(t, mux)
+	client.RemoteAddr = uniqueRemoteAddr()
+	client.Register()
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusAccepted, client.Do(http.MethodPost, "/api/user/orders", luhnNumber(t, 11)).Code)
+	}
+
+	w := client.Do(http.MethodPost, "/api/user/orders", luhnNumber(t, 11))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var blocked handler.UploadBlockedResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&blocked))
+	assert.Equal(t, "upload_limited", blocked.Error)
+	assert.Equal(t, repository.UploadBlockUserVelocity, blocked.Reason)
+
+	// пакет проверяется по количеству номеров в нем
+	w = client.DoJSON(http.MethodPost, "/api/user/orders/batch", `["`+luhnNumber(t, 11)+`"]`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// результаты загрузок записаны в зарезервированные записи журнала
+	var pending int
+	err := globalDB.QueryRow("SELECT count(*) FROM order_upload_attempts WHERE user_id = $1 AND result = 'pending'", client.UserID).Scan(&pending)
+	require.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	// параллельные загрузки не превышают ограничение
+	parallel := newAnonymousClient(t, mux)
+	parallel.RemoteAddr = uniqueRemoteAddr()
+	parallel.Register()
+
+	codes := make([]int, 6)
+	var wg sync.WaitGroup
+	for i := range codes {
+		number := luhnNumber(t, 11)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = parallel.Do(http.MethodPost, "/api/user/orders", number).Code
+		}()
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, code := range codes {
+		if code == http.StatusAccepted {
+			accepted++
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, code)
+		}
+	}
+	assert.Equal(t, 3, accepted)
+}
+
+func TestUploadAutoBlock(t *testing.T) {
+	// отдельный экземпляр сервиса, блокирующий загрузку после двух некорректных номеров из трех загрузок
+	conf := newConfig(globalFlags)
+	conf.UploadAbuse.MinAttempts = 3
+	conf.UploadAbuse.MaxInvalidRatio = 0.5
+	conf.UploadAbuse.BlockDuration = time.Hour
+	mux := newTestInstance(t, conf)
+
+	client := newAnonymousClient(t, mux)
+	client.RemoteAddr = uniqueRemoteAddr()
+	client.Register()
+
+	invalid := luhnNumber(t, 11)
+	invalid = invalid[:len(invalid)-1] + strconv.Itoa((int(invalid[len(invalid)-1]-'0')+1)%10)
+
+	require.Equal(t, http.StatusAccepted, client.Do(http.MethodPost, "/api/user/orders", luhnNumber(t, 11)).Code)
+	require.Equal(t, http.StatusUnprocessableEntity, client.Do(http.MethodPost, "/api/user/orders", invalid).Code)
+	require.Equal(t, http.StatusUnprocessableEntity, client.Do(http.MethodPost, "/api/user/orders", invalid).Code)
+
+	// доля некорректных номеров превышена - загрузка заблокирована и для корректного номера
+	w := client.Do(http.MethodPost, "/api/user/orders", luhnNumber(t, 11))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	var blocked handler.UploadBlockedResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&blocked))
+	assert.Equal(t, repository.UploadBlockInvalid, blocked.Reason)
+	assert.False(t, blocked.Until.IsZero())
+
+	// пользователь попадает в отчет о подозрительных загрузках
+	support := newTestServer(t).WithRole(auth.RoleSupport)
+	w = support.Do(http.MethodGet, "/api/admin/uploads/suspicious?window=10m", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var report []repository.UploadAbuseReport
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+
+	var item *repository.UploadAbuseReport
+	for i := range report {
+		if report[i].UserID == client.UserID {
+			item = &report[i]
+		}
+	}
+	require.NotNil(t, item)
+	assert.Equal(t, client.Login, item.Login)
+	assert.Equal(t, 3, item.Attempts)
+	assert.Equal(t, 1, item.Accepted)
+	assert.Equal(t, 0, item.Conflicts)
+	assert.Equal(t, 2, item.Invalid)
+	assert.Equal(t, 1, item.IPs)
+	require.NotNil(t, item.BlockedUntil)
+
+	// отчет доступен только с правом чтения отчета
+	assert.Equal(t, http.StatusForbidden, client.Do(http.MethodGet, "/api/admin/uploads/suspicious", "").Code)
+	assert.Equal(t, http.StatusBadRequest, support.Do(http.MethodGet, "/api/admin/uploads/suspicious?window=-1h", "").Code)
+}
+
+func TestUploadAttemptsPurge(t *testing.T) {
+	ctx := context.Background()
+	store := testStore()
+	userID, err := store.CreateUser(ctx, "testuser"+util.GenerateRandomString(8), "hash")
+	require.NoError(t, err)
+
+	const insertStmt = `
+    INSERT INTO order_upload_attempts (user_id, ip, order_number, result, created_at)
+    VALUES ($1, '192.0.2.1', '12345', 'invalid', now() - make_interval(secs => $2))
+`
+	_, err = globalDB.Exec(insertStmt, userID, (48 * time.Hour).Seconds())
+	require.NoError(t, err)
+	_, err = globalDB.Exec(insertStmt, userID, 0)
+	require.NoError(t, err)
+
+	// удаляются только записи старше срока хранения
+	purged, err := store.PurgeOrderUploadAttempts(ctx, 24*time.Hour)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, purged, int64(1))
+
+	var attempts int
+	err = globalDB.QueryRow("SELECT count(*) FROM order_upload_attempts WHERE user_id = $1", userID).Scan(&attempts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestLoginAttemptsPurge(t *testing.T) {
+	ctx := context.Background()
+	store := testStore()
+	login := "testuser" + util.GenerateRandomString(8)
+	// ключи счетчиков не совпадают с адресами, с которых входят другие тесты
+	oldIP := "ip:purge-" + util.GenerateRandomString(8)
+	lockedIP := "ip:purge-" + util.GenerateRandomString(8)
+
+	const attemptStmt = `
+    INSERT INTO login_attempts (login, ip, result, created_at)
+    VALUES ($1, '192.0.2.1', 'failure', now() - make_interval(secs => $2))
+`
+	_, err := globalDB.Exec(attemptStmt, login, (48 * time.Hour).Seconds())
+	require.NoError(t, err)
+	_, err = globalDB.Exec(attemptStmt, login, 0)
+	require.NoError(t, err)
+
+	// старый счетчик без блокировки удаляется, счетчик с действующей блокировкой и свежий счетчик остаются
+	const lockoutStmt = `
+    INSERT INTO login_lockouts (key, failures, last_failure_at, locked_until)
+    VALUES ($1, 3, now() - make_interval(secs => $2), now() + make_interval(secs => $3))
+`
+	_, err = globalDB.Exec(lockoutStmt, oldIP, (2 * time.Hour).Seconds(), -time.Hour.Seconds())
+	require.NoError(t, err)
+	_, err = globalDB.Exec(lockoutStmt, lockedIP, (2 * time.Hour).Seconds(), time.Hour.Seconds())
+	require.NoError(t, err)
+	_, err = globalDB.Exec(lockoutStmt, "login:"+login, 0, -time.Hour.Seconds())
+	require.NoError(t, err)
+
+	purged, err := store.PurgeLoginAttempts(ctx, 24*time.Hour)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, purged, int64(1))
+
+	var attempts int
+	err = globalDB.QueryRow("SELECT count(*) FROM login_attempts WHERE login = $1", login).Scan(&attempts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+
+	purged, err = store.PurgeLoginLockouts(ctx, time.Hour)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, purged, int64(1))
+
+	var keys []string
+	rows, err := globalDB.Query("SELECT key FROM login_lockouts WHERE key IN ($1, $2, $3)", oldIP, lockedIP, "login:"+login)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		require.NoError(t, rows.Scan(&key))
+		keys = append(keys, key)
+	}
+	require.NoError(t, rows.Err())
+	assert.ElementsMatch(t, []string{lockedIP, "login:" + login}, keys)
+}
+
+func TestEvents(t *testing.T) {
+	conf := newConfig(globalFlags)
+	conf.EventsHeartbeat = 100 * time.Millisecond
+	instance := handler.ResponseCompressHandle(newTestInstance(t, conf), globalLogger)
+	server := httptest.NewServer(instance)
+	t.Cleanup(server.Close)
+
+	client := newTestClient(t, instance)
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/api/user/events", nil)
+	require.NoError(t, err)
+	request.Header.Set("Accept-Encoding", "gzip")
+	for _, cookie := range client.Cookies {
+		request.AddCookie(cookie)
+	}
+
+	response, err := server.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	// поток событий проходит через middleware сжатия без сжатия и без буферизации
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	assert.Empty(t, response.Header.Get("Content-Encoding"))
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// nextLine ожидание следующей строки потока, начинающейся с prefix
+	nextLine := func(prefix string, timeout time.Duration) (string, bool) {
+		deadline := time.After(timeout)
+		for {
+			select {
+			case line, ok := <-lines:
+				require.True(t, ok, "поток событий закрыт")
+				if strings.HasPrefix(line, prefix) {
+					return line, true
+				}
+			case <-deadline:
+				return "", false
+			}
+		}
+	}
+
+	_, ok := nextLine(": ping", 5*time.Second)
+	require.True(t, ok, "служебный комментарий не получен")
+
+	// подписка воркера экземпляра на уведомления могла еще не состояться, поэтому списание повторяется до получения события
+	order := luhnNumber(t, 10)
+	var frame string
+	for attempt := 0; attempt < 20 && frame == ""; attempt++ {
+		_, err := globalDB.Exec("INSERT INTO withdrawals (user_id, number, amount) VALUES ($1, $2, $3)", client.UserID, order, 10)
+		require.NoError(t, err)
+		frame, _ = nextLine("event: withdrawal", time.Second)
+	}
+	require.NotEmpty(t, frame, "событие списания не получено")
+
+	data, ok := nextLine("data: ", time.Second)
+	require.True(t, ok)
+	var event repository.UserEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &event))
+	assert.Equal(t, repository.UserEventWithdrawal, event.Type)
+	assert.Equal(t, order, event.Order)
+	assert.InDelta(t, 10, event.Sum, 0.001)
+
+	// ответы JSON того же экземпляра по-прежнему сжимаются
+	w := client.DoWithHeader(client.Cookies, http.Header{"Accept-Encoding": {"gzip"}}, http.MethodGet, "/api/user/balance", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	var balance map[string]any
+	require.NoError(t, json.NewDecoder(reader).Decode(&balance))
+	assert.Contains(t, balance, "withdrawn")
+}
+
 func TestFinally(t *testing.T) {
 	if globalDB != nil {
 		err := globalDB.Close()
@@ -0,0 +1,133 @@
+// Package auth набор ключей подписи JWT токенов с идентификаторами kid
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// minSecretLength минимальная длина секрета ключа подписи в байтах
+const minSecretLength = 32
+
+// Key тип, описывающий ключ подписи токенов с идентификатором ID, передаваемым в заголовке токена kid
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// KeySet тип, описывающий набор ключей подписи токенов:
+// первым ключом подписываются новые токены, остальными проверяются ранее выданные токены,
+// пока ключи не выведены из набора
+type KeySet struct {
+	keys []Key
+}
+
+// NewKeySet создание набора ключей, первый ключ используется для подписи
+func NewKeySet(keys ...Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("набор ключей подписи токенов пуст")
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("у ключа подписи токенов не задан идентификатор")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("идентификатор ключа подписи токенов %q повторяется", key.ID)
+		}
+		if len(key.Secret) < minSecretLength {
+			return nil, fmt.Errorf("секрет ключа подписи токенов %q короче %d байт", key.ID, minSecretLength)
+		}
+		seen[key.ID] = true
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+// ParseKeySet разбор набора ключей из строк вида kid:base64secret, где секрет закодирован в base64,
+// ключи в строке разделяются пробелами, первый ключ используется для подписи,
+// пустые строки и строки, начинающиеся с #, пропускаются
+func ParseKeySet(spec string) (*KeySet, error) {
+	var keys []Key
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for _, item := range strings.Fields(line) {
+			key, err := parseKey(item)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return NewKeySet(keys...)
+}
+
+// parseKey разбор ключа подписи токенов вида kid:base64secret,
+// секрет принимается в стандартной кодировке base64 с выравниванием или без него
+func parseKey(item string) (Key, error) {
+	id, encoded, ok := strings.Cut(item, ":")
+	if !ok || id == "" {
+		return Key{}, errors.New("ключ подписи токенов должен быть задан в виде kid:base64secret")
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		secret, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("секрет ключа подписи токенов %q должен быть закодирован в base64", id)
+	}
+
+	return Key{ID: id, Secret: secret}, nil
+}
+
+// LoadKeySet загрузка набора ключей из файла в формате ParseKeySet
+func LoadKeySet(path string) (*KeySet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(string(content))
+}
+
+// NewRandomKeySet создание набора из одного случайного ключа,
+// выданные с ним токены перестают проходить проверку после перезапуска сервиса
+func NewRandomKeySet() (*KeySet, error) {
+	secret := make([]byte, minSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return NewKeySet(Key{ID: "ephemeral-" + hex.EncodeToString(id), Secret: secret})
+}
+
+// Signing возвращает ключ подписи новых токенов
+func (s *KeySet) Signing() Key {
+	return s.keys[0]
+}
+
+// Lookup поиск ключа проверки токена по идентификатору kid
+func (s *KeySet) Lookup(id string) (Key, bool) {
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
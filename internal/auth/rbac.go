@@ -0,0 +1,51 @@
+// Package auth роли пользователей и права доступа к методам сервиса
+package auth
+
+import "slices"
+
+// роли пользователей
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Roles допустимые роли пользователей
+var Roles = []string{RoleUser, RoleSupport, RoleAdmin}
+
+// Permission право доступа к группе методов сервиса, объявляемое на маршруте,
+// права orders:write, balance:read и withdraw совпадают с областями доступа API ключей
+type Permission string
+
+// права доступа к методам сервиса
+const (
+	PermOrdersWrite     Permission = "orders:write"
+	PermOrdersRead      Permission = "orders:read"
+	PermBalanceRead     Permission = "balance:read"
+	PermWithdraw        Permission = "withdraw"
+	PermAccount         Permission = "account"
+	PermDisputesRead    Permission = "disputes:read"
+	PermDisputesReview  Permission = "disputes:review"
+	PermDisputesResolve Permission = "disputes:resolve"
+	PermAbuseReportRead Permission = "abuse:read"
+	PermUsersManage     Permission = "users:manage"
+)
+
+// userPermissions права обычного пользователя на работу со своим счетом
+var userPermissions = []Permission{PermOrdersWrite, PermOrdersRead, PermBalanceRead, PermWithdraw, PermAccount}
+
+// supportPermissions права поддержки: разбор споров без начислений и отчеты о злоупотреблениях
+var supportPermissions = append(slices.Clone(userPermissions), PermDisputesRead, PermDisputesReview, PermAbuseReportRead)
+
+// rolePermissions права доступа ролей, администратор дополнительно начисляет корректировки по спорам
+// и управляет ролями пользователей
+var rolePermissions = map[string][]Permission{
+	RoleUser:    userPermissions,
+	RoleSupport: supportPermissions,
+	RoleAdmin:   append(slices.Clone(supportPermissions), PermDisputesResolve, PermUsersManage),
+}
+
+// HasPermission проверка наличия права доступа у роли, неизвестная роль прав не имеет
+func HasPermission(role string, permission Permission) bool {
+	return slices.Contains(rolePermissions[role], permission)
+}
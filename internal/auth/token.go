@@ -7,25 +7,34 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-// Claims добавление в стандартный набор клеймов JWT токена клейма UserID
+// Claims добавление в стандартный набор клеймов JWT токена клейма UserID,
+// семьи токенов FamilyID, по которой проверяется отзыв токена, и роли пользователя Role
 type Claims struct {
 	jwt.RegisteredClaims
-	UserID int
+	UserID   int
+	FamilyID string `json:"fid,omitempty"`
+	Role     string `json:"role,omitempty"`
 }
 
-// CreateToken функция создания JWT токена
+// CreateToken функция создания JWT токена, подписанного текущим ключом набора keys,
+// идентификатор ключа передается в заголовке токена kid
 // возвращает или ошибку или созданный токен
-func CreateToken(tokenExpiration time.Duration, userID int, secretKey string) (string, error) {
+func CreateToken(tokenExpiration time.Duration, userID int, familyID string, role string, keys *KeySet) (string, error) {
 	// создание токена с нужными клеймами
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenExpiration)),
 		},
-		UserID: userID,
+		UserID:   userID,
+		FamilyID: familyID,
+		Role:     role,
 	})
 
+	key := keys.Signing()
+	token.Header["kid"] = key.ID
+
 	// подписание токена и возвращение его в виде строки
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(key.Secret)
 	if err != nil {
 		return "", err
 	}
@@ -33,31 +42,48 @@ func CreateToken(tokenExpiration time.Duration, userID int, secretKey string) (s
 	return tokenString, nil
 }
 
-// GetUserID проверка токена и получение из него клейма UserID
+// GetUserID проверка токена ключом из набора keys с идентификатором kid из заголовка токена
+// и получение из него клейма UserID
 // возвращает или ошибку или валидный UserID
-func GetUserID(tokenString string, secretKey string) (int, error) {
+func GetUserID(tokenString string, keys *KeySet) (int, error) {
+	claims, err := ParseToken(tokenString, keys)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserID, nil
+}
+
+// ParseToken проверка токена ключом из набора keys с идентификатором kid из заголовка токена
+// возвращает или ошибку или клеймы токена с валидным UserID
+func ParseToken(tokenString string, keys *KeySet) (*Claims, error) {
 	// проверка токена и парсинг содержащихся в нем клеймов
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
+		// токены без kid и с выведенными из набора ключами не принимаются
+		kid, _ := t.Header["kid"].(string)
+		key, ok := keys.Lookup(kid)
+		if !ok {
+			return nil, jwt.ErrTokenUnverifiable
+		}
+		return key.Secret, nil
 	})
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	// проверка метода шифрование, недопущение none алгоритма и проверка валидности токена
 	if token.Method.Alg() != "HS256" {
-		return 0, jwt.ErrTokenMalformed
+		return nil, jwt.ErrTokenMalformed
 	}
 
 	if !token.Valid {
-		return 0, jwt.ErrTokenUnverifiable
+		return nil, jwt.ErrTokenUnverifiable
 	}
 
 	if claims.UserID == 0 {
-		return 0, jwt.ErrTokenMalformed
+		return nil, jwt.ErrTokenMalformed
 	}
 
-	return claims.UserID, nil
+	return claims, nil
 }
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRotation(t *testing.T) {
+	oldSecret := base64.StdEncoding.EncodeToString([]byte("old-secret-0123456789abcdef0123456789"))
+	newSecret := base64.StdEncoding.EncodeToString([]byte("new-secret-0123456789abcdef0123456789"))
+
+	oldKeys, err := ParseKeySet("k1:" + oldSecret)
+	require.NoError(t, err)
+
+	oldToken, err := CreateToken(time.Hour, 42, "f1", RoleUser, oldKeys)
+	require.NoError(t, err)
+
+	// новый ключ подписывает, старый продолжает проверять выданные токены
+	rotated, err := ParseKeySet("k2:" + newSecret + "\nk1:" + oldSecret)
+	require.NoError(t, err)
+
+	userID, err := GetUserID(oldToken, rotated)
+	require.NoError(t, err)
+	assert.Equal(t, 42, userID)
+
+	newToken, err := CreateToken(time.Hour, 7, "f2", RoleAdmin, rotated)
+	require.NoError(t, err)
+
+	_, err = GetUserID(newToken, oldKeys)
+	assert.Error(t, err)
+
+	// после вывода старого ключа из набора выданные им токены не принимаются
+	retired, err := ParseKeySet("k2:" + newSecret)
+	require.NoError(t, err)
+
+	_, err = GetUserID(oldToken, retired)
+	assert.Error(t, err)
+
+	claims, err := ParseToken(newToken, retired)
+	require.NoError(t, err)
+	assert.Equal(t, 7, claims.UserID)
+	assert.Equal(t, RoleAdmin, claims.Role)
+}
+
+func TestRolePermissions(t *testing.T) {
+	assert.True(t, HasPermission(RoleUser, PermWithdraw))
+	assert.False(t, HasPermission(RoleUser, PermDisputesRead))
+	assert.True(t, HasPermission(RoleSupport, PermDisputesReview))
+	assert.False(t, HasPermission(RoleSupport, PermDisputesResolve))
+	assert.True(t, HasPermission(RoleAdmin, PermUsersManage))
+	assert.False(t, HasPermission("unknown", PermOrdersRead))
+}
+
+func TestParseKeySet(t *testing.T) {
+	// секрет с запятыми и двоеточиями передается в base64 без потерь
+	secret := []byte("secret,with:separators,0123456789abcdef0123")
+	encoded := base64.StdEncoding.EncodeToString(secret)
+	raw := base64.RawStdEncoding.EncodeToString(secret)
+
+	keys, err := ParseKeySet("# ключи подписи\nk2:" + encoded + "\n\nk1:" + raw + " k0:" + encoded + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keys.Signing().ID)
+	assert.Equal(t, secret, keys.Signing().Secret)
+
+	key, ok := keys.Lookup("k1")
+	require.True(t, ok)
+	assert.Equal(t, secret, key.Secret)
+	_, ok = keys.Lookup("k0")
+	assert.True(t, ok)
+}
+
+func TestParseKeySetErrors(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	for _, spec := range []string{
+		"",
+		"# только комментарий",
+		secret,
+		":" + secret,
+		"k1:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"k1:not base64!",
+		"k1:0123456789abcdef0123456789abcdef,k2:0123456789abcdef0123456789abcdef",
+		"k1:" + secret + "\nk1:" + secret,
+	} {
+		_, err := ParseKeySet(spec)
+		assert.Error(t, err, spec)
+	}
+}
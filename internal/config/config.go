@@ -1,22 +1,143 @@
 // Package config создание объекта конфигурации сервиса
 package config
 
-import "github.com/hardvlad/ypdiploma1/internal/config/db"
+import (
+	"net/http"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/auth"
+	"github.com/hardvlad/ypdiploma1/internal/config/db"
+	"github.com/hardvlad/ypdiploma1/internal/oidc"
+	"github.com/hardvlad/ypdiploma1/internal/password"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/validator"
+	"github.com/hardvlad/ypdiploma1/internal/webauthn"
+)
+
+// режимы защиты от CSRF запросов, авторизованных cookie
+const (
+	CSRFModeOrigin       = "origin"
+	CSRFModeDoubleSubmit = "double-submit"
+	CSRFModeOff          = "off"
+)
 
 // Config тип описывающий структуру конфига приложения
 type Config struct {
-	DBConfig       *db.Config
-	CookieName     string
-	TokenSecret    string
-	AccrualAddress string
+	DBConfig   *db.Config
+	CookieName string
+	// RefreshCookieName - имя cookie refresh токена
+	RefreshCookieName string
+	// CookieDomain, CookieSecure, CookieSameSite - атрибуты cookie токенов
+	CookieDomain   string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	// CSRFMode - режим защиты от CSRF запросов, авторизованных cookie
+	CSRFMode string
+	// CSRFCookieName - имя cookie со значением для проверки в режиме double-submit
+	CSRFCookieName string
+	// CSRFTrustedOrigins - источники запросов, кроме адреса самого сервиса, допустимые в режиме origin
+	CSRFTrustedOrigins []string
+	// OIDC - настройки входа через провайдера OpenID Connect, nil - вход отключен
+	OIDC *oidc.Config
+	// OIDCAutoCreate - создание пользователя при первом входе через провайдера без связанной учетной записи
+	OIDCAutoCreate bool
+	// OIDCStateCookieName - имя cookie, связывающей начатый вход через провайдера с браузером пользователя
+	OIDCStateCookieName string
+	// WebAuthn - настройки входа по ключам доступа WebAuthn, nil - вход отключен
+	WebAuthn *webauthn.Config
+	// TOTPIssuer - название сервиса в приложении-аутентификаторе
+	TOTPIssuer string
+	// TOTPWithdrawAbove - сумма, списания больше которой у пользователей с двухфакторной аутентификацией
+	// требуют свежий код TOTP
+	TOTPWithdrawAbove float64
+	// AccessTokenTTL, RefreshTokenTTL - время жизни access и refresh токенов
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// TokenKeys - набор ключей подписи JWT токенов, первый ключ подписывает новые токены
+	TokenKeys        *auth.KeySet
+	AccrualAddress   string
+	WithdrawalLimits repository.WithdrawalLimits
+	// UploadAbuse - правила обнаружения злоупотреблений при загрузке заказов
+	UploadAbuse repository.UploadAbusePolicy
+	// AdminLogins - логины пользователей, получающих роль admin при запуске сервиса
+	AdminLogins []string
+	// LoginLockout - блокировка входа после неудачных попыток
+	LoginLockout repository.LoginLockoutPolicy
+	// SecondFactorLockout - блокировка проверок второго фактора пользователя после неверных кодов
+	SecondFactorLockout repository.SecondFactorLockoutPolicy
+	// PasswordPolicy - политика сложности паролей
+	PasswordPolicy password.Policy
+	// BreachedPasswords - список утекших паролей, nil - проверка отключена
+	BreachedPasswords *password.BreachedList
+	// OrderValidator - схема проверки номеров заказов для пользователей без персональной схемы
+	OrderValidator validator.Validator
+	// AccrualPollInterval - пауза между запросами в систему начислений по заказу с неокончательным статусом
+	AccrualPollInterval time.Duration
+	// ReconcileWindow - период после завершения расчета, в течение которого заказ сверяется с системой начислений,
+	// 0 - сверка отключена
+	ReconcileWindow time.Duration
+	// ReconcileInterval - периодичность сверки заказа
+	ReconcileInterval time.Duration
+	// WebhookMaxAttempts - количество попыток доставки вебхука, после которого доставка считается неуспешной
+	WebhookMaxAttempts int
+	// WebhookTimeout - таймаут запроса доставки вебхука
+	WebhookTimeout time.Duration
+	// EventsHeartbeat - периодичность служебных комментариев, поддерживающих поток событий открытым
+	EventsHeartbeat time.Duration
+	// DeletionGrace - период между запросом удаления учетной записи и удалением, в течение которого удаление можно отменить
+	DeletionGrace time.Duration
 }
 
 // NewConfig создание и наполнение структуры конфига приложения
 func NewConfig(dsn string, accrualAddress string) *Config {
 	return &Config{
-		DBConfig:       db.NewConfig(dsn),
-		CookieName:     "yp_diploma_one_token",
-		TokenSecret:    "superSecretKey",
-		AccrualAddress: accrualAddress,
+		DBConfig:            db.NewConfig(dsn),
+		CookieName:          "yp_diploma_one_token",
+		RefreshCookieName:   "yp_diploma_one_refresh",
+		CookieSameSite:      http.SameSiteLaxMode,
+		CSRFMode:            CSRFModeOrigin,
+		CSRFCookieName:      "yp_diploma_one_csrf",
+		OIDCStateCookieName: "yp_diploma_one_oidc_state",
+		TOTPIssuer:          "Gophermart",
+		TOTPWithdrawAbove:   1000,
+		AccessTokenTTL:      15 * time.Minute,
+		RefreshTokenTTL:     30 * 24 * time.Hour,
+		AccrualAddress:      accrualAddress,
+		AccrualPollInterval: time.Second,
+		ReconcileWindow:     72 * time.Hour,
+		ReconcileInterval:   10 * time.Minute,
+		WebhookMaxAttempts:  8,
+		WebhookTimeout:      10 * time.Second,
+		EventsHeartbeat:     15 * time.Second,
+		DeletionGrace:       30 * 24 * time.Hour,
+		OrderValidator:      validator.Luhn{},
+		LoginLockout: repository.LoginLockoutPolicy{
+			LoginThreshold: 5,
+			IPThreshold:    50,
+			BaseLockout:    30 * time.Second,
+			MaxLockout:     time.Hour,
+			ResetAfter:     time.Hour,
+		},
+		SecondFactorLockout: repository.SecondFactorLockoutPolicy{
+			Threshold:   5,
+			BaseLockout: 5 * time.Minute,
+			MaxLockout:  24 * time.Hour,
+			ResetAfter:  24 * time.Hour,
+		},
+		PasswordPolicy: password.Policy{
+			MinLength:   8,
+			MinClasses:  1,
+			ForbidLogin: true,
+		},
+		UploadAbuse: repository.UploadAbusePolicy{
+			Window:           time.Minute,
+			MaxPerUser:       1000,
+			MaxPerIP:         2000,
+			RatioWindow:      time.Hour,
+			MinAttempts:      20,
+			MaxConflictRatio: 0.5,
+			MaxInvalidRatio:  0.8,
+			BlockDuration:    time.Hour,
+		},
 	}
 }
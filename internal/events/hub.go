@@ -0,0 +1,58 @@
+// Package events рассылка событий пользователей подписчикам внутри экземпляра сервиса
+package events
+
+import (
+	"sync"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// subscriberBuffer размер буфера канала подписчика, при переполнении события для него отбрасываются
+const subscriberBuffer = 16
+
+// Hub тип, хранящий подписки на события пользователей
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[int]map[chan repository.UserEvent]struct{}
+}
+
+// NewHub создание объекта рассылки событий
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[int]map[chan repository.UserEvent]struct{})}
+}
+
+// Subscribe подписка на события пользователя userID,
+// возвращает канал событий и функцию отмены подписки
+func (h *Hub) Subscribe(userID int) (<-chan repository.UserEvent, func()) {
+	ch := make(chan repository.UserEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan repository.UserEvent]struct{})
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers[userID], ch)
+		if len(h.subscribers[userID]) == 0 {
+			delete(h.subscribers, userID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Publish рассылка события всем подписчикам пользователя события,
+// медленные подписчики не блокируют рассылку
+func (h *Hub) Publish(event repository.UserEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch := range h.subscribers[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
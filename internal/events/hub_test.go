@@ -0,0 +1,64 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishFanOut(t *testing.T) {
+	hub := NewHub()
+
+	first, unsubscribeFirst := hub.Subscribe(1)
+	defer unsubscribeFirst()
+	second, unsubscribeSecond := hub.Subscribe(1)
+	defer unsubscribeSecond()
+	other, unsubscribeOther := hub.Subscribe(2)
+	defer unsubscribeOther()
+
+	event := repository.UserEvent{Type: repository.UserEventWithdrawal, UserID: 1, Order: "12345678903", Sum: 10}
+	hub.Publish(event)
+
+	// событие получают все подписки пользователя и только они
+	for _, ch := range []<-chan repository.UserEvent{first, second} {
+		select {
+		case got := <-ch:
+			assert.Equal(t, event, got)
+		default:
+			require.Fail(t, "событие не доставлено подписчику")
+		}
+	}
+	assert.Empty(t, other)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := NewHub()
+
+	ch, unsubscribe := hub.Subscribe(1)
+	unsubscribe()
+
+	hub.Publish(repository.UserEvent{Type: repository.UserEventAccrual, UserID: 1})
+	assert.Empty(t, ch)
+	assert.Empty(t, hub.subscribers)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+
+	slow, unsubscribeSlow := hub.Subscribe(1)
+	defer unsubscribeSlow()
+
+	// переполненный канал не блокирует рассылку, лишние события отбрасываются
+	for i := 0; i < subscriberBuffer+5; i++ {
+		hub.Publish(repository.UserEvent{Type: repository.UserEventOrderStatus, UserID: 1})
+	}
+	assert.Len(t, slow, subscriberBuffer)
+
+	// новый подписчик того же пользователя получает события несмотря на переполнение первого
+	fresh, unsubscribeFresh := hub.Subscribe(1)
+	defer unsubscribeFresh()
+	hub.Publish(repository.UserEvent{Type: repository.UserEventOrderStatus, UserID: 1})
+	assert.Len(t, fresh, 1)
+}
@@ -0,0 +1,135 @@
+// Package handler содержит проверки злоупотреблений при загрузке заказов и отчет о подозрительных аккаунтах
+package handler
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// uploadAbuseReportLimit максимальное количество пользователей в отчете о подозрительных загрузках
+const uploadAbuseReportLimit = 100
+
+// uploadAbuseReportWindow окно отчета о подозрительных загрузках по умолчанию
+const uploadAbuseReportWindow = 24 * time.Hour
+
+// UploadBlockedResponse структура, описывающая формат ответа при ограничении загрузки заказов
+type UploadBlockedResponse struct {
+	Error  string    `json:"error"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// getClientIP получение IP-адреса клиента из адреса соединения,
+// заголовки прокси не учитываются, так как их может подставить сам клиент
+func getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkOrderUploads проверяет, разрешена ли пользователю загрузка count номеров заказов,
+// при блокировке или превышении частоты загрузок выводит StatusTooManyRequests и возвращает false
+func checkOrderUploads(w http.ResponseWriter, r *http.Request, data Handlers, userID int, count int) bool {
+	block, err := data.Store.CheckOrderUploads(r.Context(), userID, getClientIP(r), count, data.Conf.UploadAbuse)
+	if err != nil {
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusInternalServerError),
+			code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+
+	if block == nil {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(time.Until(block.Until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	writeJSON(w, http.StatusTooManyRequests, UploadBlockedResponse{
+		Error:  "upload_limited",
+		Reason: block.Reason,
+		Until:  block.Until,
+	})
+	return false
+}
+
+// recordOrderUploads записывает результаты загрузки заказов для отслеживания конфликтов и некорректных номеров,
+// ошибка записи не влияет на ответ пользователю
+func recordOrderUploads(r *http.Request, data Handlers, userID int, numbers []string, results []string) {
+	ip := getClientIP(r)
+	block, err := data.Store.RecordOrderUploads(r.Context(), userID, ip, numbers, results, data.Conf.UploadAbuse)
+	if err != nil {
+		data.Logger.Errorw(err.Error(), "event", "запись результатов загрузки заказов", "userID", userID, "ip", ip)
+		return
+	}
+
+	if block != nil {
+		data.Logger.Warnw("Загрузка заказов заблокирована", "userID", userID, "ip", ip, "reason", block.Reason, "until", block.Until)
+	}
+}
+
+// createAdminUploadAbuseHandler создает административный обработчик отчета о подозрительных аккаунтах:
+// статистика загрузок заказов за окно window (по умолчанию сутки) по пользователям с конфликтами,
+// некорректными номерами или действующими блокировками
+func createAdminUploadAbuseHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		window := uploadAbuseReportWindow
+		if value := r.URL.Query().Get("window"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: "некорректное окно отчета window",
+					code:    http.StatusBadRequest,
+				})
+				return
+			}
+			window = parsed
+		}
+
+		report, err := data.Store.GetUploadAbuseReport(r.Context(), window, uploadAbuseReportLimit)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if len(report) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// purgeUploadAttempts удаление записей журнала загрузок заказов, не нужных ни для проверки частоты и доли
+// конфликтов загрузок, ни для отчета о подозрительных загрузках за окно по умолчанию
+func purgeUploadAttempts(ctx context.Context, data Handlers) error {
+	retention := max(data.Conf.UploadAbuse.Window, data.Conf.UploadAbuse.RatioWindow, uploadAbuseReportWindow)
+
+	purged, err := data.Store.PurgeOrderUploadAttempts(ctx, retention)
+	if err != nil {
+		return err
+	}
+
+	if purged > 0 {
+		data.Logger.Infow("Журнал загрузок заказов очищен", "purged", purged, "retention", retention)
+	}
+	return nil
+}
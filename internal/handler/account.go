@@ -0,0 +1,244 @@
+// Package handler содержит выгрузку персональных данных и удаление учетной записи пользователя
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accountPurgeInterval периодичность удаления учетных записей, время удаления которых наступило
+const accountPurgeInterval = 10 * time.Minute
+
+// accountPurgeBatchSize количество учетных записей, удаляемых за один проход
+const accountPurgeBatchSize = 100
+
+// DeleteAccountRequest структура, описывающая формат запроса на удаление учетной записи,
+// пользователь без пароля, созданный при входе через провайдера OpenID Connect, вместо пароля
+// может передать код TOTP или код восстановления
+type DeleteAccountRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// DeleteAccountResponse структура, описывающая формат ответа на запрос удаления учетной записи
+type DeleteAccountResponse struct {
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+}
+
+// createExportHandler создает обработчик выгрузки персональных данных пользователя:
+// профиля, заказов, списаний и журнала движения баллов одним JSON документом
+func createExportHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		export, err := data.Store.GetUserExport(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "export user data", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data.Logger.Infow("Выгрузка персональных данных", "userID", userID)
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gophermart-export-%d.json"`, userID))
+		writeJSON(w, http.StatusOK, export)
+	}
+}
+
+// createDeleteAccountHandler создает обработчик запроса удаления учетной записи по паролю
+// или повторной аутентификации пользователя без пароля: учетная запись удаляется после льготного периода,
+// до истечения которого удаление можно отменить, остальные входы пользователя завершаются,
+// повторный запрос возвращает ранее запланированное время удаления
+func createDeleteAccountHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// тело запроса необязательно для пользователя без пароля
+		var request DeleteAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		_, pwdHash, err := data.Store.GetUserLoginPasswordHash(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "delete account - get password hash", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// проверка пароля или повторной аутентификации пользователя без пароля
+		secondFactor := SecondFactorRequest{Code: request.Code, RecoveryCode: request.RecoveryCode}
+		if !checkReauthentication(w, r, data, userID, pwdHash, request.Password, secondFactor) {
+			return
+		}
+
+		scheduledAt, err := data.Store.ScheduleUserDeletion(r.Context(), userID, data.Conf.DeletionGrace)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "delete account - schedule", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// текущий вход остается, чтобы пользователь мог отменить удаление
+		if err := data.Store.RevokeOtherSessions(r.Context(), userID, getSessionIDFromRequest(r)); err != nil {
+			data.Logger.Debugw(err.Error(), "event", "delete account - revoke sessions", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data.Logger.Infow("Запрошено удаление учетной записи", "userID", userID, "scheduledAt", scheduledAt)
+
+		writeJSON(w, http.StatusAccepted, DeleteAccountResponse{DeletionScheduledAt: scheduledAt})
+	}
+}
+
+// createCancelDeletionHandler создает обработчик отмены запланированного удаления учетной записи
+func createCancelDeletionHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		cancelled, err := data.Store.CancelUserDeletion(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "cancel account deletion", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !cancelled {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Удаление учетной записи отменено", "userID", userID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CreateAccountPurgeWorker запуск воркера удаления учетных записей, льготный период которых истек
+func CreateAccountPurgeWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go accountPurgeWorker(ctx, data, wg)
+}
+
+// accountPurgeWorker воркер, периодически удаляющий учетные записи с обезличиванием финансовых записей
+// и устаревшие записи журналов загрузок заказов и попыток входа
+func accountPurgeWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := purgeAccounts(ctx, data)
+			if err != nil {
+				data.Logger.Errorw("accountPurgeWorker: purgeAccounts error", "error", err)
+			}
+			err = purgeUploadAttempts(ctx, data)
+			if err != nil {
+				data.Logger.Errorw("accountPurgeWorker: purgeUploadAttempts error", "error", err)
+			}
+			err = purgeLoginAttempts(ctx, data)
+			if err != nil {
+				data.Logger.Errorw("accountPurgeWorker: purgeLoginAttempts error", "error", err)
+			}
+		case <-ctx.Done():
+			data.Logger.Infow("accountPurgeWorker: shutting down")
+			return
+		}
+	}
+}
+
+// purgeAccounts функция одного прохода удаления учетных записей
+func purgeAccounts(ctx context.Context, data Handlers) error {
+	userIDs, err := data.Store.GetUsersForPurge(ctx, accountPurgeBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		purged, err := data.Store.PurgeUser(ctx, userID)
+		if err != nil {
+			data.Logger.Errorw("account purge - delete user", "userID", userID, "error", err)
+			continue
+		}
+
+		if purged {
+			data.Logger.Infow("Учетная запись удалена", "userID", userID)
+		}
+	}
+
+	return nil
+}
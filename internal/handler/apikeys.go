@@ -0,0 +1,182 @@
+// Package handler содержит методы управления API ключами пользователя для серверных клиентов
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// APIKeyRequest структура, описывающая формат запроса на создание API ключа
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// createPostAPIKeyHandler создает обработчик создания API ключа с областями доступа,
+// ключ выводится в ответе один раз и хранится только в виде хэша
+func createPostAPIKeyHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" || len(request.Scopes) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "нужно указать имя ключа name и области доступа scopes",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		for _, scope := range request.Scopes {
+			if !slices.Contains(repository.APIKeyScopes, scope) {
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: "неизвестная область доступа: " + scope,
+					code:    http.StatusBadRequest,
+				})
+				return
+			}
+		}
+		slices.Sort(request.Scopes)
+		scopes := slices.Compact(request.Scopes)
+
+		// ключ состоит из открытого префикса для отображения в списке ключей и секретной части
+		prefix, err := util.GenerateSecureToken(4)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		secret, err := util.GenerateSecureToken(24)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		key := apiKeyPrefix + prefix + "_" + secret
+
+		apiKey, err := data.Store.CreateAPIKey(r.Context(), userID, strings.TrimSpace(request.Name), apiKeyPrefix+prefix, util.HashToken(key), scopes)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "create api key", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		apiKey.Key = key
+		writeJSON(w, http.StatusCreated, apiKey)
+	}
+}
+
+// createGetAPIKeysHandler создает обработчик получения API ключей пользователя без секретов
+func createGetAPIKeysHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		apiKeys, err := data.Store.GetAPIKeys(r.Context(), userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if len(apiKeys) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiKeys)
+	}
+}
+
+// createDeleteAPIKeyHandler создает обработчик отзыва API ключа пользователя
+func createDeleteAPIKeyHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		keyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		revoked, err := data.Store.RevokeAPIKey(r.Context(), userID, keyID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !revoked {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -4,21 +4,35 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
-	"github.com/hardvlad/ypdiploma1/internal/util"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
 )
 
 // GetBalanceResponse структура, описывающая формат ответа на запрос баланса
+// Debt - задолженность, возникшая после пересмотра начислений, Flagged - списания заблокированы
 type GetBalanceResponse struct {
 	Current   float64 `json:"current"`
 	Withdrawn float64 `json:"withdrawn"`
+	Debt      float64 `json:"debt,omitempty"`
+	Flagged   bool    `json:"flagged,omitempty"`
 }
 
 // WithdrawRequest структура, описывающая формат запроса на списание
 type WithdrawRequest struct {
 	OrderNumber string  `json:"order"`
 	Sum         float64 `json:"sum"`
+	// TOTPCode - код TOTP для крупного списания, может передаваться и в заголовке X-TOTP-Code
+	TOTPCode string `json:"totp_code,omitempty"`
+}
+
+// WithdrawLimitResponse структура, описывающая формат ответа при нарушении ограничения на списание
+type WithdrawLimitResponse struct {
+	Error     string  `json:"error"`
+	Rule      string  `json:"rule"`
+	Limit     float64 `json:"limit"`
+	Available float64 `json:"available"`
 }
 
 // createGetBalanceHandler - создание обработчика метода получения баланса
@@ -50,6 +64,21 @@ func createGetBalanceHandler(data Handlers) http.HandlerFunc {
 
 		balance.Current -= balance.Withdrawn
 
+		// получаем признак задолженности пользователя
+		balance.Flagged, err = data.Store.GetUserDebtFlag(r.Context(), userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if balance.Current < 0 {
+			balance.Debt = -balance.Current
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(balance)
@@ -61,7 +90,7 @@ func createWithdrawHandler(data Handlers) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// получаем userID из контекста
-		userID, ok := r.Context().Value(userIDKey).(int)
+		userID, ok := getUserIDFromRequest(r)
 		if !ok {
 			writeResponse(w, r, commonResponse{
 				isError: true,
@@ -94,18 +123,13 @@ func createWithdrawHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
-		// проверяем номер заказа по алгоритму Луна - последняя цифра - контрольная сумма
-		if !util.CheckNumberLuhn(requestData.OrderNumber) {
-			writeResponse(w, r, commonResponse{
-				isError: true,
-				message: http.StatusText(http.StatusUnprocessableEntity),
-				code:    http.StatusUnprocessableEntity,
-			})
+		// крупные списания пользователей с двухфакторной аутентификацией подтверждаются кодом TOTP
+		if !checkWithdrawTOTP(w, r, data, userID, requestData.Sum, requestData.TOTPCode) {
 			return
 		}
 
-		// получаем баланс из базы данных
-		accrued, withdrawn, err := data.Store.GetUserBalance(r.Context(), userID)
+		// получаем схему проверки номеров заказов пользователя
+		numberValidator, err := getOrderValidator(r.Context(), data, userID)
 		if err != nil {
 			writeResponse(w, r, commonResponse{
 				isError: true,
@@ -115,21 +139,50 @@ func createWithdrawHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
-		balance := accrued - withdrawn
-
-		// если баланс меньше суммы списания - выводим ошибку
-		if balance < requestData.Sum {
+		// проверяем номер заказа по схеме проверки пользователя
+		if !numberValidator.Valid(requestData.OrderNumber) {
 			writeResponse(w, r, commonResponse{
 				isError: true,
-				message: http.StatusText(http.StatusPaymentRequired),
-				code:    http.StatusPaymentRequired,
+				message: http.StatusText(http.StatusUnprocessableEntity),
+				code:    http.StatusUnprocessableEntity,
 			})
 			return
 		}
 
-		// сохраняем списание в базе данных
-		err = data.Store.InsertWithdrawal(r.Context(), requestData.OrderNumber, requestData.Sum, userID)
+		// сохраняем списание в базе данных, баланс и ограничения на списания проверяются в той же транзакции
+		err = data.Store.InsertWithdrawal(r.Context(), requestData.OrderNumber, requestData.Sum, userID, data.Conf.WithdrawalLimits)
 		if err != nil {
+			// если баланс меньше суммы списания - выводим ошибку
+			if errors.Is(err, repository.ErrInsufficientFunds) {
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusPaymentRequired),
+					code:    http.StatusPaymentRequired,
+				})
+				return
+			}
+
+			// если на счету задолженность - списания заблокированы
+			if errors.Is(err, repository.ErrNegativeBalance) {
+				writeJSON(w, http.StatusForbidden, errorResponse{
+					Error:   "negative_balance",
+					Message: err.Error(),
+				})
+				return
+			}
+
+			// если нарушено ограничение на списание - выводим описание нарушенного правила
+			var limitErr *repository.WithdrawalLimitError
+			if errors.As(err, &limitErr) {
+				writeJSON(w, http.StatusForbidden, WithdrawLimitResponse{
+					Error:     "withdrawal_limit_exceeded",
+					Rule:      limitErr.Rule,
+					Limit:     limitErr.Limit,
+					Available: limitErr.Available,
+				})
+				return
+			}
+
 			data.Logger.Debugw(err.Error(), "event", "insert withdrawal", "userID", userID, "number", requestData.OrderNumber, "sum", requestData.Sum)
 			writeResponse(w, r, commonResponse{
 				isError: true,
@@ -147,7 +200,8 @@ func createWithdrawHandler(data Handlers) http.HandlerFunc {
 	}
 }
 
-// createGetWithdrawalsHandler - создание обработчика метода для получения списка списаний
+// createGetWithdrawalsHandler - создание обработчика метода для получения списка списаний,
+// поддерживает постраничную выдачу (limit, cursor), диапазон времени (from, to) и группировку по периодам (group_by)
 func createGetWithdrawalsHandler(data Handlers) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -161,8 +215,30 @@ func createGetWithdrawalsHandler(data Handlers) http.HandlerFunc {
 			})
 		}
 
-		// получаем список списаний из базы данных
-		withdrawals, err := data.Store.GetWithdrawals(r.Context(), userID)
+		// получаем параметры постраничной выдачи и диапазон времени
+		params, err := parsePageParams(r)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: err.Error(),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// в режиме группировки выводим суммы списаний по периодам
+		if groupBy := r.URL.Query().Get("group_by"); groupBy != "" {
+			writeWithdrawalsAggregates(w, r, data, userID, groupBy, params)
+			return
+		}
+
+		// получаем страницу списка списаний из базы данных
+		withdrawals, next, err := data.Store.GetWithdrawalsPage(r.Context(), userID, repository.WithdrawalsFilter{
+			Limit:  params.Limit,
+			Cursor: params.Cursor,
+			From:   params.From,
+			To:     params.To,
+		})
 		if err != nil {
 			writeResponse(w, r, commonResponse{
 				isError: true,
@@ -181,8 +257,44 @@ func createGetWithdrawalsHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
+		setNextPageHeaders(w, r, next)
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(withdrawals)
 	}
 }
+
+// writeWithdrawalsAggregates - вывод сумм списаний пользователя по периодам day или month,
+// параметры limit и cursor в этом режиме не используются
+func writeWithdrawalsAggregates(w http.ResponseWriter, r *http.Request, data Handlers, userID int, groupBy string, params pageParams) {
+	if groupBy != repository.GroupByDay && groupBy != repository.GroupByMonth {
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: "group_by должен быть day или month",
+			code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	aggregates, err := data.Store.GetWithdrawalsAggregates(r.Context(), userID, groupBy, params.From, params.To)
+	if err != nil {
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusInternalServerError),
+			code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	if len(aggregates) == 0 {
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusNoContent),
+			code:    http.StatusNoContent,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, aggregates)
+}
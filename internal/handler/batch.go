@@ -0,0 +1,192 @@
+// Package handler содержит обработчик пакетной загрузки номеров заказов
+package handler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// maxBatchOrders максимальное количество номеров заказов в одном пакете
+const maxBatchOrders = 1000
+
+// BatchOrderResult структура, описывающая результат обработки одного номера заказа из пакета
+type BatchOrderResult struct {
+	OrderNumber string `json:"number"`
+	Result      string `json:"result"`
+}
+
+// BatchOrdersResponse структура, описывающая формат ответа на пакетную загрузку заказов
+type BatchOrdersResponse struct {
+	Accepted int                `json:"accepted"`
+	Results  []BatchOrderResult `json:"results"`
+}
+
+// createPostOrdersBatchHandler создает обработчик пакетной загрузки номеров заказов
+// в формате JSON массива или CSV, новые заказы сохраняются в одной транзакции
+// и ставятся в очередь опроса системы начислений, ответ не ждет их обработки
+func createPostOrdersBatchHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// разбираем список номеров заказов в зависимости от формата запроса
+		numbers, err := parseBatchOrderNumbers(r)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: err.Error(),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		if len(numbers) == 0 || len(numbers) > maxBatchOrders {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: fmt.Sprintf("пакет должен содержать от 1 до %d номеров заказов", maxBatchOrders),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// проверяем ограничения частоты загрузок и блокировки пользователя и IP-адреса
+		if !checkOrderUploads(w, r, data, userID, len(numbers)) {
+			return
+		}
+
+		// получаем схему проверки номеров заказов пользователя
+		numberValidator, err := getOrderValidator(r.Context(), data, userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// проверяем номера заказов по схеме проверки пользователя, в базу данных передаем только корректные
+		results := make([]BatchOrderResult, len(numbers))
+		var valid []string
+		var validIdx []int
+		for i, number := range numbers {
+			results[i].OrderNumber = number
+			if !numberValidator.Valid(number) {
+				results[i].Result = repository.OrderResultInvalid
+				continue
+			}
+			valid = append(valid, number)
+			validIdx = append(validIdx, i)
+		}
+
+		if len(valid) > 0 {
+			// сохраняем новые заказы в базе данных одной транзакцией
+			stored, err := data.Store.InsertOrdersBatch(r.Context(), valid, userID)
+			if err != nil {
+				data.Logger.Debugw(err.Error(), "event", "insert orders batch", "userID", userID, "count", len(valid))
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+				return
+			}
+
+			for j, result := range stored {
+				results[validIdx[j]].Result = result
+			}
+		}
+
+		recordOrderUploads(r, data, userID, numbers, resultsOf(results))
+
+		// принятые заказы уже в очереди опроса, воркер очереди запросит начисления по ним
+		response := BatchOrdersResponse{Results: results}
+		for _, result := range results {
+			if result.Result == repository.OrderResultAccepted {
+				response.Accepted++
+			}
+		}
+
+		writeJSON(w, http.StatusAccepted, response)
+	}
+}
+
+// resultsOf возвращает результаты обработки номеров заказов пакета в порядке номеров
+func resultsOf(results []BatchOrderResult) []string {
+	values := make([]string, len(results))
+	for i, result := range results {
+		values[i] = result.Result
+	}
+	return values
+}
+
+// parseBatchOrderNumbers функция разбора номеров заказов из JSON массива строк или чисел
+// либо из CSV, в котором номером считается каждое непустое поле
+func parseBatchOrderNumbers(r *http.Request) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.New("can't read body")
+	}
+
+	switch mediaType {
+	case "application/json":
+		// номера принимаются без преобразования в число, чтобы не потерять длинные номера
+		var items []json.RawMessage
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, errors.New("ожидается JSON массив номеров заказов")
+		}
+
+		numbers := make([]string, 0, len(items))
+		for _, item := range items {
+			var number string
+			if err := json.Unmarshal(item, &number); err != nil {
+				number = string(item)
+			}
+			numbers = append(numbers, strings.TrimSpace(number))
+		}
+		return numbers, nil
+
+	case "text/csv":
+		reader := csv.NewReader(bytes.NewReader(body))
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, errors.New("некорректный CSV")
+		}
+
+		var numbers []string
+		for i, record := range records {
+			for _, field := range record {
+				field = strings.TrimSpace(field)
+				// первая строка может быть заголовком
+				if field == "" || (i == 0 && (field == "number" || field == "order")) {
+					continue
+				}
+				numbers = append(numbers, field)
+			}
+		}
+		return numbers, nil
+	}
+
+	return nil, errors.New("поддерживаются форматы application/json и text/csv")
+}
@@ -0,0 +1,98 @@
+// Package handler содержит защиту от CSRF запросов, авторизованных cookie
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/hardvlad/ypdiploma1/internal/config"
+)
+
+// csrfHeader заголовок, в котором клиент передает значение CSRF cookie в режиме double-submit
+const csrfHeader = "X-CSRF-Token"
+
+// csrfMiddleware возвращает middleware защиты от CSRF для изменяющих запросов, авторизованных cookie:
+// в режиме origin источник запроса из Origin или Referer должен совпадать с адресом сервиса или быть доверенным,
+// в режиме double-submit заголовок X-CSRF-Token должен совпадать с CSRF cookie,
+// запросы с токеном в заголовке Authorization или API ключом и запросы без cookie авторизации не проверяются
+func csrfMiddleware(conf *config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if conf.CSRFMode == config.CSRFModeOff || isSafeMethod(r.Method) || r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" || !hasAuthCookie(r, conf) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed := false
+			switch conf.CSRFMode {
+			case config.CSRFModeDoubleSubmit:
+				allowed = checkDoubleSubmit(r, conf.CSRFCookieName)
+			default:
+				allowed = checkOrigin(r, conf.CSRFTrustedOrigins)
+			}
+
+			if !allowed {
+				writeJSON(w, http.StatusForbidden, errorResponse{Error: "csrf", Message: "запрос не прошел проверку на CSRF"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isSafeMethod проверяет, что метод запроса не изменяет данные
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// hasAuthCookie проверяет, передана ли в запросе cookie access или refresh токена
+func hasAuthCookie(r *http.Request, conf *config.Config) bool {
+	for _, name := range []string{conf.CookieName, conf.RefreshCookieName} {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDoubleSubmit проверяет совпадение заголовка X-CSRF-Token со значением CSRF cookie
+func checkDoubleSubmit(r *http.Request, cookieName string) bool {
+	c, err := r.Cookie(cookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(c.Value)) == 1
+}
+
+// checkOrigin проверяет источник запроса по заголовку Origin, а при его отсутствии - по Referer,
+// запросы без обоих заголовков отправлены не браузером и пропускаются
+func checkOrigin(r *http.Request, trusted []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer := r.Header.Get("Referer")
+		if referer == "" {
+			return true
+		}
+		u, err := url.Parse(referer)
+		if err != nil {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(trusted, func(item string) bool {
+		return strings.EqualFold(strings.TrimRight(item, "/"), origin)
+	})
+}
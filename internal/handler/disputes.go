@@ -0,0 +1,247 @@
+// Package handler содержит методы открытия споров по начислениям и административные методы разбора споров
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// disputeQueueLimit максимальное количество споров в выдаче очереди
+const disputeQueueLimit = 100
+
+// DisputeRequest структура, описывающая формат запроса на открытие спора
+type DisputeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// DisputeDecisionRequest структура, описывающая формат решения по спору,
+// Amount - сумма корректировки баланса в пользу пользователя
+type DisputeDecisionRequest struct {
+	Resolution string  `json:"resolution"`
+	Amount     float64 `json:"amount"`
+}
+
+// createPostDisputeHandler создает обработчик открытия спора по начислению за заказ пользователя
+func createPostDisputeHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request DisputeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Reason) == "" {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		dispute, err := data.Store.CreateDispute(r.Context(), userID, chi.URLParam(r, "number"), strings.TrimSpace(request.Reason))
+		if err != nil {
+			switch {
+			case errors.Is(err, repository.ErrOrderNotFinished):
+				writeJSON(w, http.StatusUnprocessableEntity, errorResponse{Error: "order_not_finished", Message: err.Error()})
+			case errors.Is(err, repository.ErrDisputeExists):
+				writeJSON(w, http.StatusConflict, errorResponse{Error: "dispute_exists", Message: err.Error()})
+			default:
+				data.Logger.Debugw(err.Error(), "event", "create dispute", "userID", userID)
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+			}
+			return
+		}
+
+		// чужие и несуществующие заказы не различаются
+		if dispute == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, dispute)
+	}
+}
+
+// createGetDisputesHandler создает обработчик получения споров пользователя
+func createGetDisputesHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		disputes, err := data.Store.GetUserDisputes(r.Context(), userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// администраторы, разбиравшие спор, пользователю не показываются
+		for i := range disputes {
+			disputes[i].ReviewedBy = 0
+			disputes[i].ResolvedBy = 0
+		}
+
+		if len(disputes) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, disputes)
+	}
+}
+
+// createAdminGetDisputesHandler создает административный обработчик очереди споров с фильтром по статусу
+func createAdminGetDisputesHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		status := r.URL.Query().Get("status")
+		if status != "" && !slices.Contains([]string{
+			repository.DisputeStatusOpen,
+			repository.DisputeStatusUnderReview,
+			repository.DisputeStatusResolved,
+			repository.DisputeStatusRejected,
+		}, status) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "неизвестный статус спора",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		disputes, err := data.Store.GetDisputes(r.Context(), status, disputeQueueLimit)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if len(disputes) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, disputes)
+	}
+}
+
+// createAdminDisputeDecisionHandler создает административный обработчик перевода спора в статус status:
+// взятие в работу, решение с корректировкой баланса или отказ
+func createAdminDisputeDecisionHandler(data Handlers, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем администратора из контекста, он записывается в спор и корректировку
+		actorID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		disputeID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		// при взятии в работу тело запроса не обязательно
+		var request DisputeDecisionRequest
+		if status != repository.DisputeStatusUnderReview {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Amount < 0 {
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusBadRequest),
+					code:    http.StatusBadRequest,
+				})
+				return
+			}
+
+			if status == repository.DisputeStatusResolved && request.Amount == 0 {
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: "для решения в пользу пользователя нужна сумма корректировки amount",
+					code:    http.StatusBadRequest,
+				})
+				return
+			}
+		}
+
+		dispute, err := data.Store.SetDisputeStatus(r.Context(), disputeID, actorID, status, request.Resolution, request.Amount)
+		if err != nil {
+			switch {
+			case errors.Is(err, repository.ErrDisputeNotFound):
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusNotFound),
+					code:    http.StatusNotFound,
+				})
+			case errors.Is(err, repository.ErrDisputeState):
+				writeJSON(w, http.StatusConflict, errorResponse{Error: "invalid_dispute_transition", Message: err.Error()})
+			default:
+				data.Logger.Debugw(err.Error(), "event", "set dispute status", "disputeID", disputeID, "status", status)
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+			}
+			return
+		}
+
+		data.Logger.Infow("Спор обработан", "disputeID", disputeID, "status", status, "amount", request.Amount, "actorID", actorID)
+		writeJSON(w, http.StatusOK, dispute)
+	}
+}
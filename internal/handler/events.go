@@ -0,0 +1,119 @@
+// Package handler содержит потоковую выдачу событий пользователя в формате Server-Sent Events
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// паузы перед повторным подключением к уведомлениям о событиях
+const (
+	eventsReconnectMin = time.Second
+	eventsReconnectMax = time.Minute
+)
+
+// CreateEventsListener запуск воркера, получающего события пользователей из базы данных
+// и рассылающего их подписчикам этого экземпляра сервиса, при обрыве подключения воркер переподключается
+// с удвоением паузы, пауза сбрасывается после успешного подключения
+func CreateEventsListener(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		delay := eventsReconnectMin
+		resetDelay := func() { delay = eventsReconnectMin }
+		for {
+			err := data.Store.ListenUserEvents(ctx, resetDelay, data.Events.Publish)
+			if ctx.Err() != nil {
+				data.Logger.Infow("eventsListener: shutting down")
+				return
+			}
+
+			data.Logger.Errorw("eventsListener: listen error", "error", err, "retry", delay)
+			select {
+			case <-time.After(delay):
+				delay = min(delay*2, eventsReconnectMax)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// createEventsHandler создает обработчик потока событий пользователя: смена статусов заказов,
+// начисления и списания, поток завершается при отключении клиента или остановке сервиса
+func createEventsHandler(ctx context.Context, data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// поток событий не должен ограничиваться таймаутом записи сервера
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			data.Logger.Debugw(err.Error(), "event", "events - reset write deadline")
+		}
+
+		events, unsubscribe := data.Events.Subscribe(userID)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		if err := rc.Flush(); err != nil {
+			data.Logger.Errorw("events - flush not supported", "error", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(data.Conf.EventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case event := <-events:
+				if err := writeEvent(w, event); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent функция записи события в поток в формате Server-Sent Events
+func writeEvent(w http.ResponseWriter, event repository.UserEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, payload)
+	return err
+}
@@ -0,0 +1,113 @@
+// Package handler содержит административные методы управления персональными ограничениями на списания
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// validWithdrawalLimits проверка, что заданные персональные ограничения на списания не отрицательны
+func validWithdrawalLimits(limits repository.UserWithdrawalLimits) bool {
+	for _, value := range []*float64{limits.MaxSingle, limits.MaxDaily, limits.MaxWeekly, limits.MinBalance} {
+		if value != nil && *value < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// createAdminSetWithdrawalLimitsHandler создает обработчик установки персональных ограничений на списания пользователя,
+// незаданное поле - действует ограничение из конфигурации, ноль - ограничения нет
+func createAdminSetWithdrawalLimitsHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		var request repository.UserWithdrawalLimits
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validWithdrawalLimits(request) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "ограничения max_single, max_daily, max_weekly и min_balance должны быть неотрицательными числами",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		found, err := data.Store.SetUserWithdrawalLimits(r.Context(), userID, request)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "set withdrawal limits", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !found {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Персональные ограничения на списания изменены", "userID", userID, "limits", request)
+
+		writeJSON(w, http.StatusOK, request)
+	}
+}
+
+// createAdminDeleteWithdrawalLimitsHandler создает обработчик удаления персональных ограничений на списания пользователя,
+// после удаления действуют ограничения из конфигурации
+func createAdminDeleteWithdrawalLimitsHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		deleted, err := data.Store.DeleteUserWithdrawalLimits(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "delete withdrawal limits", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !deleted {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Персональные ограничения на списания удалены", "userID", userID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -2,14 +2,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/hardvlad/ypdiploma1/internal/auth"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
 	"github.com/hardvlad/ypdiploma1/internal/util"
 )
 
+// loginAttemptsRetention срок хранения журнала попыток входа
+const loginAttemptsRetention = 30 * 24 * time.Hour
+
 // loginUser структура, описывающая формат запроса в JSON
 type loginUser struct {
 	Login    string `json:"login"`
@@ -44,10 +51,13 @@ func createLoginHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
-		// получение из базы userID и хэша пароля по логину
-		userID, pwdHash, err := data.Store.GetUserIDPasswordHashByLogin(r.Context(), user.Login)
+		ip := getClientIP(r)
+
+		// проверка блокировки входа по логину и IP-адресу до сравнения пароля,
+		// чтобы перебор не расходовал ресурсы на bcrypt
+		lockout, err := data.Store.CheckLoginLockout(r.Context(), user.Login, ip)
 		if err != nil {
-			data.Logger.Debugw(err.Error(), "event", "login - get userID error", "login", user.Login)
+			data.Logger.Debugw(err.Error(), "event", "login - check lockout", "login", user.Login)
 			writeResponse(w, r, commonResponse{
 				isError: true,
 				message: http.StatusText(http.StatusInternalServerError),
@@ -55,20 +65,36 @@ func createLoginHandler(data Handlers) http.HandlerFunc {
 			})
 			return
 		}
+		if lockout > 0 {
+			recordLoginAttempt(r, data, user.Login, ip, repository.LoginResultLocked)
+			writeLoginLocked(w, lockout)
+			return
+		}
 
-		// если userID == 0, значит пользователь с таким логином не найден, выводим StatusUnauthorized
-		if userID == 0 {
+		// получение из базы userID и хэша пароля по логину
+		userID, pwdHash, err := data.Store.GetUserIDPasswordHashByLogin(r.Context(), user.Login)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "login - get userID error", "login", user.Login)
 			writeResponse(w, r, commonResponse{
 				isError: true,
-				message: http.StatusText(http.StatusUnauthorized),
-				code:    http.StatusUnauthorized,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
 			})
 			return
 		}
 
-		// проверка пароля, если не совпадает - выводим StatusUnauthorized
+		// если пользователь с таким логином не найден, пароль сравнивается с фиктивным хэшем,
+		// чтобы время ответа не выдавало существование логина
+		if userID == 0 {
+			pwdHash = dummyPasswordHash()
+		}
+
+		// проверка пароля, если не совпадает или пользователь не найден - выводим StatusUnauthorized
 		ok := util.CheckPasswordHash(user.Password, pwdHash)
-		if !ok {
+		if !ok || userID == 0 {
+			if lockout := recordLoginAttempt(r, data, user.Login, ip, repository.LoginResultFailure); lockout > 0 {
+				data.Logger.Warnw("Вход заблокирован после неудачных попыток", "login", user.Login, "ip", ip, "lockout", lockout)
+			}
 			writeResponse(w, r, commonResponse{
 				isError: true,
 				message: http.StatusText(http.StatusUnauthorized),
@@ -77,10 +103,11 @@ func createLoginHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
-		// создание токена
-		token, err := auth.CreateToken(time.Hour*24, userID, data.Conf.TokenSecret)
-		if err != nil {
-			data.Logger.Debugw(err.Error(), "event", "login - create token", "login", user.Login, "userID", userID)
+		recordLoginAttempt(r, data, user.Login, ip, repository.LoginResultSuccess)
+
+		// выдача токенов или, при подключенной двухфакторной аутентификации, переход ко второму шагу входа
+		if err := completeLogin(w, r, data, userID); err != nil {
+			data.Logger.Debugw(err.Error(), "event", "login - complete", "login", user.Login, "userID", userID)
 			writeResponse(w, r, commonResponse{
 				isError: true,
 				message: http.StatusText(http.StatusInternalServerError),
@@ -88,16 +115,50 @@ func createLoginHandler(data Handlers) http.HandlerFunc {
 			})
 			return
 		}
+	}
+}
+
+// dummyPasswordHash фиктивный хэш пароля для сравнения при входе с несуществующим логином
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := util.HashPassword(util.GenerateRandomString(16))
+	return hash
+})
+
+// recordLoginAttempt записывает попытку входа в журнал и возвращает установленную блокировку,
+// ошибка записи не влияет на ответ пользователю
+func recordLoginAttempt(r *http.Request, data Handlers, login string, ip string, result string) time.Duration {
+	lockout, err := data.Store.RecordLoginAttempt(r.Context(), login, ip, result, data.Conf.LoginLockout)
+	if err != nil {
+		data.Logger.Errorw(err.Error(), "event", "запись попытки входа", "login", login, "ip", ip, "result", result)
+		return 0
+	}
+	return lockout
+}
+
+// writeLoginLocked выводит StatusTooManyRequests с временем до снятия блокировки входа,
+// ответ одинаков для существующих и несуществующих логинов
+func writeLoginLocked(w http.ResponseWriter, lockout time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(lockout.Seconds())), 1)))
+	writeJSON(w, http.StatusTooManyRequests, errorResponse{Error: "login_locked", Message: "слишком много неудачных попыток входа, повторите позже"})
+}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:  data.Conf.CookieName,
-			Value: token,
-		})
+// purgeLoginAttempts удаление записей журнала попыток входа старше срока хранения
+// и сброшенных счетчиков неудачных попыток входа по логинам и IP-адресам
+func purgeLoginAttempts(ctx context.Context, data Handlers) error {
+	retention := max(loginAttemptsRetention, data.Conf.LoginLockout.ResetAfter)
+
+	purged, err := data.Store.PurgeLoginAttempts(ctx, retention)
+	if err != nil {
+		return err
+	}
+
+	lockouts, err := data.Store.PurgeLoginLockouts(ctx, data.Conf.LoginLockout.ResetAfter)
+	if err != nil {
+		return err
+	}
 
-		writeResponse(w, r, commonResponse{
-			isError: false,
-			message: http.StatusText(http.StatusOK),
-			code:    http.StatusOK,
-		})
+	if purged > 0 || lockouts > 0 {
+		data.Logger.Infow("Журнал попыток входа очищен", "purged", purged, "lockouts", lockouts, "retention", retention)
 	}
+	return nil
 }
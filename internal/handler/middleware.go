@@ -6,7 +6,6 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"context"
-	"database/sql"
 	"io"
 	"net/http"
 	"slices"
@@ -14,29 +13,50 @@ import (
 
 	"github.com/andybalholm/brotli"
 	"github.com/hardvlad/ypdiploma1/internal/auth"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/util"
 	"go.uber.org/zap"
 )
 
 type contextKey string
 
-// UserIDKey поле в контексте запроса для UserID
-const userIDKey contextKey = "user_id"
+// principalKey поле в контексте запроса для пользователя запроса
+const principalKey contextKey = "principal"
+
+// principal тип, описывающий пользователя запроса: роль, для запросов по access токену - сессию SessionID,
+// для запросов по API ключу - области доступа ключа
+type principal struct {
+	UserID    int
+	Role      string
+	SessionID string
+	Scopes    []string
+}
+
+// can проверка права доступа пользователя запроса: право должно быть у роли,
+// а при авторизации API ключом - входить в области доступа ключа
+func (p *principal) can(permission auth.Permission) bool {
+	if !auth.HasPermission(p.Role, permission) {
+		return false
+	}
+	return p.Scopes == nil || slices.Contains(p.Scopes, string(permission))
+}
 
 type compressWriter struct {
 	http.ResponseWriter
-	Writer        io.Writer
+	Writer        io.WriteCloser
 	setEncoding   string
 	setStatusCode int
+	compress      bool
+	wroteHeader   bool
 }
 
 func (w *compressWriter) Write(b []byte) (int, error) {
-	contentType := w.Header().Get("Content-Type")
-	if strings.Contains(contentType, "application/json") || strings.Contains(contentType, "text/html") {
-		w.Header().Set("Content-Encoding", w.setEncoding)
-		w.ResponseWriter.WriteHeader(w.setStatusCode)
+	if !w.wroteHeader {
+		w.writeHeader()
+	}
+	if w.compress {
 		return w.Writer.Write(b)
 	}
-	w.ResponseWriter.WriteHeader(w.setStatusCode)
 	return w.ResponseWriter.Write(b)
 }
 
@@ -44,6 +64,50 @@ func (w *compressWriter) WriteHeader(statusCode int) {
 	w.setStatusCode = statusCode
 }
 
+// writeHeader по типу содержимого определяет, нужно ли сжимать ответ, и отправляет заголовки,
+// сжимаются только ответы в JSON и HTML
+func (w *compressWriter) writeHeader() {
+	contentType := w.Header().Get("Content-Type")
+	if strings.Contains(contentType, "application/json") || strings.Contains(contentType, "text/html") {
+		w.compress = true
+		w.Header().Set("Content-Encoding", w.setEncoding)
+	}
+	if w.setStatusCode == 0 {
+		w.setStatusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.setStatusCode)
+	w.wroteHeader = true
+}
+
+// Flush отправляет клиенту накопленные данные, в том числе из буфера сжатия
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.writeHeader()
+	}
+	if flusher, ok := w.Writer.(interface{ Flush() error }); ok && w.compress {
+		flusher.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap возвращает исходный http.ResponseWriter для http.ResponseController
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close завершает ответ: дописывает сжатые данные или отправляет заголовки ответа без тела
+func (w *compressWriter) close() {
+	if !w.wroteHeader {
+		if w.setStatusCode != 0 {
+			w.ResponseWriter.WriteHeader(w.setStatusCode)
+		}
+		return
+	}
+	if w.compress {
+		w.Writer.Close()
+	}
+}
+
 // ResponseCompressHandle возвращает хендлер middleware для сжатия ответов
 func ResponseCompressHandle(next http.Handler, sugarLogger *zap.SugaredLogger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -68,14 +132,14 @@ func ResponseCompressHandle(next http.Handler, sugarLogger *zap.SugaredLogger) h
 				sugarLogger.Error(err.Error(), "сжатие ответа", acceptEncoding)
 				return
 			}
-
-			defer writer.Close()
 		} else {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		next.ServeHTTP(&compressWriter{ResponseWriter: w, Writer: writer, setEncoding: encoding, setStatusCode: 0}, r)
+		cw := &compressWriter{ResponseWriter: w, Writer: writer, setEncoding: encoding, setStatusCode: 0}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
 	})
 }
 
@@ -117,51 +181,135 @@ func RequestDecompressHandle(next http.Handler, sugarLogger *zap.SugaredLogger)
 	})
 }
 
-// AuthorizationMiddleware возвращает хендлер middleware для проверки авторизации
-func AuthorizationMiddleware(next http.Handler, sugarLogger *zap.SugaredLogger, cookieName string, secretKey string, db *sql.DB) http.Handler {
+// AuthorizationMiddleware возвращает хендлер middleware, определяющий пользователя запроса по API ключу
+// или по access токену из заголовка Authorization: Bearer или из cookie с проверкой отзыва семьи токенов.
+// Запросы без действительных ключа или токена передаются дальше без пользователя,
+// права доступа проверяются на маршрутах через requirePermission
+func AuthorizationMiddleware(next http.Handler, sugarLogger *zap.SugaredLogger, cookieName string, tokenKeys *auth.KeySet, store repository.StorageInterface) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		// пути, требующие авторизации
-		authRoutes := []string{"/api/user/orders", "/api/user/balance", "/api/user/balance/withdraw", "/api/user/withdrawals"}
-		// если авторизация не нужна - пропускаем обработку
-		if !slices.Contains(authRoutes, r.URL.Path) {
+		// если не заданы параметры авторизации - пользователь не определяется
+		if cookieName == "" || tokenKeys == nil || store == nil {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// если не заданы параметры авторизации - выдаем StatusUnauthorized
-		if cookieName == "" || secretKey == "" || db == nil {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		p, err := authenticate(r, sugarLogger, cookieName, tokenKeys, store)
+		if err != nil {
+			sugarLogger.Errorw(err.Error(), "event", "авторизация запроса")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		userID := 0
-		c, err := r.Cookie(cookieName)
-		if err != nil {
-		} else {
-			uid, err := auth.GetUserID(c.Value, secretKey)
-			// если возникла ошибка при разборе JWT токена - выдаем StatusUnauthorized
-			if err != nil {
-				sugarLogger.Errorw(err.Error(), "event", "парсинг токена из куки", "cookie", c.Value)
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey, p))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate определение пользователя запроса по API ключу или access токену,
+// возвращает nil, если ключ или токен не переданы либо недействительны
+func authenticate(r *http.Request, sugarLogger *zap.SugaredLogger, cookieName string, tokenKeys *auth.KeySet, store repository.StorageInterface) (*principal, error) {
+	// запросы серверных клиентов авторизуются API ключом, права ограничены областями доступа ключа
+	if key := getAPIKey(r); key != "" {
+		apiKey, err := store.AuthenticateAPIKey(r.Context(), util.HashToken(key))
+		if err != nil || apiKey == nil {
+			return nil, err
+		}
+		return &principal{UserID: apiKey.UserID, Role: apiKey.UserRole, Scopes: apiKey.Scopes}, nil
+	}
+
+	token := getAccessToken(r, cookieName)
+	if token == "" {
+		return nil, nil
+	}
+
+	claims, err := auth.ParseToken(token, tokenKeys)
+	if err != nil {
+		sugarLogger.Debugw(err.Error(), "event", "парсинг токена авторизации")
+		return nil, nil
+	}
+
+	// токены сессии, отозванной при выходе, пользователем или при повторном использовании refresh токена,
+	// не принимаются, для действующей сессии отмечается время запроса
+	if claims.FamilyID != "" {
+		active, err := store.TouchSession(r.Context(), claims.FamilyID, sessionTouchInterval)
+		if err != nil || !active {
+			return nil, err
+		}
+	}
+
+	// токены, выданные до появления ролей, относятся к обычным пользователям
+	role := claims.Role
+	if role == "" {
+		role = auth.RoleUser
+	}
+
+	return &principal{UserID: claims.UserID, Role: role, SessionID: claims.FamilyID}, nil
+}
+
+// requirePermission возвращает middleware маршрута, пропускающий запросы пользователей с правом permission:
+// без пользователя выводится StatusUnauthorized, без права - StatusForbidden
+func requirePermission(permission auth.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := r.Context().Value(principalKey).(*principal)
+			if !ok {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
 
-			userID = uid
-		}
+			if !p.can(permission) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
 
-		// если удалось определить ID пользователя - выдаем StatusUnauthorized
-		if userID == 0 {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-		ctx := context.WithValue(r.Context(), userIDKey, userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// apiKeyPrefix префикс API ключей, отличающий их от JWT токенов в заголовке Authorization
+const apiKeyPrefix = "gk_"
+
+// getAPIKey получение API ключа из заголовка X-API-Key или из заголовка Authorization: Bearer gk_...
+func getAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") && strings.HasPrefix(strings.TrimSpace(token), apiKeyPrefix) {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// getAccessToken получение access токена из заголовка Authorization: Bearer <token>,
+// а при его отсутствии - из cookie с именем cookieName
+func getAccessToken(r *http.Request, cookieName string) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	if c, err := r.Cookie(cookieName); err == nil {
+		return c.Value
+	}
+	return ""
 }
 
 func getUserIDFromRequest(r *http.Request) (userID int, ok bool) {
-	userID, ok = r.Context().Value(userIDKey).(int)
-	return userID, ok
+	p, ok := r.Context().Value(principalKey).(*principal)
+	if !ok {
+		return 0, false
+	}
+	return p.UserID, true
+}
+
+// getSessionIDFromRequest получение сессии запроса, пустая строка для запросов по API ключу
+func getSessionIDFromRequest(r *http.Request) string {
+	p, ok := r.Context().Value(principalKey).(*principal)
+	if !ok {
+		return ""
+	}
+	return p.SessionID
 }
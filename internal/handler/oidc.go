@@ -0,0 +1,246 @@
+// Package handler содержит вход пользователя через провайдера OpenID Connect по коду авторизации с PKCE
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/oidc"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// oidcAuthRequestTTL время, за которое пользователь должен вернуться от провайдера с кодом авторизации
+const oidcAuthRequestTTL = 10 * time.Minute
+
+// oidcCookiePath путь cookie state начатого входа через провайдера
+const oidcCookiePath = "/api/user/oidc"
+
+// createOIDCLoginHandler создает обработчик начала входа через провайдера: сохраняет state, nonce и code_verifier,
+// связывает state с браузером cookie и перенаправляет пользователя на страницу авторизации провайдера,
+// вход авторизованного пользователя привязывает к нему внешнюю учетную запись
+func createOIDCLoginHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if data.OIDC == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		state, err := util.GenerateSecureToken(16)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		nonce, err := util.GenerateSecureToken(16)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		verifier, err := oidc.NewVerifier()
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		authURL, err := data.OIDC.AuthCodeURL(r.Context(), state, nonce, verifier)
+		if err != nil {
+			data.Logger.Errorw(err.Error(), "event", "oidc - discovery")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadGateway),
+				code:    http.StatusBadGateway,
+			})
+			return
+		}
+
+		request := repository.OIDCAuthRequest{Nonce: nonce, CodeVerifier: verifier}
+		if userID, ok := getUserIDFromRequest(r); ok {
+			request.LinkUserID = userID
+		}
+
+		err = data.Store.SaveOIDCAuthRequest(r.Context(), util.HashToken(state), request, oidcAuthRequestTTL)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "oidc - save auth request")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		http.SetCookie(w, newOIDCStateCookie(data, state, int(oidcAuthRequestTTL.Seconds())))
+
+		writeResponse(w, r, commonResponse{
+			isError:     false,
+			redirectURL: authURL,
+			code:        http.StatusFound,
+		})
+	}
+}
+
+// createOIDCCallbackHandler создает обработчик возврата от провайдера: проверяет state по cookie,
+// обменивает код на ID токен, находит, привязывает или создает пользователя и выдает токены
+func createOIDCCallbackHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if data.OIDC == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		if providerError := query.Get("error"); providerError != "" {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "oidc_denied", Message: providerError})
+			return
+		}
+
+		state, code := query.Get("state"), query.Get("code")
+		stateCookie, err := r.Cookie(data.Conf.OIDCStateCookieName)
+		if state == "" || code == "" || err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "oidc_state", Message: "вход начат в другом браузере или устарел"})
+			return
+		}
+		http.SetCookie(w, newOIDCStateCookie(data, "", -1))
+
+		request, err := data.Store.TakeOIDCAuthRequest(r.Context(), util.HashToken(state))
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "oidc - take auth request")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if request == nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "oidc_state", Message: "вход начат в другом браузере или устарел"})
+			return
+		}
+
+		claims, err := data.OIDC.Exchange(r.Context(), code, request.CodeVerifier, request.Nonce)
+		if err != nil {
+			data.Logger.Warnw(err.Error(), "event", "oidc - exchange code")
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "oidc_failed", Message: "провайдер не подтвердил вход"})
+			return
+		}
+
+		identity := repository.Identity{Issuer: claims.Issuer, Subject: claims.Subject}
+		if claims.EmailVerified {
+			identity.Email = claims.Email
+		}
+
+		userID, status, err := resolveOIDCUser(r, data, request, identity, claims)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "oidc - resolve user", "issuer", identity.Issuer, "subject", identity.Subject)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if status != nil {
+			writeJSON(w, status.code, status.response)
+			return
+		}
+
+		// выдача токенов или, при подключенной двухфакторной аутентификации, переход ко второму шагу входа
+		if err := completeLogin(w, r, data, userID); err != nil {
+			data.Logger.Debugw(err.Error(), "event", "oidc - complete login", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+	}
+}
+
+// oidcRefusal отказ во входе через провайдера с кодом ответа и описанием ошибки
+type oidcRefusal struct {
+	code     int
+	response errorResponse
+}
+
+// resolveOIDCUser определение пользователя для внешней учетной записи: привязка к пользователю, начавшему вход,
+// пользователь с ранее связанной записью или, если разрешено, новый пользователь
+func resolveOIDCUser(r *http.Request, data Handlers, request *repository.OIDCAuthRequest, identity repository.Identity, claims *oidc.IDTokenClaims) (int, *oidcRefusal, error) {
+	if request.LinkUserID > 0 {
+		err := data.Store.LinkIdentity(r.Context(), request.LinkUserID, identity)
+		if errors.Is(err, repository.ErrIdentityLinked) {
+			return 0, &oidcRefusal{http.StatusConflict, errorResponse{Error: "identity_linked", Message: err.Error()}}, nil
+		}
+		return request.LinkUserID, nil, err
+	}
+
+	userID, err := data.Store.GetUserIDByIdentity(r.Context(), identity)
+	if err != nil || userID > 0 {
+		return userID, nil, err
+	}
+
+	// пользователи с совпадающим логином или email не связываются автоматически,
+	// чтобы учетная запись провайдера не получила доступ к чужому счету
+	if !data.Conf.OIDCAutoCreate {
+		return 0, &oidcRefusal{http.StatusForbidden, errorResponse{Error: "identity_not_linked", Message: "внешняя учетная запись не связана с пользователем"}}, nil
+	}
+
+	userID, err = data.Store.CreateUserWithIdentity(r.Context(), oidcLogin(identity, claims), identity)
+	if errors.Is(err, repository.ErrLoginTaken) {
+		return 0, &oidcRefusal{http.StatusConflict, errorResponse{Error: "login_taken", Message: "логин внешней учетной записи занят, войдите по паролю и привяжите ее"}}, nil
+	}
+	if err == nil {
+		data.Logger.Infow("Создан пользователь при входе через провайдера", "userID", userID, "issuer", identity.Issuer)
+	}
+	return userID, nil, err
+}
+
+// oidcLogin логин нового пользователя: preferred_username, подтвержденный email
+// или производный от издателя и sub идентификатор
+func oidcLogin(identity repository.Identity, claims *oidc.IDTokenClaims) string {
+	if login := strings.TrimSpace(claims.PreferredUsername); login != "" {
+		return login
+	}
+	if identity.Email != "" {
+		return identity.Email
+	}
+	sum := sha256.Sum256([]byte(identity.Issuer + "\x00" + identity.Subject))
+	return "oidc-" + hex.EncodeToString(sum[:8])
+}
+
+// newOIDCStateCookie cookie state начатого входа, SameSite=Strict заменяется на Lax,
+// иначе браузер не передаст cookie при возврате от провайдера
+func newOIDCStateCookie(data Handlers, state string, maxAge int) *http.Cookie {
+	c := newCookie(data, data.Conf.OIDCStateCookieName, state, oidcCookiePath, maxAge, true)
+	if c.SameSite == http.SameSiteStrictMode {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
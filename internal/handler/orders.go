@@ -3,13 +3,42 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"mime"
 	"net/http"
+	"slices"
 
-	"github.com/hardvlad/ypdiploma1/internal/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/validator"
 )
 
+// orderStatuses статусы заказа, допустимые в фильтре списка заказов
+var orderStatuses = []string{"NEW", "PROCESSING", "INVALID", "PROCESSED"}
+
+// getOrderValidator получение схемы проверки номеров заказов пользователя:
+// персональной схемы партнера, если она задана, или схемы из конфигурации
+func getOrderValidator(ctx context.Context, data Handlers, userID int) (validator.Validator, error) {
+	spec, err := data.Store.GetUserOrderValidator(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec == "" {
+		return data.Conf.OrderValidator, nil
+	}
+
+	numberValidator, err := validator.Parse(spec)
+	if err != nil {
+		data.Logger.Errorw(err.Error(), "event", "разбор схемы проверки номеров заказов", "userID", userID, "spec", spec)
+		return nil, err
+	}
+	return numberValidator, nil
+}
+
 // createPostOrdersHandler создает обработчик для сохранения заказа
 // для дальнейшей обработки воркером - получение начислений из сторонней системы
 func createPostOrdersHandler(data Handlers, ch chan string) http.HandlerFunc {
@@ -36,9 +65,36 @@ func createPostOrdersHandler(data Handlers, ch chan string) http.HandlerFunc {
 			})
 		}
 
-		// проверяем номер заказа по алгоритму Луна - последняя цифра - контрольная сумма
-		orderNumber := string(bodyBytes)
-		if !util.CheckNumberLuhn(orderNumber) {
+		// проверяем ограничения частоты загрузок и блокировки пользователя и IP-адреса
+		if !checkOrderUploads(w, r, data, userID, 1) {
+			return
+		}
+
+		// получаем схему проверки номеров заказов пользователя
+		numberValidator, err := getOrderValidator(r.Context(), data, userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// заказ передается номером в text/plain или в JSON вместе с товарами
+		orderNumber, goods, err := parseOrderUpload(r, bodyBytes)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: err.Error(),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// проверяем номер заказа по схеме проверки пользователя, по умолчанию - по алгоритму Луна
+		if !numberValidator.Valid(orderNumber) {
+			recordOrderUploads(r, data, userID, []string{orderNumber}, []string{repository.OrderResultInvalid})
 			writeResponse(w, r, commonResponse{
 				isError: true,
 				message: http.StatusText(http.StatusUnprocessableEntity),
@@ -61,12 +117,14 @@ func createPostOrdersHandler(data Handlers, ch chan string) http.HandlerFunc {
 		// если заказ уже существует - выводим статусы
 		if existingOrderUserID != 0 {
 			if existingOrderUserID == userID {
+				recordOrderUploads(r, data, userID, []string{orderNumber}, []string{repository.OrderResultAlreadyYours})
 				writeResponse(w, r, commonResponse{
 					isError: false,
 					message: http.StatusText(http.StatusOK),
 					code:    http.StatusOK,
 				})
 			} else {
+				recordOrderUploads(r, data, userID, []string{orderNumber}, []string{repository.OrderResultConflict})
 				writeResponse(w, r, commonResponse{
 					isError: false,
 					message: http.StatusText(http.StatusConflict),
@@ -77,7 +135,11 @@ func createPostOrdersHandler(data Handlers, ch chan string) http.HandlerFunc {
 		}
 
 		// сохраняем новый заказ в базе данных
-		err = data.Store.InsertNewOrder(r.Context(), orderNumber, userID)
+		if len(goods) > 0 {
+			err = data.Store.InsertNewOrderWithGoods(r.Context(), orderNumber, userID, goods)
+		} else {
+			err = data.Store.InsertNewOrder(r.Context(), orderNumber, userID)
+		}
 		if err != nil {
 			writeResponse(w, r, commonResponse{
 				isError: true,
@@ -87,6 +149,8 @@ func createPostOrdersHandler(data Handlers, ch chan string) http.HandlerFunc {
 			return
 		}
 
+		recordOrderUploads(r, data, userID, []string{orderNumber}, []string{repository.OrderResultAccepted})
+
 		// отправляем номер заказа в канал для дальнейшей обработки воркером
 		ch <- orderNumber
 
@@ -98,7 +162,36 @@ func createPostOrdersHandler(data Handlers, ch chan string) http.HandlerFunc {
 	}
 }
 
-// createGetOrdersHandler создает обработчик для получения списка заказов пользователя
+// OrderUploadRequest структура, описывающая формат загрузки заказа с товарами в JSON
+type OrderUploadRequest struct {
+	Order string                 `json:"order"`
+	Goods []repository.OrderGood `json:"goods"`
+}
+
+// parseOrderUpload функция разбора загружаемого заказа: номера в теле запроса
+// или JSON с номером и товарами, если передан Content-Type: application/json
+func parseOrderUpload(r *http.Request, body []byte) (string, []repository.OrderGood, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return string(body), nil, nil
+	}
+
+	var request OrderUploadRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", nil, errors.New("некорректный JSON заказа")
+	}
+
+	for _, good := range request.Goods {
+		if good.Description == "" || good.Price <= 0 {
+			return "", nil, errors.New("у товара должны быть заданы description и положительная price")
+		}
+	}
+
+	return request.Order, request.Goods, nil
+}
+
+// createGetOrdersHandler создает обработчик для получения списка заказов пользователя,
+// поддерживает постраничную выдачу (limit, cursor) и фильтры по статусу и времени загрузки (status, from, to)
 func createGetOrdersHandler(data Handlers) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -112,8 +205,35 @@ func createGetOrdersHandler(data Handlers) http.HandlerFunc {
 			})
 		}
 
-		// получаем список заказов из базы данных
-		orders, err := data.Store.GetOrders(userID)
+		// получаем параметры постраничной выдачи и фильтры
+		params, err := parsePageParams(r)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: err.Error(),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		if status != "" && !slices.Contains(orderStatuses, status) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "неизвестный статус заказа",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// получаем страницу списка заказов из базы данных
+		orders, next, err := data.Store.GetOrdersPage(r.Context(), userID, repository.OrdersFilter{
+			Limit:  params.Limit,
+			Cursor: params.Cursor,
+			Status: status,
+			From:   params.From,
+			To:     params.To,
+		})
 		if err != nil {
 			writeResponse(w, r, commonResponse{
 				isError: true,
@@ -133,8 +253,50 @@ func createGetOrdersHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
+		setNextPageHeaders(w, r, next)
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(orders)
 	}
 }
+
+// createGetOrderHandler создает обработчик для получения состояния отдельного заказа пользователя,
+// для чужих и несуществующих заказов выводится StatusNotFound, чтобы не раскрывать принадлежность заказа
+func createGetOrderHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// получаем заказ пользователя из базы данных
+		order, err := data.Store.GetOrder(r.Context(), userID, chi.URLParam(r, "number"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if order == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, order)
+	}
+}
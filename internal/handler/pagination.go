@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// defaultPageLimit размер страницы, если передан только параметр cursor
+const defaultPageLimit = 100
+
+// maxPageLimit максимальный размер страницы при постраничной выдаче
+const maxPageLimit = 1000
+
+// dateLayout формат даты без времени в параметрах запроса
+const dateLayout = "2006-01-02"
+
+// pageParams параметры постраничной выдачи из строки запроса
+// Limit - размер страницы (0 - без ограничения), Cursor - позиция предыдущей страницы,
+// From и To - диапазон времени [From, To)
+type pageParams struct {
+	Limit  int
+	Cursor *repository.Cursor
+	From   time.Time
+	To     time.Time
+}
+
+// parsePageParams функция разбора параметров limit, cursor, from и to из строки запроса,
+// без limit и cursor выдается весь список, как в исходной спецификации,
+// cursor без limit продолжает выдачу страницами размера defaultPageLimit,
+// from и to принимаются в формате RFC3339 или как дата, дата в to включается в диапазон целиком
+func parsePageParams(r *http.Request) (pageParams, error) {
+	var params pageParams
+	query := r.URL.Query()
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxPageLimit {
+			return params, errors.New("limit должен быть числом от 1 до " + strconv.Itoa(maxPageLimit))
+		}
+		params.Limit = value
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		value, err := repository.DecodeCursor(cursor)
+		if err != nil {
+			return params, err
+		}
+		params.Cursor = value
+		if params.Limit == 0 {
+			params.Limit = defaultPageLimit
+		}
+	}
+
+	if from := query.Get("from"); from != "" {
+		value, _, err := parseTimeParam(from)
+		if err != nil {
+			return params, errors.New("from должен быть датой или временем в формате RFC3339")
+		}
+		params.From = value
+	}
+
+	if to := query.Get("to"); to != "" {
+		value, isDate, err := parseTimeParam(to)
+		if err != nil {
+			return params, errors.New("to должен быть датой или временем в формате RFC3339")
+		}
+		if isDate {
+			value = value.AddDate(0, 0, 1)
+		}
+		params.To = value
+	}
+
+	return params, nil
+}
+
+// parseTimeParam функция разбора времени в формате RFC3339 или даты,
+// возвращает признак того, что было передано только значение даты
+func parseTimeParam(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(dateLayout, value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t.UTC(), false, err
+}
+
+// setNextPageHeaders функция установки заголовков со ссылкой на следующую страницу выдачи
+func setNextPageHeaders(w http.ResponseWriter, r *http.Request, next *repository.Cursor) {
+	if next == nil {
+		return
+	}
+
+	cursor := next.Encode()
+
+	nextURL := *r.URL
+	query := nextURL.Query()
+	query.Set("cursor", cursor)
+	nextURL.RawQuery = query.Encode()
+
+	w.Header().Set("Link", "<"+nextURL.RequestURI()+`>; rel="next"`)
+	w.Header().Set("X-Next-Cursor", cursor)
+}
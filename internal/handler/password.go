@@ -0,0 +1,209 @@
+// Package handler содержит проверку паролей по политике сложности и обработчик смены пароля
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/password"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// stepUpMaxAge время после входа, в течение которого вход пользователя без пароля
+// подтверждает чувствительные действия без кода TOTP
+const stepUpMaxAge = 5 * time.Minute
+
+// ChangePasswordRequest структура, описывающая формат запроса на смену пароля,
+// пользователь без пароля вместо старого пароля может передать код TOTP или код восстановления
+type ChangePasswordRequest struct {
+	OldPassword  string `json:"old_password"`
+	NewPassword  string `json:"new_password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// validatePassword проверяет новый пароль пользователя по политике сложности и списку утекших паролей,
+// при нарушении выводит StatusBadRequest с описанием и возвращает false
+func validatePassword(w http.ResponseWriter, r *http.Request, data Handlers, login string, pwd string) bool {
+	var policyErr *password.PolicyError
+	if err := data.Conf.PasswordPolicy.Check(login, pwd); errors.As(err, &policyErr) {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "weak_password", Message: policyErr.Reason})
+		return false
+	}
+
+	if data.Conf.BreachedPasswords == nil {
+		return true
+	}
+
+	breached, err := data.Conf.BreachedPasswords.Contains(pwd)
+	if err != nil {
+		data.Logger.Errorw(err.Error(), "event", "проверка пароля по списку утекших паролей")
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusInternalServerError),
+			code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+
+	if breached {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "breached_password", Message: "пароль встречается в утечках, выберите другой пароль"})
+		return false
+	}
+
+	return true
+}
+
+// checkReauthentication проверка повторной аутентификации перед чувствительным действием:
+// пользователь с паролем подтверждает действие паролем, пользователь без пароля, созданный при входе
+// через провайдера OpenID Connect, - кодом TOTP или кодом восстановления при подключенной двухфакторной
+// аутентификации либо входом через провайдера или по ключу доступа не ранее stepUpMaxAge назад,
+// при отказе выводит StatusForbidden, после нескольких неверных кодов - StatusTooManyRequests, и возвращает false
+func checkReauthentication(w http.ResponseWriter, r *http.Request, data Handlers, userID int, pwdHash string, pwd string, secondFactor SecondFactorRequest) bool {
+	if pwdHash != "" {
+		if util.CheckPasswordHash(pwd, pwdHash) {
+			return true
+		}
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusForbidden),
+			code:    http.StatusForbidden,
+		})
+		return false
+	}
+
+	if secondFactor.Code != "" || secondFactor.RecoveryCode != "" {
+		if !checkSecondFactorLockout(w, r, data, userID) {
+			return false
+		}
+
+		verified, err := verifySecondFactor(r.Context(), data, userID, secondFactor)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "reauthentication - second factor", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return false
+		}
+		recordSecondFactorResult(r, data, userID, verified)
+		if !verified {
+			writeJSON(w, http.StatusForbidden, errorResponse{Error: "invalid_second_factor", Message: "неверный или уже использованный код"})
+			return false
+		}
+		return true
+	}
+
+	// запросы по API ключу не относятся к сессии и свежим входом не считаются
+	sessionID := getSessionIDFromRequest(r)
+	if sessionID != "" {
+		fresh, err := data.Store.IsSessionFresh(r.Context(), userID, sessionID, stepUpMaxAge)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "reauthentication - session", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return false
+		}
+		if fresh {
+			return true
+		}
+	}
+
+	writeJSON(w, http.StatusForbidden, errorResponse{
+		Error:   "reauthentication_required",
+		Message: "подтвердите действие кодом двухфакторной аутентификации или войдите заново",
+	})
+	return false
+}
+
+// createChangePasswordHandler создает обработчик смены пароля пользователя по старому паролю,
+// пользователь, созданный при входе через провайдера OpenID Connect, устанавливает пароль без старого
+// после повторной аутентификации: все входы пользователя завершаются, текущему клиенту выдаются новые токены
+func createChangePasswordHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.NewPassword == "" {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		login, pwdHash, err := data.Store.GetUserLoginPasswordHash(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "change password - get password hash", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// проверка старого пароля или повторной аутентификации пользователя без пароля
+		secondFactor := SecondFactorRequest{Code: request.Code, RecoveryCode: request.RecoveryCode}
+		if !checkReauthentication(w, r, data, userID, pwdHash, request.OldPassword, secondFactor) {
+			return
+		}
+
+		if !validatePassword(w, r, data, login, request.NewPassword) {
+			return
+		}
+
+		newHash, err := util.HashPassword(request.NewPassword)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// установка и смена пароля отзывают все семьи токенов пользователя, в том числе текущую,
+		// текущему клиенту ниже выдается новая
+		if err := data.Store.UpdateUserPassword(r.Context(), userID, newHash); err != nil {
+			data.Logger.Debugw(err.Error(), "event", "change password - update", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		tokens, err := issueTokens(w, r, data, userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "change password - issue tokens", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data.Logger.Infow("Пароль пользователя изменен", "userID", userID)
+		writeTokens(w, r, tokens)
+	}
+}
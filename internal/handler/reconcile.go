@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/retry"
+)
+
+// reconcileBatchSize количество заказов, сверяемых за один проход
+const reconcileBatchSize = 100
+
+// CreateReconcileWorker запуск воркера сверки завершенных заказов с системой начислений,
+// если окно сверки не задано - воркер не запускается
+func CreateReconcileWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	if data.Conf.ReconcileWindow <= 0 || data.Conf.ReconcileInterval <= 0 {
+		return
+	}
+	wg.Add(1)
+	go reconcileWorker(ctx, data, wg)
+}
+
+// reconcileWorker воркер, периодически повторно запрашивающий начисления по завершенным заказам
+// и записывающий корректировки баланса при их пересмотре системой начислений
+func reconcileWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(data.Conf.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := reconcileOrders(ctx, data)
+			if err != nil {
+				data.Logger.Errorw("reconcileWorker: reconcileOrders error", "error", err)
+			}
+		case <-ctx.Done():
+			data.Logger.Infow("reconcileWorker: shutting down")
+			return
+		}
+	}
+}
+
+// reconcileOrders функция одного прохода сверки заказов
+func reconcileOrders(ctx context.Context, data Handlers) error {
+	numbers, err := data.Store.GetOrdersForReconcile(ctx, data.Conf.ReconcileWindow, data.Conf.ReconcileInterval, reconcileBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, number := range numbers {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		checkAndPause()
+
+		accrualURL, err := url.JoinPath(data.Conf.AccrualAddress, "/api/orders/", number)
+		if err != nil {
+			return err
+		}
+
+		// неудачный запрос и неокончательный ответ системы начислений не являются пересмотром,
+		// попытка сверки отмечается, чтобы заказ не задерживал очередь - сверка будет повторена через интервал
+		resp, ok, err := fetchOrderAccrualOnce(data, accrualURL)
+		if err != nil || !ok {
+			if err != nil {
+				data.Logger.Debugw(err.Error(), "event", "reconcile - fetch accrual", "orderNumber", number)
+			}
+			if err := data.Store.SetOrderReconciled(ctx, number); err != nil {
+				data.Logger.Errorw("reconcile - mark order", "orderNumber", number, "error", err)
+			}
+			continue
+		}
+
+		delta, err := data.Store.ReconcileOrder(ctx, number, resp.Status, resp.Accrual)
+		if err != nil {
+			data.Logger.Errorw("reconcile - save order", "orderNumber", number, "error", err)
+			continue
+		}
+
+		if delta != 0 {
+			data.Logger.Infow("Начисление пересмотрено", "orderNumber", number, "status", resp.Status, "delta", delta)
+		}
+	}
+
+	return nil
+}
+
+// fetchOrderAccrualOnce функция однократного запроса начислений по заказу,
+// возвращает признак того, что статус расчета окончательный
+func fetchOrderAccrualOnce(data Handlers, url string) (AccrualResponse, bool, error) {
+	var resp AccrualResponse
+
+	response, err := retry.Retry(3, 2, func() (*http.Response, error) { return http.Get(url) })
+	if err != nil {
+		return resp, false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		handle429(response, data)
+		return resp, false, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return resp, false, fmt.Errorf("неожиданный статус ответа системы начислений: %d", response.StatusCode)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&resp); err != nil {
+		return resp, false, err
+	}
+
+	return resp, resp.Status == "INVALID" || resp.Status == "PROCESSED", nil
+}
@@ -4,9 +4,7 @@ package handler
 import (
 	"encoding/json"
 	"net/http"
-	"time"
 
-	"github.com/hardvlad/ypdiploma1/internal/auth"
 	"github.com/hardvlad/ypdiploma1/internal/util"
 )
 
@@ -44,6 +42,11 @@ func createRegisterHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
+		// проверка пароля по политике сложности и списку утекших паролей
+		if !validatePassword(w, r, data, user.Login, user.Password) {
+			return
+		}
+
 		// получение из базы userID по логину
 		userID, err := data.Store.GetUserIDByLogin(r.Context(), user.Login)
 		if err != nil {
@@ -90,10 +93,10 @@ func createRegisterHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
-		// создание токена
-		token, err := auth.CreateToken(time.Hour*24, userID, data.Conf.TokenSecret)
+		// создание семьи токенов и выдача access и refresh токенов
+		tokens, err := issueTokens(w, r, data, userID)
 		if err != nil {
-			data.Logger.Debugw(err.Error(), "event", "register - create token", "login", user.Login, "userID", userID)
+			data.Logger.Debugw(err.Error(), "event", "register - issue tokens", "login", user.Login, "userID", userID)
 			writeResponse(w, r, commonResponse{
 				isError: true,
 				message: http.StatusText(http.StatusInternalServerError),
@@ -102,15 +105,7 @@ func createRegisterHandler(data Handlers) http.HandlerFunc {
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:  data.Conf.CookieName,
-			Value: token,
-		})
-
-		writeResponse(w, r, commonResponse{
-			isError: false,
-			message: http.StatusText(http.StatusOK),
-			code:    http.StatusOK,
-		})
+		// токены выдаются в cookie и, по запросу клиента, в JSON
+		writeTokens(w, r, tokens)
 	}
 }
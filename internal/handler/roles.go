@@ -0,0 +1,82 @@
+// Package handler содержит административный метод смены роли пользователя
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/auth"
+)
+
+// RoleRequest структура, описывающая формат запроса на смену роли пользователя
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// createAdminSetRoleHandler создает обработчик смены роли пользователя,
+// выданные пользователю токены отзываются, чтобы новая роль действовала со следующего входа
+func createAdminSetRoleHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		var request RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !slices.Contains(auth.Roles, request.Role) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "нужно указать роль role: user, support или admin",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// администратор не может снять роль с самого себя и остаться без доступа к управлению ролями
+		if currentUserID, ok := getUserIDFromRequest(r); ok && currentUserID == userID && request.Role != auth.RoleAdmin {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "нельзя понизить собственную роль",
+				code:    http.StatusConflict,
+			})
+			return
+		}
+
+		found, err := data.Store.SetUserRole(r.Context(), userID, request.Role)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "set user role", "userID", userID, "role", request.Role)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !found {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Роль пользователя изменена", "userID", userID, "role", request.Role)
+
+		writeResponse(w, r, commonResponse{
+			isError: false,
+			message: http.StatusText(http.StatusOK),
+			code:    http.StatusOK,
+		})
+	}
+}
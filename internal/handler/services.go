@@ -3,11 +3,16 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/auth"
 	"github.com/hardvlad/ypdiploma1/internal/config"
+	"github.com/hardvlad/ypdiploma1/internal/events"
+	"github.com/hardvlad/ypdiploma1/internal/oidc"
 	"github.com/hardvlad/ypdiploma1/internal/repository"
 	"go.uber.org/zap"
 )
@@ -17,6 +22,9 @@ type Handlers struct {
 	Conf   *config.Config
 	Store  repository.StorageInterface
 	Logger *zap.SugaredLogger
+	Events *events.Hub
+	// OIDC - клиент провайдера OpenID Connect, nil - вход через провайдера отключен
+	OIDC *oidc.Client
 }
 
 type commonResponse struct {
@@ -26,6 +34,12 @@ type commonResponse struct {
 	code        int
 }
 
+// errorResponse структура, описывающая формат ответа с ошибкой в JSON
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
 type AccrualResponse struct {
 	Order   string  `json:"order"`
 	Status  string  `json:"status"`
@@ -38,19 +52,98 @@ func NewServices(ctx context.Context, mux *chi.Mux, conf *config.Config, store r
 		Conf:   conf,
 		Store:  store,
 		Logger: sugarLogger,
+		Events: events.NewHub(),
+	}
+	if conf.OIDC != nil {
+		handlersData.OIDC = oidc.NewClient(*conf.OIDC, &http.Client{Timeout: 10 * time.Second})
 	}
 
 	CreateWorkers(ctx, numWorkers, handlersData, ch, wg)
+	CreateOrderPollWorker(ctx, handlersData, wg)
+	CreateReconcileWorker(ctx, handlersData, wg)
+	CreateEventsListener(ctx, handlersData, wg)
+	CreateWebhookWorker(ctx, handlersData, wg)
+	CreateAccountPurgeWorker(ctx, handlersData, wg)
+
+	// защита от CSRF запросов, авторизованных cookie
+	mux.Use(csrfMiddleware(conf))
 
 	mux.Post(`/api/user/register`, createRegisterHandler(handlersData))
 	mux.Post(`/api/user/login`, createLoginHandler(handlersData))
-	mux.Post(`/api/user/orders`, createPostOrdersHandler(handlersData, ch))
+	mux.Post(`/api/user/login/2fa`, createLoginSecondFactorHandler(handlersData))
+	mux.Post(`/api/user/token/refresh`, createRefreshHandler(handlersData))
+	mux.Post(`/api/user/logout`, createLogoutHandler(handlersData))
+	mux.Get(`/api/user/oidc/login`, createOIDCLoginHandler(handlersData))
+	mux.Get(`/api/user/oidc/callback`, createOIDCCallbackHandler(handlersData))
+	mux.Post(`/api/user/webauthn/login/begin`, createWebAuthnLoginBeginHandler(handlersData))
+	mux.Post(`/api/user/webauthn/login/finish`, createWebAuthnLoginFinishHandler(handlersData))
+
+	// права доступа объявляются на маршрутах, без права выводится StatusForbidden, без авторизации - StatusUnauthorized
+	withPermission := func(permission auth.Permission) chi.Router {
+		return mux.With(requirePermission(permission))
+	}
+
+	withPermission(auth.PermAccount).Post(`/api/user/password`, createChangePasswordHandler(handlersData))
+	withPermission(auth.PermAccount).Get(`/api/user/export`, createExportHandler(handlersData))
+	withPermission(auth.PermAccount).Delete(`/api/user`, createDeleteAccountHandler(handlersData))
+	withPermission(auth.PermAccount).Delete(`/api/user/deletion`, createCancelDeletionHandler(handlersData))
+	withPermission(auth.PermAccount).Get(`/api/user/sessions`, createGetSessionsHandler(handlersData))
+	withPermission(auth.PermAccount).Delete(`/api/user/sessions/{id}`, createDeleteSessionHandler(handlersData))
+	withPermission(auth.PermAccount).Post(`/api/user/2fa/totp`, createTOTPEnrollHandler(handlersData))
+	withPermission(auth.PermAccount).Post(`/api/user/2fa/totp/confirm`, createTOTPConfirmHandler(handlersData))
+	withPermission(auth.PermAccount).Delete(`/api/user/2fa/totp`, createTOTPDisableHandler(handlersData))
+	withPermission(auth.PermAccount).Post(`/api/user/webauthn/register/begin`, createWebAuthnRegisterBeginHandler(handlersData))
+	withPermission(auth.PermAccount).Post(`/api/user/webauthn/register/finish`, createWebAuthnRegisterFinishHandler(handlersData))
+	withPermission(auth.PermAccount).Get(`/api/user/webauthn/credentials`, createGetWebAuthnCredentialsHandler(handlersData))
+	withPermission(auth.PermAccount).Delete(`/api/user/webauthn/credentials/{id}`, createDeleteWebAuthnCredentialHandler(handlersData))
+	withPermission(auth.PermOrdersWrite).Post(`/api/user/orders`, createPostOrdersHandler(handlersData, ch))
+	withPermission(auth.PermOrdersWrite).Post(`/api/user/orders/batch`, createPostOrdersBatchHandler(handlersData))
+
+	withPermission(auth.PermOrdersRead).Get(`/api/user/orders`, createGetOrdersHandler(handlersData))
+	withPermission(auth.PermOrdersRead).Get(`/api/user/orders/{number}`, createGetOrderHandler(handlersData))
+	withPermission(auth.PermBalanceRead).Get(`/api/user/balance`, createGetBalanceHandler(handlersData))
+
+	withPermission(auth.PermWithdraw).Post(`/api/user/balance/withdraw`, createWithdrawHandler(handlersData))
+	withPermission(auth.PermBalanceRead).Get(`/api/user/withdrawals`, createGetWithdrawalsHandler(handlersData))
 
-	mux.Get(`/api/user/orders`, createGetOrdersHandler(handlersData))
-	mux.Get(`/api/user/balance`, createGetBalanceHandler(handlersData))
+	withPermission(auth.PermAccount).Get(`/api/user/events`, createEventsHandler(ctx, handlersData))
 
-	mux.Post(`/api/user/balance/withdraw`, createWithdrawHandler(handlersData))
-	mux.Get(`/api/user/withdrawals`, createGetWithdrawalsHandler(handlersData))
+	withPermission(auth.PermAccount).Post(`/api/user/orders/{number}/dispute`, createPostDisputeHandler(handlersData))
+	withPermission(auth.PermAccount).Get(`/api/user/disputes`, createGetDisputesHandler(handlersData))
+
+	mux.Route(`/api/user/webhooks`, func(r chi.Router) {
+		r.Use(requirePermission(auth.PermAccount))
+
+		r.Post(`/`, createPostWebhookHandler(handlersData))
+		r.Get(`/`, createGetWebhooksHandler(handlersData))
+		r.Delete(`/{id}`, createDeleteWebhookHandler(handlersData))
+		r.Get(`/{id}/deliveries`, createGetWebhookDeliveriesHandler(handlersData))
+		r.Post(`/{id}/deliveries/{deliveryID}/redeliver`, createRedeliverWebhookHandler(handlersData))
+	})
+
+	mux.Route(`/api/user/api-keys`, func(r chi.Router) {
+		r.Use(requirePermission(auth.PermAccount))
+
+		r.Post(`/`, createPostAPIKeyHandler(handlersData))
+		r.Get(`/`, createGetAPIKeysHandler(handlersData))
+		r.Delete(`/{id}`, createDeleteAPIKeyHandler(handlersData))
+	})
+
+	// административные методы доступны ролям support и admin в пределах их прав
+	mux.Route(`/api/admin`, func(r chi.Router) {
+		r.With(requirePermission(auth.PermDisputesRead)).Get(`/disputes`, createAdminGetDisputesHandler(handlersData))
+		r.With(requirePermission(auth.PermDisputesReview)).Post(`/disputes/{id}/review`, createAdminDisputeDecisionHandler(handlersData, repository.DisputeStatusUnderReview))
+		r.With(requirePermission(auth.PermDisputesResolve)).Post(`/disputes/{id}/resolve`, createAdminDisputeDecisionHandler(handlersData, repository.DisputeStatusResolved))
+		r.With(requirePermission(auth.PermDisputesReview)).Post(`/disputes/{id}/reject`, createAdminDisputeDecisionHandler(handlersData, repository.DisputeStatusRejected))
+
+		r.With(requirePermission(auth.PermAbuseReportRead)).Get(`/uploads/suspicious`, createAdminUploadAbuseHandler(handlersData))
+
+		r.With(requirePermission(auth.PermUsersManage)).Put(`/users/{id}/role`, createAdminSetRoleHandler(handlersData))
+		r.With(requirePermission(auth.PermUsersManage)).Put(`/users/{id}/withdrawal-limits`, createAdminSetWithdrawalLimitsHandler(handlersData))
+		r.With(requirePermission(auth.PermUsersManage)).Delete(`/users/{id}/withdrawal-limits`, createAdminDeleteWithdrawalLimitsHandler(handlersData))
+		r.With(requirePermission(auth.PermUsersManage)).Put(`/users/{id}/order-validator`, createAdminSetOrderValidatorHandler(handlersData))
+		r.With(requirePermission(auth.PermUsersManage)).Delete(`/users/{id}/order-validator`, createAdminDeleteOrderValidatorHandler(handlersData))
+	})
 
 }
 
@@ -71,3 +164,10 @@ func writeResponse(w http.ResponseWriter, r *http.Request, resp commonResponse)
 		}
 	}
 }
+
+// writeJSON функция, выводящая ответ в формате JSON с указанным кодом
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
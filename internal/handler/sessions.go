@@ -0,0 +1,154 @@
+// Package handler содержит просмотр и отзыв сессий пользователя
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// sessionTouchInterval периодичность отметки времени последнего запроса сессии
+const sessionTouchInterval = time.Minute
+
+// createGetSessionsHandler создает обработчик получения действующих сессий пользователя
+// с отметкой сессии текущего запроса
+func createGetSessionsHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		sessions, err := data.Store.GetSessions(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "get sessions", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if len(sessions) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		current := getSessionIDFromRequest(r)
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current
+		}
+
+		writeJSON(w, http.StatusOK, sessions)
+	}
+}
+
+// createDeleteSessionHandler создает обработчик отзыва сессии пользователя: access и refresh токены сессии
+// перестают приниматься, при отзыве текущей сессии удаляются cookie токенов
+func createDeleteSessionHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		sessionID := chi.URLParam(r, "id")
+		revoked, err := data.Store.RevokeSession(r.Context(), userID, sessionID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "revoke session", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !revoked {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Сессия отозвана пользователем", "userID", userID, "familyID", sessionID)
+
+		if sessionID == getSessionIDFromRequest(r) {
+			clearTokenCookies(w, data)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// describeDevice краткое описание устройства по user agent в виде "браузер, система" для списка сессий
+func describeDevice(userAgent string) string {
+	// порядок важен: Edge и Opera содержат Chrome, Chrome содержит Safari, Android содержит Linux
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systems := []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+
+	var parts []string
+	for _, browser := range browsers {
+		if strings.Contains(userAgent, browser.token) {
+			parts = append(parts, browser.name)
+			break
+		}
+	}
+	for _, system := range systems {
+		if strings.Contains(userAgent, system.token) {
+			parts = append(parts, system.name)
+			break
+		}
+	}
+
+	if len(parts) == 0 {
+		return "неизвестное устройство"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// truncate обрезка строки до limit символов
+func truncate(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit])
+}
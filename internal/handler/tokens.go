@@ -0,0 +1,277 @@
+// Package handler содержит выдачу access и refresh токенов, их обновление и выход пользователя
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/auth"
+	"github.com/hardvlad/ypdiploma1/internal/config"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// refreshTokenBytes длина случайной части refresh токена в байтах
+const refreshTokenBytes = 32
+
+// TokenResponse структура, описывающая формат выдачи токенов в JSON для клиентов без cookie
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshRequest структура, описывающая формат передачи refresh токена в JSON
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens начинает новую сессию пользователя - семью токенов с устройством, IP-адресом и user agent запроса входа:
+// сохраняет хэш refresh токена и выдает access и refresh токены в cookie, возвращает токены для выдачи в JSON
+func issueTokens(w http.ResponseWriter, r *http.Request, data Handlers, userID int) (*TokenResponse, error) {
+	familyID, err := util.GenerateSecureToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := util.GenerateSecureToken(refreshTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := truncate(r.UserAgent(), 512)
+	session := repository.Session{
+		ID:        familyID,
+		Device:    describeDevice(userAgent),
+		IP:        getClientIP(r),
+		UserAgent: userAgent,
+	}
+
+	err = data.Store.CreateRefreshToken(r.Context(), userID, session, util.HashToken(refreshToken), data.Conf.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return setTokenCookies(r.Context(), w, data, userID, familyID, refreshToken)
+}
+
+// setTokenCookies создает access токен семьи familyID с текущей ролью пользователя
+// и устанавливает cookie access и refresh токенов, возвращает токены для выдачи в JSON
+func setTokenCookies(ctx context.Context, w http.ResponseWriter, data Handlers, userID int, familyID string, refreshToken string) (*TokenResponse, error) {
+	role, err := data.Store.GetUserRole(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := auth.CreateToken(data.Conf.AccessTokenTTL, userID, familyID, role, data.Conf.TokenKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, newCookie(data, data.Conf.CookieName, token, "/", int(data.Conf.AccessTokenTTL.Seconds()), true))
+
+	// refresh токен нужен только методам обновления токенов и выхода
+	http.SetCookie(w, newCookie(data, data.Conf.RefreshCookieName, refreshToken, "/api/user", int(data.Conf.RefreshTokenTTL.Seconds()), true))
+
+	// в режиме double-submit клиент читает значение CSRF cookie и передает его в заголовке X-CSRF-Token
+	if data.Conf.CSRFMode == config.CSRFModeDoubleSubmit {
+		csrfToken, err := util.GenerateSecureToken(16)
+		if err != nil {
+			return nil, err
+		}
+		http.SetCookie(w, newCookie(data, data.Conf.CSRFCookieName, csrfToken, "/", int(data.Conf.RefreshTokenTTL.Seconds()), false))
+	}
+
+	return &TokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(data.Conf.AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// writeTokens выводит выданные токены в JSON, если клиент запросил ответ в application/json,
+// иначе токены передаются только в cookie
+func writeTokens(w http.ResponseWriter, r *http.Request, tokens *TokenResponse) {
+	if acceptsJSON(r) {
+		writeJSON(w, http.StatusOK, tokens)
+		return
+	}
+
+	writeResponse(w, r, commonResponse{
+		isError: false,
+		message: http.StatusText(http.StatusOK),
+		code:    http.StatusOK,
+	})
+}
+
+// acceptsJSON проверяет, запросил ли клиент ответ в формате application/json в заголовке Accept
+func acceptsJSON(r *http.Request) bool {
+	for _, item := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// getRefreshToken получение refresh токена из cookie или из тела запроса в JSON
+func getRefreshToken(r *http.Request, data Handlers) string {
+	if c, err := r.Cookie(data.Conf.RefreshCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	var request RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return ""
+	}
+	return request.RefreshToken
+}
+
+// clearTokenCookies удаляет cookie access и refresh токенов
+func clearTokenCookies(w http.ResponseWriter, data Handlers) {
+	http.SetCookie(w, newCookie(data, data.Conf.CookieName, "", "/", -1, true))
+	http.SetCookie(w, newCookie(data, data.Conf.RefreshCookieName, "", "/api/user", -1, true))
+	if data.Conf.CSRFMode == config.CSRFModeDoubleSubmit {
+		http.SetCookie(w, newCookie(data, data.Conf.CSRFCookieName, "", "/", -1, false))
+	}
+}
+
+// newCookie создание cookie с атрибутами из конфигурации, maxAge < 0 удаляет cookie
+func newCookie(data Handlers, name string, value string, path string, maxAge int, httpOnly bool) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   data.Conf.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   data.Conf.CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: data.Conf.CookieSameSite,
+	}
+	if maxAge > 0 {
+		c.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	}
+	return c
+}
+
+// createRefreshHandler создает обработчик обновления токенов по refresh токену из cookie или тела запроса:
+// refresh токен заменяется новым, повторное использование замененного токена отзывает вход целиком
+func createRefreshHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		currentToken := getRefreshToken(r, data)
+		if currentToken == "" {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusUnauthorized),
+				code:    http.StatusUnauthorized,
+			})
+			return
+		}
+
+		refreshToken, err := util.GenerateSecureToken(refreshTokenBytes)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		userID, familyID, err := data.Store.RotateRefreshToken(r.Context(), util.HashToken(currentToken), util.HashToken(refreshToken), data.Conf.RefreshTokenTTL)
+		if err != nil {
+			switch {
+			case errors.Is(err, repository.ErrRefreshTokenReused):
+				data.Logger.Warnw("Повторное использование refresh токена, вход отозван", "userID", userID, "familyID", familyID)
+				clearTokenCookies(w, data)
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusUnauthorized),
+					code:    http.StatusUnauthorized,
+				})
+			case errors.Is(err, repository.ErrRefreshTokenInvalid):
+				clearTokenCookies(w, data)
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusUnauthorized),
+					code:    http.StatusUnauthorized,
+				})
+			default:
+				data.Logger.Debugw(err.Error(), "event", "rotate refresh token")
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+			}
+			return
+		}
+
+		tokens, err := setTokenCookies(r.Context(), w, data, userID, familyID, refreshToken)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "refresh - create token", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeTokens(w, r, tokens)
+	}
+}
+
+// createLogoutHandler создает обработчик выхода пользователя: отзывает семью токенов
+// по refresh токену или по действующему access токену из cookie или заголовка Authorization и удаляет cookie токенов,
+// выход доступен и с истекшим access токеном
+func createLogoutHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		familyID := ""
+		if refreshToken := getRefreshToken(r, data); refreshToken != "" {
+			revoked, err := data.Store.RevokeRefreshToken(r.Context(), util.HashToken(refreshToken))
+			if err != nil {
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+				return
+			}
+			familyID = revoked
+		}
+
+		if familyID == "" {
+			if token := getAccessToken(r, data.Conf.CookieName); token != "" {
+				if claims, err := auth.ParseToken(token, data.Conf.TokenKeys); err == nil && claims.FamilyID != "" {
+					if err := data.Store.RevokeTokenFamily(r.Context(), claims.FamilyID); err != nil {
+						writeResponse(w, r, commonResponse{
+							isError: true,
+							message: http.StatusText(http.StatusInternalServerError),
+							code:    http.StatusInternalServerError,
+						})
+						return
+					}
+				}
+			}
+		}
+
+		clearTokenCookies(w, data)
+
+		writeResponse(w, r, commonResponse{
+			isError: false,
+			message: http.StatusText(http.StatusOK),
+			code:    http.StatusOK,
+		})
+	}
+}
@@ -0,0 +1,501 @@
+// Package handler содержит подключение двухфакторной аутентификации по TOTP, коды восстановления
+// и второй шаг входа
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/totp"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+const (
+	// recoveryCodesCount количество кодов восстановления, выдаваемых при подключении TOTP
+	recoveryCodesCount = 10
+	// loginChallengeTTL время на ввод второго фактора после проверки пароля
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts количество попыток ввода второго фактора для одного входа
+	loginChallengeAttempts = 5
+)
+
+// TOTPEnrollResponse структура, описывающая формат ответа на начало подключения TOTP
+type TOTPEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// SecondFactorRequest структура, описывающая формат передачи второго фактора: кода TOTP или кода восстановления
+type SecondFactorRequest struct {
+	MFAToken     string `json:"mfa_token,omitempty"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// RecoveryCodesResponse структура, описывающая формат выдачи кодов восстановления
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFARequiredResponse структура, описывающая формат ответа на вход, требующий второго фактора
+type MFARequiredResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// createTOTPEnrollHandler создает обработчик начала подключения TOTP: создает секрет
+// и выводит его вместе с адресом otpauth:// для приложения-аутентификатора
+func createTOTPEnrollHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		login, _, err := data.Store.GetUserLoginPasswordHash(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "totp enroll - get login", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		err = data.Store.SaveTOTPSecret(r.Context(), userID, secret)
+		if err != nil {
+			if errors.Is(err, repository.ErrTOTPEnabled) {
+				writeJSON(w, http.StatusConflict, errorResponse{Error: "totp_enabled", Message: err.Error()})
+				return
+			}
+			data.Logger.Debugw(err.Error(), "event", "totp enroll - save secret", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, TOTPEnrollResponse{
+			Secret:          secret,
+			ProvisioningURI: totp.ProvisioningURI(data.Conf.TOTPIssuer, login, secret),
+		})
+	}
+}
+
+// createTOTPConfirmHandler создает обработчик подтверждения подключения TOTP кодом из приложения:
+// двухфакторная аутентификация включается, коды восстановления выводятся один раз
+func createTOTPConfirmHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request SecondFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		state, err := data.Store.GetTOTP(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "totp confirm - get secret", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if state == nil || state.Enabled {
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "totp_not_pending", Message: "нет неподтвержденного подключения TOTP"})
+			return
+		}
+
+		step, ok := totp.Validate(state.Secret, request.Code, time.Now())
+		if !ok {
+			writeJSON(w, http.StatusUnprocessableEntity, errorResponse{Error: "invalid_totp_code", Message: "неверный код"})
+			return
+		}
+
+		codes, hashes, err := generateRecoveryCodes()
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		err = data.Store.EnableTOTP(r.Context(), userID, step, hashes)
+		if err != nil {
+			if errors.Is(err, repository.ErrTOTPEnabled) {
+				writeJSON(w, http.StatusConflict, errorResponse{Error: "totp_enabled", Message: err.Error()})
+				return
+			}
+			data.Logger.Debugw(err.Error(), "event", "totp confirm - enable", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data.Logger.Infow("Подключена двухфакторная аутентификация", "userID", userID)
+
+		writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// createTOTPDisableHandler создает обработчик отключения двухфакторной аутентификации
+// по коду TOTP или коду восстановления
+func createTOTPDisableHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request SecondFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.Code == "" && request.RecoveryCode == "") {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		if !checkSecondFactorLockout(w, r, data, userID) {
+			return
+		}
+
+		verified, err := verifySecondFactor(r.Context(), data, userID, request)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "totp disable - verify", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		recordSecondFactorResult(r, data, userID, verified)
+		if !verified {
+			writeJSON(w, http.StatusForbidden, errorResponse{Error: "invalid_second_factor", Message: "неверный код"})
+			return
+		}
+
+		err = data.Store.DisableTOTP(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "totp disable", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data.Logger.Infow("Отключена двухфакторная аутентификация", "userID", userID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// createLoginSecondFactorHandler создает обработчик второго шага входа: по токену входа из первого шага
+// и коду TOTP или коду восстановления выдает токены, число попыток для одного входа ограничено
+func createLoginSecondFactorHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var request SecondFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.MFAToken == "" || (request.Code == "" && request.RecoveryCode == "") {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		challengeHash := util.HashToken(request.MFAToken)
+		userID, err := data.Store.CheckLoginChallenge(r.Context(), challengeHash, loginChallengeAttempts)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "login 2fa - check challenge")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if userID == 0 {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "mfa_token_invalid", Message: "вход истек или попытки исчерпаны, войдите заново"})
+			return
+		}
+
+		if !checkSecondFactorLockout(w, r, data, userID) {
+			return
+		}
+
+		verified, err := verifySecondFactor(r.Context(), data, userID, request)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "login 2fa - verify", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		recordSecondFactorResult(r, data, userID, verified)
+		if !verified {
+			data.Logger.Warnw("Неверный второй фактор при входе", "userID", userID, "ip", getClientIP(r))
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid_second_factor", Message: "неверный код"})
+			return
+		}
+
+		if err := data.Store.DeleteLoginChallenge(r.Context(), challengeHash); err != nil {
+			data.Logger.Errorw(err.Error(), "event", "login 2fa - delete challenge", "userID", userID)
+		}
+
+		// создание семьи токенов и выдача access и refresh токенов
+		tokens, err := issueTokens(w, r, data, userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "login 2fa - issue tokens", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeTokens(w, r, tokens)
+	}
+}
+
+// completeLogin завершение первого шага входа: пользователю без двухфакторной аутентификации выдаются токены,
+// пользователю с TOTP - токен входа для второго шага со StatusAccepted
+func completeLogin(w http.ResponseWriter, r *http.Request, data Handlers, userID int) error {
+	state, err := data.Store.GetTOTP(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	if state == nil || !state.Enabled {
+		// создание семьи токенов и выдача access и refresh токенов
+		tokens, err := issueTokens(w, r, data, userID)
+		if err != nil {
+			return err
+		}
+
+		// токены выдаются в cookie и, по запросу клиента, в JSON
+		writeTokens(w, r, tokens)
+		return nil
+	}
+
+	mfaToken, err := util.GenerateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = data.Store.CreateLoginChallenge(r.Context(), userID, util.HashToken(mfaToken), loginChallengeTTL)
+	if err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusAccepted, MFARequiredResponse{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+		ExpiresIn:   int(loginChallengeTTL.Seconds()),
+	})
+	return nil
+}
+
+// verifySecondFactor проверка кода TOTP с защитой от повторного использования или кода восстановления,
+// пользователь без подключенной двухфакторной аутентификации проверку не проходит
+func verifySecondFactor(ctx context.Context, data Handlers, userID int, request SecondFactorRequest) (bool, error) {
+	state, err := data.Store.GetTOTP(ctx, userID)
+	if err != nil || state == nil || !state.Enabled {
+		return false, err
+	}
+
+	if request.Code != "" {
+		return useTOTPCode(ctx, data, userID, state, request.Code)
+	}
+
+	return data.Store.UseRecoveryCode(ctx, userID, util.HashToken(normalizeRecoveryCode(request.RecoveryCode)))
+}
+
+// useTOTPCode проверка кода TOTP, код принимается один раз: шаг времени кода должен быть позже последнего принятого
+func useTOTPCode(ctx context.Context, data Handlers, userID int, state *repository.TOTPState, code string) (bool, error) {
+	step, ok := totp.Validate(state.Secret, code, time.Now())
+	if !ok || step <= state.LastStep {
+		return false, nil
+	}
+	return data.Store.UseTOTPStep(ctx, userID, step)
+}
+
+// checkWithdrawTOTP проверка свежего кода TOTP для списания больше порога у пользователя
+// с двухфакторной аутентификацией, при отказе выводит StatusForbidden, после нескольких неверных кодов -
+// StatusTooManyRequests, и возвращает false
+func checkWithdrawTOTP(w http.ResponseWriter, r *http.Request, data Handlers, userID int, sum float64, code string) bool {
+	if sum <= data.Conf.TOTPWithdrawAbove {
+		return true
+	}
+
+	state, err := data.Store.GetTOTP(r.Context(), userID)
+	if err != nil {
+		data.Logger.Debugw(err.Error(), "event", "withdraw - get totp", "userID", userID)
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusInternalServerError),
+			code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+	if state == nil || !state.Enabled {
+		return true
+	}
+
+	if code == "" {
+		code = r.Header.Get("X-TOTP-Code")
+	}
+	if code == "" {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: "totp_required", Message: "для списания этой суммы нужен код TOTP"})
+		return false
+	}
+
+	if !checkSecondFactorLockout(w, r, data, userID) {
+		return false
+	}
+
+	ok, err := useTOTPCode(r.Context(), data, userID, state, code)
+	if err != nil {
+		data.Logger.Debugw(err.Error(), "event", "withdraw - use totp", "userID", userID)
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusInternalServerError),
+			code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+	recordSecondFactorResult(r, data, userID, ok)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: "invalid_totp_code", Message: "неверный или уже использованный код TOTP"})
+		return false
+	}
+	return true
+}
+
+// checkSecondFactorLockout проверка блокировки проверок второго фактора пользователя до проверки кода,
+// чтобы перебор кодов TOTP и кодов восстановления прекращался после нескольких неудач,
+// при блокировке выводит StatusTooManyRequests и возвращает false
+func checkSecondFactorLockout(w http.ResponseWriter, r *http.Request, data Handlers, userID int) bool {
+	lockout, err := data.Store.CheckSecondFactorLockout(r.Context(), userID)
+	if err != nil {
+		data.Logger.Debugw(err.Error(), "event", "second factor - check lockout", "userID", userID)
+		writeResponse(w, r, commonResponse{
+			isError: true,
+			message: http.StatusText(http.StatusInternalServerError),
+			code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+	if lockout > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(lockout.Seconds())), 1)))
+		writeJSON(w, http.StatusTooManyRequests, errorResponse{Error: "second_factor_locked", Message: "слишком много неверных кодов, повторите позже"})
+		return false
+	}
+	return true
+}
+
+// recordSecondFactorResult учет результата проверки второго фактора: неудача увеличивает счетчик пользователя
+// и при превышении порога блокирует проверки, успех сбрасывает счетчик, ошибка записи не влияет на ответ пользователю
+func recordSecondFactorResult(r *http.Request, data Handlers, userID int, verified bool) {
+	if verified {
+		if err := data.Store.ResetSecondFactorFailures(r.Context(), userID); err != nil {
+			data.Logger.Errorw(err.Error(), "event", "сброс неудачных проверок второго фактора", "userID", userID)
+		}
+		return
+	}
+
+	lockout, err := data.Store.RecordSecondFactorFailure(r.Context(), userID, data.Conf.SecondFactorLockout)
+	if err != nil {
+		data.Logger.Errorw(err.Error(), "event", "запись неудачной проверки второго фактора", "userID", userID)
+		return
+	}
+	if lockout > 0 {
+		data.Logger.Warnw("Проверки второго фактора заблокированы после неверных кодов", "userID", userID, "ip", getClientIP(r), "lockout", lockout)
+	}
+}
+
+// generateRecoveryCodes создание кодов восстановления в формате xxxxx-xxxxx и их хэшей для хранения
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	hashes := make([]string, 0, recoveryCodesCount)
+	for range recoveryCodesCount {
+		token, err := util.GenerateSecureToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := token[:5] + "-" + token[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, util.HashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode приведение кода восстановления к виду без дефисов, пробелов и регистра
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,132 @@
+// Package handler содержит административные методы управления схемой проверки номеров заказов пользователя-партнера
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/validator"
+)
+
+// maxOrderValidatorLength максимальная длина описания схемы проверки номеров заказов
+const maxOrderValidatorLength = 255
+
+// OrderValidatorRequest структура, описывающая формат запроса на установку схемы проверки номеров заказов:
+// luhn, damm, verhoeff или regex:<выражение>
+type OrderValidatorRequest struct {
+	Validator string `json:"validator"`
+}
+
+// createAdminSetOrderValidatorHandler создает обработчик установки персональной схемы проверки номеров заказов
+// пользователя-партнера, схема проверяется до сохранения
+func createAdminSetOrderValidatorHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		var request OrderValidatorRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		spec := strings.TrimSpace(request.Validator)
+		if spec == "" || len(spec) > maxOrderValidatorLength {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "нужно указать схему validator: luhn, damm, verhoeff или regex:<выражение>",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		if _, err := validator.Parse(spec); err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: err.Error(),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		found, err := data.Store.SetUserOrderValidator(r.Context(), userID, spec)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "set order validator", "userID", userID, "spec", spec)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !found {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Схема проверки номеров заказов пользователя изменена", "userID", userID, "spec", spec)
+
+		writeJSON(w, http.StatusOK, OrderValidatorRequest{Validator: spec})
+	}
+}
+
+// createAdminDeleteOrderValidatorHandler создает обработчик удаления персональной схемы проверки номеров заказов,
+// после удаления действует схема из конфигурации
+func createAdminDeleteOrderValidatorHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		found, err := data.Store.SetUserOrderValidator(r.Context(), userID, "")
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "delete order validator", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !found {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Схема проверки номеров заказов пользователя удалена", "userID", userID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,535 @@
+// Package handler содержит регистрацию ключей доступа WebAuthn (passkeys) и вход по ним без пароля
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+	"github.com/hardvlad/ypdiploma1/internal/webauthn"
+)
+
+// webAuthnMaxCredentials количество ключей доступа, которое может зарегистрировать пользователь
+const webAuthnMaxCredentials = 10
+
+// WebAuthnRegisterRequest структура, описывающая формат завершения регистрации ключа доступа:
+// название ключа и ответ браузера navigator.credentials.create
+type WebAuthnRegisterRequest struct {
+	Name string `json:"name"`
+	webauthn.RegistrationResponse
+}
+
+// WebAuthnLoginBeginRequest структура, описывающая формат начала входа по ключу доступа,
+// без логина вход выполняется ключом, хранящим пользователя на аутентификаторе
+type WebAuthnLoginBeginRequest struct {
+	Login string `json:"login"`
+}
+
+// createWebAuthnRegisterBeginHandler создает обработчик начала регистрации ключа доступа:
+// сохраняет вызов и выводит параметры для navigator.credentials.create
+func createWebAuthnRegisterBeginHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if data.Conf.WebAuthn == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		login, _, err := data.Store.GetUserLoginPasswordHash(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn register - get login", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// уже зарегистрированные ключи исключаются, чтобы аутентификатор не создал второй ключ
+		credentials, err := data.Store.GetWebAuthnCredentials(r.Context(), userID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn register - get credentials", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if len(credentials) >= webAuthnMaxCredentials {
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "credentials_limit", Message: "зарегистрировано максимальное количество ключей доступа"})
+			return
+		}
+
+		challenge, err := webauthn.NewChallenge()
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		err = data.Store.SaveWebAuthnChallenge(
+			r.Context(),
+			util.HashToken(challenge),
+			repository.WebAuthnChallenge{Ceremony: repository.WebAuthnRegistration, UserID: userID},
+			webauthn.Timeout,
+		)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn register - save challenge", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, data.Conf.WebAuthn.NewRegistrationOptions(challenge, webAuthnUserHandle(userID), login, credentialIDs(credentials)))
+	}
+}
+
+// createWebAuthnRegisterFinishHandler создает обработчик завершения регистрации ключа доступа:
+// проверяет ответ аутентификатора на вызов, выданный этому пользователю, и сохраняет ключ
+func createWebAuthnRegisterFinishHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if data.Conf.WebAuthn == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request WebAuthnRegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			request.Name = "passkey"
+		}
+		if len([]rune(request.Name)) > 100 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		challenge, err := webauthn.Challenge(request.Response.ClientDataJSON)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid_credential", Message: err.Error()})
+			return
+		}
+
+		// вызов используется один раз и только пользователем, начавшим регистрацию
+		started, err := data.Store.TakeWebAuthnChallenge(r.Context(), util.HashToken(challenge), repository.WebAuthnRegistration)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn register - take challenge", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if started == nil || started.UserID != userID {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "challenge_invalid", Message: "регистрация истекла или не начата, начните заново"})
+			return
+		}
+
+		credential, err := data.Conf.WebAuthn.VerifyRegistration(challenge, request.RegistrationResponse)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid_credential", Message: err.Error()})
+			return
+		}
+
+		saved, err := data.Store.CreateWebAuthnCredential(r.Context(), repository.WebAuthnCredential{
+			UserID:       userID,
+			CredentialID: base64.RawURLEncoding.EncodeToString(credential.ID),
+			PublicKey:    credential.PublicKey,
+			SignCount:    credential.SignCount,
+			Name:         request.Name,
+		})
+		if err != nil {
+			if errors.Is(err, repository.ErrCredentialExists) {
+				writeJSON(w, http.StatusConflict, errorResponse{Error: "credential_exists", Message: err.Error()})
+				return
+			}
+			data.Logger.Debugw(err.Error(), "event", "webauthn register - save credential", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data.Logger.Infow("Зарегистрирован ключ доступа", "userID", userID, "credentialID", saved.ID)
+
+		writeJSON(w, http.StatusCreated, saved)
+	}
+}
+
+// createWebAuthnLoginBeginHandler создает обработчик начала входа по ключу доступа: сохраняет вызов
+// и выводит параметры для navigator.credentials.get, по логину выводятся ключи пользователя,
+// для неизвестного логина ответ не отличается от входа без логина
+func createWebAuthnLoginBeginHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if data.Conf.WebAuthn == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		// тело запроса необязательно
+		var request WebAuthnLoginBeginRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var userID int
+		var credentials []repository.WebAuthnCredential
+		if request.Login != "" {
+			var err error
+			userID, _, err = data.Store.GetUserIDPasswordHashByLogin(r.Context(), request.Login)
+			if err == nil && userID > 0 {
+				credentials, err = data.Store.GetWebAuthnCredentials(r.Context(), userID)
+			}
+			if err != nil {
+				data.Logger.Debugw(err.Error(), "event", "webauthn login - get credentials", "login", request.Login)
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+				return
+			}
+		}
+
+		challenge, err := webauthn.NewChallenge()
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		err = data.Store.SaveWebAuthnChallenge(
+			r.Context(),
+			util.HashToken(challenge),
+			repository.WebAuthnChallenge{Ceremony: repository.WebAuthnLogin, UserID: userID},
+			webauthn.Timeout,
+		)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn login - save challenge")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, data.Conf.WebAuthn.NewLoginOptions(challenge, credentialIDs(credentials)))
+	}
+}
+
+// createWebAuthnLoginFinishHandler создает обработчик завершения входа по ключу доступа: проверяет подпись вызова
+// и рост счетчика подписей, выдает токены, если аутентификатор проверил пользователя,
+// иначе ключ считается одним фактором и при подключенном TOTP требуется второй шаг входа
+func createWebAuthnLoginFinishHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if data.Conf.WebAuthn == nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		var response webauthn.LoginResponse
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		challenge, err := webauthn.Challenge(response.Response.ClientDataJSON)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid_assertion", Message: err.Error()})
+			return
+		}
+
+		started, err := data.Store.TakeWebAuthnChallenge(r.Context(), util.HashToken(challenge), repository.WebAuthnLogin)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn login - take challenge")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if started == nil {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "challenge_invalid", Message: "вход истек или не начат, начните заново"})
+			return
+		}
+
+		// идентификатор ключа приводится к каноническому base64url, в котором он сохранен
+		rawID, err := base64.RawURLEncoding.DecodeString(response.RawID)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid_assertion", Message: err.Error()})
+			return
+		}
+
+		stored, err := data.Store.GetWebAuthnCredential(r.Context(), base64.RawURLEncoding.EncodeToString(rawID))
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn login - get credential")
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		// ключ должен быть зарегистрирован и, если вход начат по логину, принадлежать этому пользователю
+		if stored == nil || (started.UserID != 0 && started.UserID != stored.UserID) {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unknown_credential", Message: "ключ доступа не зарегистрирован"})
+			return
+		}
+
+		assertion, err := data.Conf.WebAuthn.VerifyLogin(challenge, webauthn.Credential{
+			ID:        rawID,
+			PublicKey: stored.PublicKey,
+			SignCount: stored.SignCount,
+		}, response)
+		if errors.Is(err, webauthn.ErrSignCount) {
+			data.Logger.Warnw("Счетчик подписей ключа доступа не увеличился, возможна копия ключа", "userID", stored.UserID, "credentialID", stored.ID, "ip", getClientIP(r))
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "sign_count_invalid", Message: err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid_assertion", Message: err.Error()})
+			return
+		}
+
+		// ключ, хранящий пользователя на аутентификаторе, должен хранить владельца ключа
+		if len(assertion.UserHandle) > 0 && !bytes.Equal(assertion.UserHandle, webAuthnUserHandle(stored.UserID)) {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid_assertion", Message: "ключ доступа принадлежит другому пользователю"})
+			return
+		}
+
+		// счетчик сохраняется условно, параллельный вход копией ключа с тем же счетчиком отклоняется
+		updated, err := data.Store.UpdateWebAuthnSignCount(r.Context(), stored.ID, assertion.SignCount)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn login - update sign count", "userID", stored.UserID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if !updated {
+			data.Logger.Warnw("Счетчик подписей ключа доступа не увеличился, возможна копия ключа", "userID", stored.UserID, "credentialID", stored.ID, "ip", getClientIP(r))
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "sign_count_invalid", Message: webauthn.ErrSignCount.Error()})
+			return
+		}
+
+		if !assertion.UserVerified {
+			// выдача токенов или, при подключенной двухфакторной аутентификации, переход ко второму шагу входа
+			if err := completeLogin(w, r, data, stored.UserID); err != nil {
+				data.Logger.Debugw(err.Error(), "event", "webauthn login - complete", "userID", stored.UserID)
+				writeResponse(w, r, commonResponse{
+					isError: true,
+					message: http.StatusText(http.StatusInternalServerError),
+					code:    http.StatusInternalServerError,
+				})
+			}
+			return
+		}
+
+		// ключ с проверкой пользователя (PIN или биометрия) - двухфакторный вход, второй шаг не нужен
+		tokens, err := issueTokens(w, r, data, stored.UserID)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "webauthn login - issue tokens", "userID", stored.UserID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeTokens(w, r, tokens)
+	}
+}
+
+// createGetWebAuthnCredentialsHandler создает обработчик получения ключей доступа пользователя
+func createGetWebAuthnCredentialsHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		credentials, err := data.Store.GetWebAuthnCredentials(r.Context(), userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if len(credentials) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, credentials)
+	}
+}
+
+// createDeleteWebAuthnCredentialHandler создает обработчик удаления ключа доступа пользователя
+func createDeleteWebAuthnCredentialHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		credentialID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		deleted, err := data.Store.DeleteWebAuthnCredential(r.Context(), userID, credentialID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !deleted {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		data.Logger.Infow("Удален ключ доступа", "userID", userID, "credentialID", credentialID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// webAuthnUserHandle идентификатор пользователя, сохраняемый аутентификатором вместе с ключом
+func webAuthnUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// credentialIDs идентификаторы ключей аутентификатора для параметров церемоний
+func credentialIDs(credentials []repository.WebAuthnCredential) [][]byte {
+	ids := make([][]byte, 0, len(credentials))
+	for _, credential := range credentials {
+		id, err := base64.RawURLEncoding.DecodeString(credential.CredentialID)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,530 @@
+// Package handler содержит методы управления вебхуками пользователя и воркер их доставки
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// webhookEventTypes типы событий, на которые можно подписать вебхук
+var webhookEventTypes = []string{repository.UserEventOrderStatus, repository.UserEventAccrual, repository.UserEventWithdrawal}
+
+// параметры воркера доставки вебхуков
+const (
+	webhookPollInterval = time.Second
+	webhookBatchSize    = 20
+	webhookRetryBase    = 10 * time.Second
+	webhookRetryMax     = time.Hour
+	webhookDeliveryList = 50
+)
+
+// CreateWebhookRequest структура, описывающая формат запроса на регистрацию вебхука
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// webhookBody структура, описывающая тело запроса доставки вебхука
+type webhookBody struct {
+	ID        int             `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// createPostWebhookHandler создает обработчик регистрации вебхука,
+// секрет для проверки подписи доставок выдается в ответе только один раз
+func createPostWebhookHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		var request CreateWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// адрес вебхука должен быть абсолютным HTTP(S) адресом
+		target, err := url.Parse(request.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "url должен быть абсолютным http или https адресом",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		// адрес вебхука не должен вести во внутреннюю сеть сервиса, при доставке адрес проверяется повторно
+		if err := checkWebhookHost(r.Context(), target.Hostname()); err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: err.Error(),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		if len(request.Events) == 0 || slices.ContainsFunc(request.Events, func(event string) bool {
+			return !slices.Contains(webhookEventTypes, event)
+		}) {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: "events должен содержать типы событий order_status, accrual или withdrawal",
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		secret, err := util.GenerateSecureToken(32)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		slices.Sort(request.Events)
+		webhook, err := data.Store.CreateWebhook(r.Context(), userID, request.URL, secret, slices.Compact(request.Events))
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "create webhook", "userID", userID)
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, webhook)
+	}
+}
+
+// createGetWebhooksHandler создает обработчик получения списка вебхуков пользователя
+func createGetWebhooksHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		webhooks, err := data.Store.GetWebhooks(r.Context(), userID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if len(webhooks) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, webhooks)
+	}
+}
+
+// createDeleteWebhookHandler создает обработчик удаления вебхука пользователя
+func createDeleteWebhookHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		deleted, err := data.Store.DeleteWebhook(r.Context(), userID, webhookID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !deleted {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// createGetWebhookDeliveriesHandler создает обработчик получения журнала доставок вебхука
+func createGetWebhookDeliveriesHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		deliveries, found, err := data.Store.GetWebhookDeliveries(r.Context(), userID, webhookID, webhookDeliveryList)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if !found {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		if len(deliveries) == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNoContent),
+				code:    http.StatusNoContent,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, deliveries)
+	}
+}
+
+// createRedeliverWebhookHandler создает обработчик ручной повторной доставки вебхука,
+// повторная доставка создается как новая запись журнала со ссылкой на исходную
+func createRedeliverWebhookHandler(data Handlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// получаем userID из контекста
+		userID, ok := getUserIDFromRequest(r)
+		if !ok {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusBadRequest),
+				code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		deliveryID, err := strconv.Atoi(chi.URLParam(r, "deliveryID"))
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		newID, err := data.Store.RedeliverWebhookDelivery(r.Context(), userID, webhookID, deliveryID)
+		if err != nil {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusInternalServerError),
+				code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		if newID == 0 {
+			writeResponse(w, r, commonResponse{
+				isError: true,
+				message: http.StatusText(http.StatusNotFound),
+				code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, map[string]int{"id": newID})
+	}
+}
+
+// CreateWebhookWorker запуск воркера доставки вебхуков из очереди в базе данных,
+// очередь разбирается конкурентно всеми экземплярами сервиса
+func CreateWebhookWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		client := newWebhookClient(data.Conf.WebhookTimeout)
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := deliverWebhooks(ctx, data, client)
+				if err != nil {
+					data.Logger.Errorw("webhookWorker: deliverWebhooks error", "error", err)
+				}
+			case <-ctx.Done():
+				data.Logger.Infow("webhookWorker: shutting down")
+				return
+			}
+		}
+	}()
+}
+
+// errWebhookAddress адрес вебхука ведет во внутреннюю сеть
+var errWebhookAddress = errors.New("url вебхука не должен указывать на локальный или внутренний адрес")
+
+// webhookBlockedPrefixes специальные диапазоны адресов, которые не распознаются проверками netip,
+// но не являются публичными: разделяемые адреса операторов (CGNAT), служебные, документационные,
+// тестовые и зарезервированные сети, а также IPv6 диапазоны со встроенным IPv4 адресом (NAT64, 6to4, Teredo)
+var webhookBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fec0::/10"),
+}
+
+// webhookAddressAllowed проверка, что IP-адрес доставки вебхука не является loopback, частным,
+// link-local, multicast, неуказанным адресом или адресом из webhookBlockedPrefixes
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range webhookBlockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost проверка хоста вебхука при регистрации: IP-адрес или все адреса,
+// в которые разрешается имя, должны быть допустимы для доставки
+func checkWebhookHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !webhookAddressAllowed(addr) {
+			return errWebhookAddress
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("не удалось разрешить хост вебхука %s", host)
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+// webhookDialControl проверка адреса непосредственно перед подключением при доставке вебхука,
+// уже после разрешения имени, поэтому смена DNS записи после регистрации не открывает доступ во внутреннюю сеть
+func webhookDialControl(_ string, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !webhookAddressAllowed(addrPort.Addr()) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// newWebhookClient создание HTTP клиента доставки вебхуков: подключение только к допустимым адресам,
+// без прокси и без перехода по перенаправлениям - ответ с перенаправлением считается неуспешной доставкой
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: webhookDialControl}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliverWebhooks функция одного прохода доставки вебхуков
+func deliverWebhooks(ctx context.Context, data Handlers, client *http.Client) error {
+	// доставка не выдается другим экземплярам, пока этот экземпляр пытается ее отправить,
+	// доставки пачки отправляются последовательно, поэтому аренда покрывает таймауты всей пачки
+	lease := webhookBatchSize*data.Conf.WebhookTimeout + time.Minute
+	deliveries, err := data.Store.ClaimWebhookDeliveries(ctx, webhookBatchSize, lease)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		statusCode, err := sendWebhook(ctx, client, delivery)
+
+		delivered := err == nil && statusCode >= 200 && statusCode < 300
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+
+		var retryAfter time.Duration
+		if !delivered && delivery.Attempts+1 < data.Conf.WebhookMaxAttempts {
+			retryAfter = min(webhookRetryBase<<delivery.Attempts, webhookRetryMax)
+		}
+
+		err = data.Store.SetWebhookDeliveryResult(ctx, delivery.ID, delivered, statusCode, errText, retryAfter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendWebhook функция отправки доставки вебхука, тело подписывается HMAC-SHA256 с секретом вебхука,
+// подпись вычисляется от строки "<timestamp>.<тело>" и передается в заголовке X-Gophermart-Signature
+func sendWebhook(ctx context.Context, client *http.Client, delivery repository.PendingDelivery) (int, error) {
+	body, err := json.Marshal(webhookBody{
+		ID:        delivery.ID,
+		Type:      delivery.EventType,
+		CreatedAt: delivery.CreatedAt,
+		Data:      delivery.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(delivery.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gophermart-Event", delivery.EventType)
+	request.Header.Set("X-Gophermart-Delivery", strconv.Itoa(delivery.ID))
+	request.Header.Set("X-Gophermart-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("неуспешный статус ответа: %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
@@ -1,13 +1,16 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
+	"github.com/hardvlad/ypdiploma1/internal/repository"
 	"github.com/hardvlad/ypdiploma1/internal/retry"
 )
 
@@ -36,9 +39,19 @@ func accrualsWorker(ctx context.Context, id int, data Handlers, ch chan string,
 	}
 }
 
-// processOrderAccruals функция получения статуса заказа и начислений бонусов из внешнего сервиса
+// processOrderAccruals функция однократного запроса статуса заказа и начислений бонусов во внешнем сервисе,
+// если расчет не окончен или регистрация заказа не удалась, следующую попытку выполнит воркер очереди опроса
+// после next_poll_at
 func processOrderAccruals(ctx context.Context, data Handlers, number string) error {
 	checkAndPause()
+
+	// заказ, загруженный с товарами, сначала регистрируется в системе начислений,
+	// незарегистрированный заказ остается в очереди опроса со статусом NEW
+	err := registerOrderGoods(ctx, data, number)
+	if err != nil {
+		return err
+	}
+
 	_ = data.Store.SetOrderStatusAccrual(ctx, number, "PROCESSING", 0)
 
 	accrualURL, err := url.JoinPath(data.Conf.AccrualAddress, "/api/orders/", number)
@@ -46,54 +59,160 @@ func processOrderAccruals(ctx context.Context, data Handlers, number string) err
 		return err
 	}
 
-	status, accrual, err := fetchOrderAccruals(data, accrualURL)
-	if err != nil {
+	status, accrual, done, err := fetchOrderAccruals(ctx, data, number, accrualURL)
+	if err != nil || !done {
 		return err
 	}
 
 	return data.Store.SetOrderStatusAccrual(ctx, number, status, accrual)
 }
 
-// fetchOrderAccruals функция, в которой происходит обращение к внешнему сервису начислений
-// и ожидающая окончание начислений, периодически запрашивая внешний сервис
-func fetchOrderAccruals(data Handlers, url string) (string, float64, error) {
-	var status string
-	var accrual float64
+// accrualRegisterRequest структура, описывающая формат запроса регистрации заказа в системе начислений
+type accrualRegisterRequest struct {
+	Order string                 `json:"order"`
+	Goods []repository.OrderGood `json:"goods"`
+}
+
+// registerOrderGoods функция регистрации заказа с товарами в системе начислений,
+// заказ, уже известный системе начислений, считается зарегистрированным
+func registerOrderGoods(ctx context.Context, data Handlers, number string) error {
+	goods, err := data.Store.GetUnregisteredOrderGoods(ctx, number)
+	if err != nil || len(goods) == 0 {
+		return err
+	}
+
+	body, err := json.Marshal(accrualRegisterRequest{Order: number, Goods: goods})
+	if err != nil {
+		return err
+	}
+
+	registerURL, err := url.JoinPath(data.Conf.AccrualAddress, "/api/orders")
+	if err != nil {
+		return err
+	}
 
 	for {
-		data.Logger.Infow("Getting accruals", "url", url)
-		response, err := retry.Retry(3, 2, func() (*http.Response, error) { return http.Get(url) })
+		response, err := retry.Retry(3, 2, func() (*http.Response, error) {
+			return http.Post(registerURL, "application/json", bytes.NewReader(body))
+		})
 		if err != nil {
-			data.Logger.Debugw(err.Error(), "event", "fetchOrderAccruals - http.Get error", "url", url)
-			return "", 0, err
+			data.Logger.Debugw(err.Error(), "event", "registerOrderGoods - http.Post error", "url", registerURL)
+			return err
 		}
-		defer response.Body.Close()
+		response.Body.Close()
 
-		if response.StatusCode == http.StatusTooManyRequests {
+		switch response.StatusCode {
+		case http.StatusAccepted, http.StatusOK, http.StatusConflict:
+			return data.Store.SetOrderRegistered(ctx, number)
+		case http.StatusTooManyRequests:
 			handle429(response, data)
-			continue
+			checkAndPause()
+		default:
+			return fmt.Errorf("регистрация заказа в системе начислений: статус ответа %d", response.StatusCode)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+	}
+}
+
+// fetchOrderAccruals функция однократного обращения к внешнему сервису начислений,
+// время запроса и следующего запроса сохраняется в заказе до обращения, чтобы заказ
+// был запрошен повторно и при ошибке, возвращает признак того, что опрос заказа окончен:
+// расчет завершен или заказ не известен системе начислений
+func fetchOrderAccruals(ctx context.Context, data Handlers, number string, url string) (string, float64, bool, error) {
+	err := data.Store.SetOrderPolled(ctx, number, data.Conf.AccrualPollInterval)
+	if err != nil {
+		data.Logger.Debugw(err.Error(), "event", "fetchOrderAccruals - set order polled", "orderNumber", number)
+	}
+
+	data.Logger.Infow("Getting accruals", "url", url)
+	response, err := retry.Retry(3, 2, func() (*http.Response, error) { return http.Get(url) })
+	if err != nil {
+		data.Logger.Debugw(err.Error(), "event", "fetchOrderAccruals - http.Get error", "url", url)
+		return "", 0, false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests:
+		handle429(response, data)
+
+	case http.StatusNoContent:
+		return "NEW", 0, true, nil
 
-		if response.StatusCode == http.StatusNoContent {
-			status = "NEW"
-			accrual = 0
+	case http.StatusOK:
+		var resp AccrualResponse
+		if err := json.NewDecoder(response.Body).Decode(&resp); err != nil {
+			data.Logger.Debugw(err.Error(), "event", "fetchOrderAccruals - decode response", "orderNumber", number)
 			break
 		}
 
-		if response.StatusCode == http.StatusOK {
-			var resp AccrualResponse
-			dec := json.NewDecoder(response.Body)
-			if err := dec.Decode(&resp); err != nil {
-				time.Sleep(time.Millisecond * 100)
-				continue
-			}
+		if resp.Status == "INVALID" || resp.Status == "PROCESSED" {
+			return resp.Status, resp.Accrual, true, nil
+		}
+	}
+
+	// расчет не окончен - заказ будет запрошен повторно из очереди опроса
+	return "", 0, false, nil
+}
+
+// orderPollBatchSize количество заказов, забираемых из очереди опроса за один проход
+const orderPollBatchSize = 100
 
-			if resp.Status == "INVALID" || resp.Status == "PROCESSED" {
-				accrual = resp.Accrual
-				status = resp.Status
-				break
+// orderPollLease время, на которое заказ из очереди опроса закрепляется за воркером
+const orderPollLease = time.Minute
+
+// CreateOrderPollWorker запуск воркера очереди опроса системы начислений: заказов из пакетной загрузки,
+// заказов, первый запрос или регистрация которых не удались, и заказов, расчет которых не окончен при первом запросе
+func CreateOrderPollWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go orderPollWorker(ctx, data, wg)
+}
+
+// orderPollWorker воркер, периодически запрашивающий начисления по заказам, время следующего запроса которых наступило
+func orderPollWorker(ctx context.Context, data Handlers, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval := data.Conf.AccrualPollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := pollOrders(ctx, data)
+			if err != nil {
+				data.Logger.Errorw("orderPollWorker: pollOrders error", "error", err)
 			}
+		case <-ctx.Done():
+			data.Logger.Infow("orderPollWorker: shutting down")
+			return
 		}
 	}
-	return status, accrual, nil
+}
+
+// pollOrders функция одного прохода очереди опроса
+func pollOrders(ctx context.Context, data Handlers) error {
+	numbers, err := data.Store.ClaimOrdersForPoll(ctx, orderPollBatchSize, orderPollLease)
+	if err != nil {
+		return err
+	}
+
+	for _, number := range numbers {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		err := processOrderAccruals(ctx, data, number)
+		if err != nil {
+			data.Logger.Debugw(err.Error(), "event", "poll order accruals", "orderNumber", number)
+		}
+	}
+
+	return nil
 }
@@ -31,6 +31,16 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode // захватываем код статуса
 }
 
+// Flush отправляет клиенту накопленные данные, если исходный http.ResponseWriter это поддерживает
+func (r *loggingResponseWriter) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap возвращает исходный http.ResponseWriter для http.ResponseController
+func (r *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // InitLogger инициализация логгера zap
 func InitLogger() (*zap.Logger, error) {
 	return zap.NewDevelopment()
@@ -0,0 +1,321 @@
+// Package oidc клиент входа через OpenID Connect по коду авторизации с PKCE:
+// получение настроек провайдера по discovery, обмен кода на токены и проверка ID токена по ключам JWKS
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// ErrInvalidIDToken ошибка проверки ID токена: подпись, издатель, получатель, срок действия или nonce
+var ErrInvalidIDToken = errors.New("недействительный ID токен")
+
+// Config настройки клиента OpenID Connect
+type Config struct {
+	// Issuer - адрес провайдера, настройки получаются по адресу Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL - адрес обработчика возврата с кодом авторизации
+	RedirectURL string
+	// Scopes - запрашиваемые области доступа, openid добавляется всегда
+	Scopes []string
+}
+
+// Metadata настройки провайдера из документа discovery
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims клеймы ID токена, используемые для связи внешней учетной записи с пользователем
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// Client клиент провайдера OpenID Connect, настройки провайдера и ключи JWKS
+// загружаются при первом использовании и кэшируются
+type Client struct {
+	conf       Config
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]*rsa.PublicKey
+}
+
+// NewClient создание клиента провайдера, httpClient nil - http.DefaultClient
+func NewClient(conf Config, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{conf: conf, httpClient: httpClient}
+}
+
+// NewVerifier создание случайного code_verifier для PKCE
+func NewVerifier() (string, error) {
+	return util.GenerateSecureToken(32)
+}
+
+// Challenge вычисление code_challenge по методу S256 для code_verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL адрес страницы авторизации провайдера с параметрами state, nonce и code_challenge
+func (c *Client) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	metadata, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := []string{"openid"}
+	for _, scope := range c.conf.Scopes {
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.conf.ClientID},
+		"redirect_uri":          {c.conf.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange обмен кода авторизации на токены с передачей code_verifier
+// и проверка полученного ID токена с ожидаемым nonce
+func (c *Client) Exchange(ctx context.Context, code string, verifier string, nonce string) (*IDTokenClaims, error) {
+	metadata, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.conf.RedirectURL},
+		"client_id":     {c.conf.ClientID},
+		"code_verifier": {verifier},
+	}
+	if c.conf.ClientSecret != "" {
+		form.Set("client_secret", c.conf.ClientSecret)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	var response struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := c.doJSON(request, &response); err != nil {
+		return nil, fmt.Errorf("обмен кода авторизации: %w", err)
+	}
+	if response.IDToken == "" {
+		return nil, fmt.Errorf("обмен кода авторизации: провайдер не выдал ID токен")
+	}
+
+	return c.Verify(ctx, response.IDToken, nonce)
+}
+
+// Verify проверка ID токена: подпись RS256 ключом JWKS провайдера, издатель, получатель,
+// срок действия и nonce, неизвестный kid приводит к повторной загрузке ключей
+func (c *Client) Verify(ctx context.Context, rawIDToken string, nonce string) (*IDTokenClaims, error) {
+	metadata, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &IDTokenClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
+	_, err = parser.ParseWithClaims(rawIDToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return c.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	switch {
+	case claims.Issuer != metadata.Issuer:
+		return nil, fmt.Errorf("%w: неверный издатель %s", ErrInvalidIDToken, claims.Issuer)
+	case !claims.VerifyAudience(c.conf.ClientID, true):
+		return nil, fmt.Errorf("%w: токен выдан другому клиенту", ErrInvalidIDToken)
+	case claims.ExpiresAt == nil:
+		return nil, fmt.Errorf("%w: не указан срок действия", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: не указан sub", ErrInvalidIDToken)
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: неверный nonce", ErrInvalidIDToken)
+	}
+
+	return claims, nil
+}
+
+// Issuer издатель ID токенов провайдера из документа discovery
+func (c *Client) Issuer(ctx context.Context) (string, error) {
+	metadata, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return metadata.Issuer, nil
+}
+
+// discover получение настроек провайдера, издатель в документе должен совпадать с настроенным
+func (c *Client) discover(ctx context.Context) (*Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	issuer := strings.TrimRight(c.conf.Issuer, "/")
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata Metadata
+	if err := c.doJSON(request, &metadata); err != nil {
+		return nil, fmt.Errorf("получение настроек провайдера: %w", err)
+	}
+
+	if strings.TrimRight(metadata.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("издатель провайдера %s не совпадает с настроенным %s", metadata.Issuer, c.conf.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("в настройках провайдера нет адресов authorization_endpoint, token_endpoint или jwks_uri")
+	}
+
+	c.metadata = &metadata
+	return c.metadata, nil
+}
+
+// publicKey получение ключа проверки подписи по kid, при неизвестном kid ключи загружаются заново,
+// чтобы принимать токены после смены ключей провайдером
+func (c *Client) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	jwksURI := c.metadata.JWKSURI
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	keys, err := c.fetchKeys(ctx, jwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+
+	// без kid допускается единственный ключ набора
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("неизвестный ключ подписи %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys загрузка RSA ключей подписи из JWKS провайдера
+func (c *Client) fetchKeys(ctx context.Context, jwksURI string) (map[string]*rsa.PublicKey, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := c.doJSON(request, &jwks); err != nil {
+		return nil, fmt.Errorf("получение ключей провайдера: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("ключ %s: %w", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("ключ %s: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// doJSON выполнение запроса к провайдеру и разбор ответа в JSON
+func (c *Client) doJSON(request *http.Request, v any) error {
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("провайдер вернул статус %d: %s", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,107 @@
+package oidc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/hardvlad/ypdiploma1/internal/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	provider, err := oidctest.NewProvider("gophermart", "client-secret")
+	require.NoError(t, err)
+	defer provider.Close()
+
+	provider.SetIdentity(oidctest.Identity{Subject: "employee-42", Email: "employee@example.com", PreferredUsername: "employee"})
+
+	ctx := context.Background()
+	client := NewClient(Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     "gophermart",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://localhost/api/user/oidc/callback",
+		Scopes:       []string{"openid", "email"},
+	}, nil)
+
+	verifier, err := NewVerifier()
+	require.NoError(t, err)
+
+	authURL, err := client.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	require.NoError(t, err)
+
+	callback, err := provider.Authorize(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, "state-1", callback.Query().Get("state"))
+	code := callback.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	// код без верного code_verifier не принимается и после неудачи больше не действует
+	_, err = client.Exchange(ctx, code, "wrong-verifier", "nonce-1")
+	assert.Error(t, err)
+
+	callback, err = provider.Authorize(authURL)
+	require.NoError(t, err)
+
+	// ID токен с другим nonce отклоняется
+	_, err = client.Exchange(ctx, callback.Query().Get("code"), verifier, "nonce-2")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	callback, err = provider.Authorize(authURL)
+	require.NoError(t, err)
+
+	claims, err := client.Exchange(ctx, callback.Query().Get("code"), verifier, "nonce-1")
+	require.NoError(t, err)
+	assert.Equal(t, "employee-42", claims.Subject)
+	assert.Equal(t, "employee@example.com", claims.Email)
+	assert.Equal(t, "employee", claims.PreferredUsername)
+}
+
+func TestVerifyRejects(t *testing.T) {
+	provider, err := oidctest.NewProvider("gophermart", "")
+	require.NoError(t, err)
+	defer provider.Close()
+
+	ctx := context.Background()
+	client := NewClient(Config{Issuer: provider.Issuer(), ClientID: "gophermart"}, nil)
+
+	valid := jwt.MapClaims{
+		"iss":   provider.Issuer(),
+		"sub":   "subject-1",
+		"aud":   "gophermart",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": "n",
+	}
+
+	token, err := provider.SignIDToken(valid)
+	require.NoError(t, err)
+	_, err = client.Verify(ctx, token, "n")
+	require.NoError(t, err)
+
+	for name, change := range map[string]func(jwt.MapClaims){
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"audience": func(c jwt.MapClaims) { c["aud"] = "other-client" },
+		"expired":  func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"subject":  func(c jwt.MapClaims) { delete(c, "sub") },
+	} {
+		claims := jwt.MapClaims{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		change(claims)
+
+		token, err := provider.SignIDToken(claims)
+		require.NoError(t, err)
+		_, err = client.Verify(ctx, token, "n")
+		assert.ErrorIs(t, err, ErrInvalidIDToken, name)
+	}
+
+	// токен, подписанный HS256 по открытым данным, не принимается
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = client.Verify(ctx, forged, "n")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+}
@@ -0,0 +1,71 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rangePrefixLength длина префикса SHA-1 хэша, по которому пароли разбиты на диапазоны
+const rangePrefixLength = 5
+
+// BreachedList список утекших паролей в формате диапазонов k-anonymity:
+// каталог с файлами <PREFIX> или <PREFIX>.txt по первым 5 символам SHA-1 хэша пароля,
+// каждая строка файла - оставшиеся 35 символов хэша и, через двоеточие, количество утечек.
+// Для проверки пароля читается только файл его диапазона
+type BreachedList struct {
+	dir string
+}
+
+// NewBreachedList создание списка утекших паролей из каталога диапазонов dir
+func NewBreachedList(dir string) (*BreachedList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("список утекших паролей должен быть каталогом файлов диапазонов")
+	}
+	return &BreachedList{dir: dir}, nil
+}
+
+// Contains проверка, встречается ли пароль в списке утекших паролей
+func (l *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:rangePrefixLength], hash[rangePrefixLength:]
+
+	for _, name := range []string{prefix, prefix + ".txt", strings.ToLower(prefix), strings.ToLower(prefix) + ".txt"} {
+		found, err := scanRange(filepath.Join(l.dir, name), suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return found, err
+	}
+
+	// нет файла диапазона - в диапазоне нет утекших паролей
+	return false, nil
+}
+
+// scanRange поиск суффикса хэша в файле диапазона
+func scanRange(path string, suffix string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
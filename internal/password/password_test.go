@@ -0,0 +1,62 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{MinLength: 8, MinClasses: 2, ForbidLogin: true}
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		valid    bool
+	}{
+		{name: "short", login: "user", password: "ab1", valid: false},
+		{name: "one class", login: "user", password: "abcdefgh", valid: false},
+		{name: "two classes", login: "user", password: "abcdefg1", valid: true},
+		{name: "contains login", login: "gopher", password: "GOPHER2024", valid: false},
+		{name: "unicode length", login: "user", password: "пароль12", valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Check(test.login, test.password)
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				var policyErr *PolicyError
+				assert.ErrorAs(t, err, &policyErr)
+			}
+		})
+	}
+}
+
+func TestBreachedList(t *testing.T) {
+	dir := t.TempDir()
+
+	sum := sha1.Sum([]byte("P@ssw0rd"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	content := "0000000000000000000000000000000000A:1\n" + hash[5:] + ":52\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(content), 0o600))
+
+	list, err := NewBreachedList(dir)
+	require.NoError(t, err)
+
+	found, err := list.Contains("P@ssw0rd")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = list.Contains("correct horse battery staple")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
@@ -0,0 +1,66 @@
+// Package password проверка паролей пользователей по политике сложности и по списку утекших паролей
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy тип, описывающий политику сложности паролей:
+// MinLength - минимальная длина пароля в символах,
+// MinClasses - минимальное количество классов символов (строчные и заглавные буквы, цифры, прочие символы),
+// ForbidLogin - запрет пароля, совпадающего с логином или содержащего его
+type Policy struct {
+	MinLength   int
+	MinClasses  int
+	ForbidLogin bool
+}
+
+// PolicyError ошибка несоответствия пароля политике сложности с описанием нарушенного требования
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// Check проверка пароля пользователя с логином login на соответствие политике,
+// возвращает PolicyError с описанием нарушенного требования
+func (p Policy) Check(login string, password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PolicyError{Reason: fmt.Sprintf("пароль должен содержать не менее %d символов", p.MinLength)}
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return &PolicyError{Reason: fmt.Sprintf("пароль должен содержать символы не менее %d классов: строчные и заглавные буквы, цифры, прочие символы", p.MinClasses)}
+	}
+
+	if p.ForbidLogin && login != "" && strings.Contains(strings.ToLower(password), strings.ToLower(login)) {
+		return &PolicyError{Reason: "пароль не должен содержать логин"}
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// GetUserExport функция получения выгрузки персональных данных пользователя,
+// все данные читаются в одной транзакции, чтобы журнал сходился с заказами и списаниями
+func (s *Storage) GetUserExport(ctx context.Context, userID int) (*repository.UserExport, error) {
+	tx, err := s.DBConn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var export repository.UserExport
+	var deletionScheduledAt sql.NullTime
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT now()::timestamp, id, login, role, created_at, deletion_scheduled_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&export.ExportedAt, &export.Profile.ID, &export.Profile.Login, &export.Profile.Role, &export.Profile.CreatedAt, &deletionScheduledAt)
+	if err != nil {
+		return nil, err
+	}
+	if deletionScheduledAt.Valid {
+		export.Profile.DeletionScheduledAt = &deletionScheduledAt.Time
+	}
+
+	if export.Profile.Identities, err = exportIdentities(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+	if export.Orders, err = exportOrders(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+	if export.Withdrawals, err = exportWithdrawals(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+	if export.Ledger, err = exportLedger(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
+	return &export, tx.Commit()
+}
+
+// exportIdentities чтение связанных внешних учетных записей пользователя для выгрузки
+func exportIdentities(ctx context.Context, tx *sql.Tx, userID int) ([]repository.ExportIdentity, error) {
+	const sqlStmt = `
+    SELECT issuer, subject, coalesce(email, ''), created_at, last_login_at
+    FROM user_identities WHERE user_id = $1 ORDER BY id
+`
+	rows, err := tx.QueryContext(ctx, sqlStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []repository.ExportIdentity{}
+	for rows.Next() {
+		var identity repository.ExportIdentity
+		var lastLoginAt sql.NullTime
+		err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.Email, &identity.CreatedAt, &lastLoginAt)
+		if err != nil {
+			return nil, err
+		}
+		if lastLoginAt.Valid {
+			identity.LastLoginAt = &lastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// exportOrders чтение заказов пользователя с составом для выгрузки
+func exportOrders(ctx context.Context, tx *sql.Tx, userID int) ([]repository.ExportOrder, error) {
+	const ordersStmt = `
+    SELECT o.id, o.number, os.name, coalesce(o.accrual, 0), o.uploaded_at, o.processed_at
+    FROM orders o JOIN statuses os ON o.status_id = os.id
+    WHERE o.user_id = $1
+    ORDER BY o.uploaded_at, o.id
+`
+	rows, err := tx.QueryContext(ctx, ordersStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []repository.ExportOrder{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var id int
+		var order repository.ExportOrder
+		var processedAt sql.NullTime
+		err := rows.Scan(&id, &order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt, &processedAt)
+		if err != nil {
+			return nil, err
+		}
+		if processedAt.Valid {
+			order.ProcessedAt = &processedAt.Time
+		}
+		index[id] = len(orders)
+		orders = append(orders, order)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	const goodsStmt = `
+    SELECT g.order_id, g.description, g.price
+    FROM order_goods g JOIN orders o ON g.order_id = o.id
+    WHERE o.user_id = $1
+    ORDER BY g.id
+`
+	goodsRows, err := tx.QueryContext(ctx, goodsStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer goodsRows.Close()
+
+	for goodsRows.Next() {
+		var orderID int
+		var good repository.OrderGood
+		if err := goodsRows.Scan(&orderID, &good.Description, &good.Price); err != nil {
+			return nil, err
+		}
+		if i, ok := index[orderID]; ok {
+			orders[i].Goods = append(orders[i].Goods, good)
+		}
+	}
+	return orders, goodsRows.Err()
+}
+
+// exportWithdrawals чтение списаний пользователя для выгрузки
+func exportWithdrawals(ctx context.Context, tx *sql.Tx, userID int) ([]repository.WithdrawalsResult, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT number, amount, processed_at FROM withdrawals WHERE user_id = $1 ORDER BY processed_at, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	withdrawals := []repository.WithdrawalsResult{}
+	for rows.Next() {
+		var withdrawal repository.WithdrawalsResult
+		if err := rows.Scan(&withdrawal.OrderNumber, &withdrawal.Sum, &withdrawal.ProcessedAt); err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, withdrawal)
+	}
+	return withdrawals, rows.Err()
+}
+
+// exportLedger чтение журнала движения баллов пользователя в хронологическом порядке с балансом после каждой записи:
+// начисления за заказы на время завершения расчета, списания и корректировки баланса
+func exportLedger(ctx context.Context, tx *sql.Tx, userID int) ([]repository.LedgerEntry, error) {
+	const sqlStmt = `
+    SELECT $2::text, number, accrual, '', '', coalesce(processed_at, uploaded_at)
+    FROM orders WHERE user_id = $1 AND coalesce(accrual, 0) <> 0
+    UNION ALL
+    SELECT $3::text, number, -amount, '', '', processed_at
+    FROM withdrawals WHERE user_id = $1
+    UNION ALL
+    SELECT $4::text, coalesce(o.number, ''), a.amount, a.source, a.reason, a.created_at
+    FROM balance_adjustments a LEFT JOIN orders o ON a.order_id = o.id
+    WHERE a.user_id = $1
+    ORDER BY 6, 1
+`
+	rows, err := tx.QueryContext(ctx, sqlStmt, userID, repository.LedgerAccrual, repository.LedgerWithdrawal, repository.LedgerAdjustment)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ledger := []repository.LedgerEntry{}
+	var balance float64
+	for rows.Next() {
+		var entry repository.LedgerEntry
+		err := rows.Scan(&entry.Type, &entry.Order, &entry.Amount, &entry.Source, &entry.Reason, &entry.At)
+		if err != nil {
+			return nil, err
+		}
+		balance = math.Round((balance+entry.Amount)*100) / 100
+		entry.Balance = balance
+		ledger = append(ledger, entry)
+	}
+	return ledger, rows.Err()
+}
+
+// ScheduleUserDeletion функция планирования удаления учетной записи через grace,
+// повторный запрос не переносит запланированное время, возвращает время удаления
+func (s *Storage) ScheduleUserDeletion(ctx context.Context, userID int, grace time.Duration) (time.Time, error) {
+	const sqlStmt = `
+    UPDATE users SET deletion_scheduled_at = coalesce(deletion_scheduled_at, now() + make_interval(secs => $2))
+    WHERE id = $1
+    RETURNING deletion_scheduled_at
+`
+	var scheduledAt time.Time
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, userID, grace.Seconds()).Scan(&scheduledAt)
+	return scheduledAt, err
+}
+
+// CancelUserDeletion функция отмены запланированного удаления, возвращает false, если удаление не запланировано
+func (s *Storage) CancelUserDeletion(ctx context.Context, userID int) (bool, error) {
+	return s.execAffected(ctx, "UPDATE users SET deletion_scheduled_at = NULL WHERE id = $1 AND deletion_scheduled_at IS NOT NULL", userID)
+}
+
+// GetUsersForPurge функция получения пользователей, время удаления которых наступило
+func (s *Storage) GetUsersForPurge(ctx context.Context, limit int) ([]int, error) {
+	const sqlStmt = `
+    SELECT id FROM users
+    WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= now()
+    ORDER BY deletion_scheduled_at
+    LIMIT $1
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// PurgeUser функция удаления учетной записи с обезличиванием финансовых записей: заказы, списания,
+// корректировки и споры остаются без связи с пользователем, незавершенные споры отклоняются,
+// тексты обращений, журнал попыток входа по логину и журнал загрузок заказов удаляются, остальные данные удаляются каскадно,
+// возвращает false, если удаление отменено или время удаления не наступило
+func (s *Storage) PurgeUser(ctx context.Context, userID int) (bool, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// блокировка строки пользователя исключает гонку с отменой удаления
+	var login string
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT login FROM users WHERE id = $1 AND deletion_scheduled_at <= now() FOR UPDATE",
+		userID,
+	).Scan(&login)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	const closeDisputesStmt = `
+    UPDATE disputes
+    SET status = $2, resolution = $3, updated_at = now(), resolved_at = now()
+    WHERE user_id = $1 AND status IN ($4, $5)
+`
+	_, err = tx.ExecContext(ctx, closeDisputesStmt, userID,
+		repository.DisputeStatusRejected, "учетная запись пользователя удалена",
+		repository.DisputeStatusOpen, repository.DisputeStatusUnderReview,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	// текст обращения может содержать персональные данные, решение по спору сохраняется
+	_, err = tx.ExecContext(ctx, "UPDATE disputes SET reason = '' WHERE user_id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+
+	loginKey, _ := loginLockoutKeys(login, "")
+	_, err = tx.ExecContext(ctx, "DELETE FROM login_attempts WHERE login = $1", login)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM login_lockouts WHERE key = $1", loginKey)
+	if err != nil {
+		return false, err
+	}
+
+	// журнал загрузок содержит номера заказов и IP-адреса пользователя
+	_, err = tx.ExecContext(ctx, "DELETE FROM order_upload_attempts WHERE user_id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
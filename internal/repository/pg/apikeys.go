@@ -0,0 +1,91 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// CreateAPIKey функция создания API ключа пользователя по хэшу ключа
+func (s *Storage) CreateAPIKey(ctx context.Context, userID int, name string, prefix string, keyHash string, scopes []string) (*repository.APIKey, error) {
+	apiKey := repository.APIKey{UserID: userID, Name: name, Prefix: prefix, Scopes: scopes}
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		userID, name, prefix, keyHash, scopes,
+	).Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+// GetAPIKeys функция получения API ключей пользователя, включая отозванные
+func (s *Storage) GetAPIKeys(ctx context.Context, userID int) ([]repository.APIKey, error) {
+	const sqlStmt = `
+    SELECT id, name, prefix, array_to_string(scopes, ','), created_at, last_used_at, revoked_at
+    FROM api_keys WHERE user_id = $1 ORDER BY id
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apiKeys []repository.APIKey
+	for rows.Next() {
+		apiKey := repository.APIKey{UserID: userID}
+		var scopes string
+		var lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.CreatedAt, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		apiKey.Scopes = strings.Split(scopes, ",")
+		if lastUsedAt.Valid {
+			apiKey.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			apiKey.RevokedAt = &revokedAt.Time
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	return apiKeys, rows.Err()
+}
+
+// RevokeAPIKey функция отзыва API ключа пользователя, возвращает false, если ключ не найден
+func (s *Storage) RevokeAPIKey(ctx context.Context, userID int, keyID int) (bool, error) {
+	result, err := s.DBConn.ExecContext(ctx, "UPDATE api_keys SET revoked_at = coalesce(revoked_at, now()) WHERE id = $1 AND user_id = $2", keyID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// AuthenticateAPIKey функция поиска действующего API ключа по хэшу с отметкой времени использования
+// и ролью владельца, возвращает nil, если ключ не найден или отозван
+func (s *Storage) AuthenticateAPIKey(ctx context.Context, keyHash string) (*repository.APIKey, error) {
+	const sqlStmt = `
+    UPDATE api_keys k SET last_used_at = now()
+    FROM users u
+    WHERE k.key_hash = $1 AND k.revoked_at IS NULL AND u.id = k.user_id
+    RETURNING k.id, k.user_id, u.role, k.name, k.prefix, array_to_string(k.scopes, ','), k.created_at
+`
+	var apiKey repository.APIKey
+	var scopes string
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, keyHash).Scan(&apiKey.ID, &apiKey.UserID, &apiKey.UserRole, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	apiKey.Scopes = strings.Split(scopes, ",")
+	return &apiKey, nil
+}
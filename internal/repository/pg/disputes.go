@@ -0,0 +1,194 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// disputeSelectSQL запрос споров с номером заказа и суммой корректировки по решению
+const disputeSelectSQL = `
+    SELECT d.id, coalesce(d.user_id, 0), o.number, d.reason, d.status, coalesce(d.resolution, ''), coalesce(a.amount, 0),
+           d.created_at, d.updated_at, coalesce(d.reviewed_by, 0), d.reviewed_at, coalesce(d.resolved_by, 0), d.resolved_at
+    FROM disputes d
+        JOIN orders o ON d.order_id = o.id
+        LEFT JOIN balance_adjustments a ON d.adjustment_id = a.id
+`
+
+// disputeTransitions статусы, из которых допустим переход спора в новый статус
+var disputeTransitions = map[string][]string{
+	repository.DisputeStatusUnderReview: {repository.DisputeStatusOpen},
+	repository.DisputeStatusResolved:    {repository.DisputeStatusOpen, repository.DisputeStatusUnderReview},
+	repository.DisputeStatusRejected:    {repository.DisputeStatusOpen, repository.DisputeStatusUnderReview},
+}
+
+// CreateDispute функция открытия спора пользователя по начислению за заказ,
+// возвращает nil, если заказ не найден или принадлежит другому пользователю
+func (s *Storage) CreateDispute(ctx context.Context, userID int, orderNumber string, reason string) (*repository.Dispute, error) {
+	var orderID int
+	var status string
+	const selectStmt = "SELECT o.id, os.name FROM orders o JOIN statuses os ON o.status_id = os.id WHERE o.number = $1 AND o.user_id = $2"
+	err := s.DBConn.QueryRowContext(ctx, selectStmt, orderNumber, userID).Scan(&orderID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// оспорить можно только окончательный результат расчета
+	if !isFinalStatus(status) {
+		return nil, repository.ErrOrderNotFinished
+	}
+
+	var disputeID int
+	err = s.DBConn.QueryRowContext(
+		ctx,
+		"INSERT INTO disputes (order_id, user_id, reason) VALUES ($1, $2, $3) RETURNING id",
+		orderID, userID, reason,
+	).Scan(&disputeID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, repository.ErrDisputeExists
+		}
+		return nil, err
+	}
+
+	return s.getDispute(ctx, s.DBConn, disputeID)
+}
+
+// GetUserDisputes функция получения споров пользователя
+func (s *Storage) GetUserDisputes(ctx context.Context, userID int) ([]repository.Dispute, error) {
+	return s.queryDisputes(ctx, disputeSelectSQL+" WHERE d.user_id = $1 ORDER BY d.created_at DESC, d.id DESC", userID)
+}
+
+// GetDisputes функция получения очереди споров с фильтром по статусу, пустой статус - все споры
+func (s *Storage) GetDisputes(ctx context.Context, status string, limit int) ([]repository.Dispute, error) {
+	return s.queryDisputes(ctx, disputeSelectSQL+" WHERE $1 = '' OR d.status = $1 ORDER BY d.created_at, d.id LIMIT $2", status, limit)
+}
+
+// SetDisputeStatus функция перевода спора в новый статус с решением администратором actorID,
+// при amount > 0 пользователю начисляется корректировка баланса по заказу спора от имени администратора
+func (s *Storage) SetDisputeStatus(ctx context.Context, disputeID int, actorID int, status string, resolution string, amount float64) (*repository.Dispute, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID, orderID int
+	var current string
+	err = tx.QueryRowContext(ctx, "SELECT coalesce(user_id, 0), order_id, status FROM disputes WHERE id = $1 FOR UPDATE", disputeID).
+		Scan(&userID, &orderID, &current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrDisputeNotFound
+		}
+		return nil, err
+	}
+
+	if !slices.Contains(disputeTransitions[status], current) {
+		return nil, repository.ErrDisputeState
+	}
+
+	// решение в пользу пользователя оформляется корректировкой баланса, которая остается в истории
+	var adjustmentID sql.NullInt64
+	if status == repository.DisputeStatusResolved && amount > 0 {
+		err = tx.QueryRowContext(ctx,
+			"INSERT INTO balance_adjustments (user_id, order_id, amount, source, reason, created_by) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			userID, orderID, amount, repository.AdjustmentSourceDispute, fmt.Sprintf("решение по спору #%d: %s", disputeID, resolution), actorID,
+		).Scan(&adjustmentID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// спор разбирает администратор, первым взявший его в работу или сразу принявший решение
+	const updateStmt = `
+    UPDATE disputes
+    SET status = $2, resolution = nullif($3, ''), adjustment_id = $4, updated_at = now(),
+        reviewed_by = CASE WHEN reviewed_at IS NULL THEN $5 ELSE reviewed_by END,
+        reviewed_at = coalesce(reviewed_at, now()),
+        resolved_by = CASE WHEN $2 IN ('resolved', 'rejected') THEN $5 END,
+        resolved_at = CASE WHEN $2 IN ('resolved', 'rejected') THEN now() END
+    WHERE id = $1
+`
+	_, err = tx.ExecContext(ctx, updateStmt, disputeID, status, resolution, adjustmentID, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	if adjustmentID.Valid {
+		err = s.refreshDebtFlag(ctx, tx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dispute, err := s.getDispute(ctx, tx, disputeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return dispute, tx.Commit()
+}
+
+// querier общий интерфейс подключения к базе данных и транзакции для запросов
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// getDispute функция получения спора по ID
+func (s *Storage) getDispute(ctx context.Context, conn querier, disputeID int) (*repository.Dispute, error) {
+	rows, err := conn.QueryContext(ctx, disputeSelectSQL+" WHERE d.id = $1", disputeID)
+	if err != nil {
+		return nil, err
+	}
+	disputes, err := scanDisputes(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(disputes) == 0 {
+		return nil, repository.ErrDisputeNotFound
+	}
+	return &disputes[0], nil
+}
+
+// queryDisputes функция получения списка споров по запросу
+func (s *Storage) queryDisputes(ctx context.Context, query string, args ...any) ([]repository.Dispute, error) {
+	rows, err := s.DBConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDisputes(rows)
+}
+
+// scanDisputes функция чтения споров из результата запроса, закрывает rows
+func scanDisputes(rows *sql.Rows) ([]repository.Dispute, error) {
+	defer rows.Close()
+
+	var disputes []repository.Dispute
+	for rows.Next() {
+		var dispute repository.Dispute
+		var reviewedAt, resolvedAt sql.NullTime
+		err := rows.Scan(&dispute.ID, &dispute.UserID, &dispute.Order, &dispute.Reason, &dispute.Status, &dispute.Resolution,
+			&dispute.Adjustment, &dispute.CreatedAt, &dispute.UpdatedAt, &dispute.ReviewedBy, &reviewedAt, &dispute.ResolvedBy, &resolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		if reviewedAt.Valid {
+			dispute.ReviewedAt = &reviewedAt.Time
+		}
+		if resolvedAt.Valid {
+			dispute.ResolvedAt = &resolvedAt.Time
+		}
+		disputes = append(disputes, dispute)
+	}
+	return disputes, rows.Err()
+}
@@ -0,0 +1,63 @@
+package pg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// userEventsChannel канал LISTEN/NOTIFY, в который триггеры публикуют события пользователей
+const userEventsChannel = "user_events"
+
+// userEventPayload формат события в уведомлении Postgres
+type userEventPayload struct {
+	repository.UserEvent
+	UserID int `json:"user_id"`
+}
+
+// ListenUserEvents функция получения событий пользователей, опубликованных любым экземпляром сервиса,
+// вызывает ready после подписки на канал уведомлений и fn для каждого события,
+// блокируется до отмены контекста или ошибки подключения
+func (s *Storage) ListenUserEvents(ctx context.Context, ready func(), fn func(repository.UserEvent)) error {
+	// для LISTEN нужно выделенное подключение, которое не возвращается в пул на время ожидания
+	conn, err := s.DBConn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("подключение не поддерживает LISTEN")
+		}
+		pgxConn := stdlibConn.Conn()
+
+		_, err := pgxConn.Exec(ctx, "LISTEN "+userEventsChannel)
+		if err != nil {
+			return err
+		}
+		defer pgxConn.Exec(context.Background(), "UNLISTEN "+userEventsChannel)
+		ready()
+
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			var payload userEventPayload
+			if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+				s.logger.Errorw("некорректное событие пользователя", "payload", notification.Payload, "error", err)
+				continue
+			}
+
+			event := payload.UserEvent
+			event.UserID = payload.UserID
+			fn(event)
+		}
+	})
+}
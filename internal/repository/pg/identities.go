@@ -0,0 +1,122 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SaveOIDCAuthRequest функция сохранения начатого входа через провайдера по хэшу state на время ttl,
+// истекшие входы удаляются
+func (s *Storage) SaveOIDCAuthRequest(ctx context.Context, stateHash string, request repository.OIDCAuthRequest, ttl time.Duration) error {
+	_, err := s.DBConn.ExecContext(ctx, "DELETE FROM oidc_auth_requests WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DBConn.ExecContext(
+		ctx,
+		"INSERT INTO oidc_auth_requests (state_hash, nonce, code_verifier, link_user_id, expires_at) VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))",
+		stateHash, request.Nonce, request.CodeVerifier, sql.NullInt64{Int64: int64(request.LinkUserID), Valid: request.LinkUserID > 0}, ttl.Seconds(),
+	)
+	return err
+}
+
+// TakeOIDCAuthRequest функция однократного получения начатого входа по хэшу state,
+// возвращает nil, если вход не найден или истек
+func (s *Storage) TakeOIDCAuthRequest(ctx context.Context, stateHash string) (*repository.OIDCAuthRequest, error) {
+	var request repository.OIDCAuthRequest
+	var linkUserID sql.NullInt64
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"DELETE FROM oidc_auth_requests WHERE state_hash = $1 AND expires_at > now() RETURNING nonce, code_verifier, link_user_id",
+		stateHash,
+	).Scan(&request.Nonce, &request.CodeVerifier, &linkUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	request.LinkUserID = int(linkUserID.Int64)
+	return &request, nil
+}
+
+// GetUserIDByIdentity функция получения пользователя, связанного с внешней учетной записью,
+// с отметкой времени входа и обновлением email, возвращает 0, если связи нет
+func (s *Storage) GetUserIDByIdentity(ctx context.Context, identity repository.Identity) (int, error) {
+	var userID int
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"UPDATE user_identities SET last_login_at = now(), email = $3 WHERE issuer = $1 AND subject = $2 RETURNING user_id",
+		identity.Issuer, identity.Subject, identity.Email,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// LinkIdentity функция связи внешней учетной записи с пользователем, повторная связь с тем же пользователем допускается,
+// возвращает ErrIdentityLinked, если запись связана с другим пользователем
+func (s *Storage) LinkIdentity(ctx context.Context, userID int, identity repository.Identity) error {
+	return linkIdentity(ctx, s.DBConn, userID, identity)
+}
+
+// CreateUserWithIdentity функция создания пользователя без пароля, связанного с внешней учетной записью,
+// войти по паролю такой пользователь не может до установки пароля, возвращает ErrLoginTaken, если логин занят
+func (s *Storage) CreateUserWithIdentity(ctx context.Context, login string, identity repository.Identity) (int, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, "INSERT INTO users (login, password_hash) VALUES ($1, '') RETURNING id", login).Scan(&userID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return 0, repository.ErrLoginTaken
+		}
+		return 0, err
+	}
+
+	if err := linkIdentity(ctx, tx, userID, identity); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// rowQuerier общий интерфейс подключения к базе данных и транзакции для запросов одной строки
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// linkIdentity связь внешней учетной записи с пользователем в транзакции или вне ее
+func linkIdentity(ctx context.Context, conn rowQuerier, userID int, identity repository.Identity) error {
+	const sqlStmt = `
+    INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES ($1, $2, $3, $4, now())
+    ON CONFLICT (issuer, subject) DO UPDATE SET last_login_at = now(), email = excluded.email
+    WHERE user_identities.user_id = excluded.user_id
+    RETURNING user_id
+`
+	var linkedUserID int
+	err := conn.QueryRowContext(ctx, sqlStmt, userID, identity.Issuer, identity.Subject, identity.Email).Scan(&linkedUserID)
+	if err != nil {
+		// ON CONFLICT ... WHERE не обновляет запись другого пользователя и не возвращает строку
+		if errors.Is(err, sql.ErrNoRows) {
+			return repository.ErrIdentityLinked
+		}
+		return err
+	}
+	return nil
+}
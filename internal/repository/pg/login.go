@@ -0,0 +1,147 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// loginLockoutKeys ключи счетчиков неудачных попыток входа по логину и по IP-адресу
+func loginLockoutKeys(login string, ip string) (string, string) {
+	return "login:" + login, "ip:" + ip
+}
+
+// CheckLoginLockout функция проверки блокировки входа по логину и IP-адресу,
+// возвращает оставшееся время блокировки, 0 - вход разрешен
+func (s *Storage) CheckLoginLockout(ctx context.Context, login string, ip string) (time.Duration, error) {
+	loginKey, ipKey := loginLockoutKeys(login, ip)
+
+	var seconds float64
+	const sqlStmt = `
+    SELECT coalesce(extract(epoch FROM max(locked_until) - now()), 0)
+    FROM login_lockouts
+    WHERE key IN ($1, $2) AND locked_until > now()
+`
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, loginKey, ipKey).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// RecordLoginAttempt функция записи попытки входа в журнал и учета неудачных попыток:
+// неудача увеличивает счетчики логина и IP-адреса и при превышении порога блокирует вход
+// с удвоением блокировки на каждую следующую неудачу, успешный вход сбрасывает счетчик логина,
+// возвращает установленное время блокировки
+func (s *Storage) RecordLoginAttempt(ctx context.Context, login string, ip string, result string, policy repository.LoginLockoutPolicy) (time.Duration, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO login_attempts (login, ip, result) VALUES ($1, $2, $3)", login, ip, result)
+	if err != nil {
+		return 0, err
+	}
+
+	loginKey, ipKey := loginLockoutKeys(login, ip)
+
+	switch result {
+	case repository.LoginResultSuccess:
+		_, err = tx.ExecContext(ctx, "DELETE FROM login_lockouts WHERE key = $1", loginKey)
+		if err != nil {
+			return 0, err
+		}
+		return 0, tx.Commit()
+
+	case repository.LoginResultLocked:
+		return 0, tx.Commit()
+	}
+
+	// счетчик сбрасывается, если предыдущая неудача была раньше окна ResetAfter
+	const upsertStmt = `
+    INSERT INTO login_lockouts (key, failures, last_failure_at) VALUES ($1, 1, now())
+    ON CONFLICT (key) DO UPDATE SET
+        failures = CASE WHEN login_lockouts.last_failure_at < now() - make_interval(secs => $2) THEN 1 ELSE login_lockouts.failures + 1 END,
+        last_failure_at = now()
+    RETURNING failures
+`
+	const lockStmt = "UPDATE login_lockouts SET locked_until = now() + make_interval(secs => $2) WHERE key = $1"
+
+	var lockout time.Duration
+	for _, rule := range []struct {
+		key       string
+		threshold int
+	}{
+		{loginKey, policy.LoginThreshold},
+		{ipKey, policy.IPThreshold},
+	} {
+		if rule.threshold <= 0 {
+			continue
+		}
+
+		var failures int
+		err = tx.QueryRowContext(ctx, upsertStmt, rule.key, policy.ResetAfter.Seconds()).Scan(&failures)
+		if err != nil {
+			return 0, err
+		}
+
+		if failures < rule.threshold {
+			continue
+		}
+
+		duration := lockoutDuration(policy.BaseLockout, policy.MaxLockout, failures-rule.threshold)
+		_, err = tx.ExecContext(ctx, lockStmt, rule.key, duration.Seconds())
+		if err != nil {
+			return 0, err
+		}
+		lockout = max(lockout, duration)
+	}
+
+	return lockout, tx.Commit()
+}
+
+// PurgeLoginAttempts функция удаления записей журнала попыток входа старше retention,
+// возвращает количество удаленных записей
+func (s *Storage) PurgeLoginAttempts(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := s.DBConn.ExecContext(
+		ctx,
+		"DELETE FROM login_attempts WHERE created_at < now() - make_interval(secs => $1)",
+		retention.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeLoginLockouts функция удаления счетчиков неудачных попыток входа по логинам и IP-адресам
+// без действующей блокировки, неудач по которым не было дольше resetAfter - такие счетчики все равно
+// сбросились бы при следующей неудаче, возвращает количество удаленных счетчиков
+func (s *Storage) PurgeLoginLockouts(ctx context.Context, resetAfter time.Duration) (int64, error) {
+	const sqlStmt = `
+    DELETE FROM login_lockouts
+    WHERE last_failure_at < now() - make_interval(secs => $1)
+      AND (locked_until IS NULL OR locked_until < now())
+`
+	result, err := s.DBConn.ExecContext(ctx, sqlStmt, resetAfter.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// lockoutDuration длительность блокировки после exceeded неудачных попыток сверх порога:
+// base, удваиваемая на каждую попытку, но не больше maxLockout
+func lockoutDuration(base time.Duration, maxLockout time.Duration, exceeded int) time.Duration {
+	duration := base
+	for i := 0; i < exceeded && duration < maxLockout; i++ {
+		duration *= 2
+	}
+	if maxLockout > 0 && duration > maxLockout {
+		duration = maxLockout
+	}
+	return duration
+}
@@ -5,12 +5,21 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/hardvlad/ypdiploma1/internal/repository"
 	"go.uber.org/zap"
 )
 
+// balanceSQL выражение текущего баланса пользователя с ID $1:
+// начисления по заказам и корректировки за вычетом списаний
+const balanceSQL = `coalesce((select sum(accrual) from orders where user_id = $1), 0) +
+           coalesce((select sum(amount) from balance_adjustments where user_id = $1), 0) -
+           coalesce((select sum(amount) from withdrawals where user_id = $1), 0)`
+
 // Storage тип, содержащий данные, необходимые для работы интерфейса и логирования
 type Storage struct {
 	DBConn *sql.DB
@@ -71,9 +80,116 @@ func (s *Storage) GetUserIDPasswordHashByLogin(ctx context.Context, login string
 	return userID, pwdHash, nil
 }
 
-// GetUserIDOfOrder функция получение ID пользователя в заказе
+// GetUserLoginPasswordHash функция получения логина и хеша пароля пользователя
+func (s *Storage) GetUserLoginPasswordHash(ctx context.Context, userID int) (string, string, error) {
+	var login, pwdHash string
+	err := s.DBConn.QueryRowContext(ctx, "SELECT login, password_hash FROM users WHERE id = $1", userID).Scan(&login, &pwdHash)
+	if err != nil {
+		return "", "", err
+	}
+	return login, pwdHash, nil
+}
+
+// UpdateUserPassword функция смены хеша пароля пользователя,
+// все семьи токенов пользователя отзываются, чтобы завершить входы со старым паролем
+func (s *Storage) UpdateUserPassword(ctx context.Context, userID int, pwdHash string) error {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password_hash = $2 WHERE id = $1", userID, pwdHash)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE token_families SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUserRole функция получения роли пользователя
+func (s *Storage) GetUserRole(ctx context.Context, userID int) (string, error) {
+	var role string
+	err := s.DBConn.QueryRowContext(ctx, "SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// SetUserRole функция смены роли пользователя, все семьи токенов пользователя отзываются,
+// чтобы токены со старой ролью перестали действовать, возвращает false, если пользователь не найден
+func (s *Storage) SetUserRole(ctx context.Context, userID int, role string) (bool, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET role = $2 WHERE id = $1", userID, role)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE token_families SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// SetUserRoleByLogin функция смены роли пользователя по логину, возвращает false, если пользователь не найден,
+// токены пользователя с уже назначенной ролью не отзываются
+func (s *Storage) SetUserRoleByLogin(ctx context.Context, login string, role string) (bool, error) {
+	var userID int
+	var currentRole string
+	err := s.DBConn.QueryRowContext(ctx, "SELECT id, role FROM users WHERE login = $1", login).Scan(&userID, &currentRole)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if currentRole == role {
+		return true, nil
+	}
+	return s.SetUserRole(ctx, userID, role)
+}
+
+// GetUserOrderValidator функция получения схемы проверки номеров заказов пользователя-партнера,
+// пустая строка - схема не задана
+func (s *Storage) GetUserOrderValidator(ctx context.Context, userID int) (string, error) {
+	var spec sql.NullString
+	err := s.DBConn.QueryRowContext(ctx, "SELECT order_validator FROM users WHERE id = $1", userID).Scan(&spec)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return spec.String, nil
+}
+
+// SetUserOrderValidator функция сохранения схемы проверки номеров заказов пользователя-партнера,
+// пустая строка удаляет персональную схему, возвращает false, если пользователь не найден
+func (s *Storage) SetUserOrderValidator(ctx context.Context, userID int, spec string) (bool, error) {
+	return s.execAffected(ctx, "UPDATE users SET order_validator = NULLIF($2, '') WHERE id = $1", userID, spec)
+}
+
+// GetUserIDOfOrder функция получение ID пользователя в заказе,
+// для заказа удаленного пользователя возвращает -1, номер остается занятым
 func (s *Storage) GetUserIDOfOrder(ctx context.Context, orderNumber string) (int, error) {
-	row := s.DBConn.QueryRowContext(ctx, "SELECT user_id from orders where number = $1", orderNumber)
+	row := s.DBConn.QueryRowContext(ctx, "SELECT coalesce(user_id, -1) from orders where number = $1", orderNumber)
 
 	userID := 0
 	err := row.Scan(&userID)
@@ -86,39 +202,277 @@ func (s *Storage) GetUserIDOfOrder(ctx context.Context, orderNumber string) (int
 	return userID, nil
 }
 
-// InsertNewOrder функция сохранения в базе данных нового заказа
+// InsertNewOrder функция сохранения в базе данных нового заказа,
+// заказ сразу ставится в очередь опроса системы начислений на случай, если первый запрос не удастся
 func (s *Storage) InsertNewOrder(ctx context.Context, orderNumber string, userID int) error {
-	_, err := s.DBConn.ExecContext(ctx, "INSERT INTO orders (number, user_id, status_id) VALUES ($1, $2, 1)", orderNumber, userID)
+	_, err := s.DBConn.ExecContext(ctx, "INSERT INTO orders (number, user_id, status_id, next_poll_at) VALUES ($1, $2, 1, now())", orderNumber, userID)
 	return err
 }
 
-// GetOrders функция получения заказов пользователя
-func (s *Storage) GetOrders(userID int) ([]repository.OrdersResult, error) {
-	rows, err := s.DBConn.Query("SELECT o.number, os.name, o.accrual, o.uploaded_at FROM orders o JOIN statuses os ON o.status_id = os.id WHERE o.user_id = $1 ORDER BY o.uploaded_at DESC", userID)
+// InsertNewOrderWithGoods функция сохранения в базе данных нового заказа с товарами,
+// такой заказ регистрируется в системе начислений перед запросом начислений, заказ сразу ставится
+// в очередь опроса, поэтому неудавшаяся регистрация повторяется воркером очереди опроса
+func (s *Storage) InsertNewOrderWithGoods(ctx context.Context, orderNumber string, userID int, goods []repository.OrderGood) error {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orderID int
+	err = tx.QueryRowContext(ctx, "INSERT INTO orders (number, user_id, status_id, next_poll_at) VALUES ($1, $2, 1, now()) RETURNING id", orderNumber, userID).Scan(&orderID)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO order_goods (order_id, description, price) VALUES ($1, $2, $3)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, good := range goods {
+		_, err = stmt.ExecContext(ctx, orderID, good.Description, good.Price)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetUnregisteredOrderGoods функция получения товаров заказа, еще не зарегистрированного в системе начислений,
+// возвращает nil, если регистрация не требуется
+func (s *Storage) GetUnregisteredOrderGoods(ctx context.Context, orderNumber string) ([]repository.OrderGood, error) {
+	const sqlStmt = `
+    SELECT g.description, g.price
+    FROM order_goods g JOIN orders o ON g.order_id = o.id
+    WHERE o.number = $1 AND o.accrual_registered_at IS NULL
+    ORDER BY g.id
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, orderNumber)
 	if err != nil {
 		return nil, err
 	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
+	defer rows.Close()
+
+	var goods []repository.OrderGood
+	for rows.Next() {
+		var good repository.OrderGood
+		if err := rows.Scan(&good.Description, &good.Price); err != nil {
+			return nil, err
+		}
+		goods = append(goods, good)
+	}
+	return goods, rows.Err()
+}
+
+// SetOrderRegistered функция сохранения признака регистрации заказа в системе начислений
+func (s *Storage) SetOrderRegistered(ctx context.Context, orderNumber string) error {
+	_, err := s.DBConn.ExecContext(ctx, "UPDATE orders SET accrual_registered_at = now() WHERE number = $1", orderNumber)
+	return err
+}
+
+// InsertOrdersBatch функция сохранения пакета новых заказов в одной транзакции,
+// новые заказы сразу ставятся в очередь опроса системы начислений,
+// возвращает результат по каждому номеру: accepted, already_yours или conflict
+func (s *Storage) InsertOrdersBatch(ctx context.Context, orderNumbers []string, userID int) ([]string, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insertStmt, err := tx.PrepareContext(ctx, "INSERT INTO orders (number, user_id, status_id, next_poll_at) VALUES ($1, $2, 1, now()) ON CONFLICT (number) DO NOTHING RETURNING id")
+	if err != nil {
+		return nil, err
+	}
+	defer insertStmt.Close()
+
+	ownerStmt, err := tx.PrepareContext(ctx, "SELECT coalesce(user_id, -1) FROM orders WHERE number = $1")
+	if err != nil {
+		return nil, err
+	}
+	defer ownerStmt.Close()
+
+	results := make([]string, len(orderNumbers))
+	for i, number := range orderNumbers {
+		var orderID int
+		err := insertStmt.QueryRowContext(ctx, number, userID).Scan(&orderID)
+		if err == nil {
+			results[i] = repository.OrderResultAccepted
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		// заказ с таким номером уже есть - определяем, кому он принадлежит
+		var ownerID int
+		err = ownerStmt.QueryRowContext(ctx, number).Scan(&ownerID)
+		if err != nil {
+			return nil, err
+		}
+
+		if ownerID == userID {
+			results[i] = repository.OrderResultAlreadyYours
+		} else {
+			results[i] = repository.OrderResultConflict
+		}
+	}
+
+	return results, tx.Commit()
+}
+
+// GetOrders функция получения заказов пользователя
+func (s *Storage) GetOrders(ctx context.Context, userID int) ([]repository.OrdersResult, error) {
+	orders, _, err := s.GetOrdersPage(ctx, userID, repository.OrdersFilter{})
+	return orders, err
+}
+
+// GetOrdersPage функция постраничного получения заказов пользователя с фильтрами,
+// возвращает курсор следующей страницы или nil, если страница последняя
+func (s *Storage) GetOrdersPage(ctx context.Context, userID int, filter repository.OrdersFilter) ([]repository.OrdersResult, *repository.Cursor, error) {
+	sqlStmt := `
+    SELECT o.id, o.number, os.name, o.accrual + coalesce((select sum(amount) from balance_adjustments where order_id = o.id), 0), o.uploaded_at
+    FROM orders o JOIN statuses os ON o.status_id = os.id
+    WHERE o.user_id = $1`
+	args := []any{userID}
+
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		sqlStmt += fmt.Sprintf(" AND os.name = $%d", len(args))
+	}
+	where, args := timeRangeCondition("o.uploaded_at", filter.From, filter.To, args)
+	sqlStmt += where
+
+	if filter.Cursor != nil {
+		args = append(args, filter.Cursor.Time, filter.Cursor.ID)
+		sqlStmt += fmt.Sprintf(" AND (o.uploaded_at, o.id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	// ID заказа в сортировке делает порядок стабильным для заказов с одинаковым временем загрузки
+	sqlStmt += " ORDER BY o.uploaded_at DESC, o.id DESC"
+
+	// запрашивается на одну запись больше страницы, чтобы определить, есть ли следующая страница
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit+1)
+		sqlStmt += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, args...)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	var orders []repository.OrdersResult
+	var ids []int
 
 	for rows.Next() {
+		var id int
 		var order repository.OrdersResult
-		err := rows.Scan(&order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt)
+		err := rows.Scan(&id, &order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		orders = append(orders, order)
+		ids = append(ids, id)
+	}
+	if rows.Err() != nil {
+		return nil, nil, rows.Err()
+	}
+
+	if filter.Limit > 0 && len(orders) > filter.Limit {
+		orders = orders[:filter.Limit]
+		last := filter.Limit - 1
+		return orders, &repository.Cursor{Time: orders[last].UploadedAt, ID: ids[last]}, nil
+	}
+
+	return orders, nil, nil
+}
+
+// GetOrder функция получения заказа пользователя по номеру,
+// возвращает nil, если заказ не найден или принадлежит другому пользователю
+func (s *Storage) GetOrder(ctx context.Context, userID int, orderNumber string) (*repository.OrderDetails, error) {
+	const sqlStmt = `
+    SELECT o.number, os.name, o.accrual + coalesce((select sum(amount) from balance_adjustments where order_id = o.id), 0),
+           o.uploaded_at, o.last_polled_at, o.next_poll_at
+    FROM orders o JOIN statuses os ON o.status_id = os.id
+    WHERE o.user_id = $1 AND o.number = $2
+`
+	var order repository.OrderDetails
+	var lastPolledAt, nextPollAt sql.NullTime
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, userID, orderNumber).
+		Scan(&order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt, &lastPolledAt, &nextPollAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if lastPolledAt.Valid {
+		order.LastPolledAt = &lastPolledAt.Time
+	}
+	if nextPollAt.Valid {
+		order.NextPollAt = &nextPollAt.Time
+	}
+
+	return &order, nil
+}
+
+// SetOrderPolled функция сохранения времени запроса заказа в систему начислений
+// и времени следующего запроса через nextPoll
+func (s *Storage) SetOrderPolled(ctx context.Context, orderNumber string, nextPoll time.Duration) error {
+	const sqlStmt = `
+    UPDATE orders SET last_polled_at = now(), next_poll_at = now() + make_interval(secs => $2)
+    WHERE number = $1
+`
+	_, err := s.DBConn.ExecContext(ctx, sqlStmt, orderNumber, nextPoll.Seconds())
+	return err
+}
+
+// ClaimOrdersForPoll функция получения номеров заказов, время следующего запроса в систему начислений
+// которых наступило, взятые заказы не выдаются другим воркерам и репликам на время lease
+func (s *Storage) ClaimOrdersForPoll(ctx context.Context, limit int, lease time.Duration) ([]string, error) {
+	const sqlStmt = `
+    UPDATE orders SET next_poll_at = now() + make_interval(secs => $2)
+    WHERE id IN (
+        SELECT id FROM orders
+        WHERE next_poll_at <= now() AND status_id IN (select id from statuses where name in ('NEW', 'PROCESSING'))
+        ORDER BY next_poll_at
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING number
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
 	}
-	return orders, nil
+	defer rows.Close()
+
+	var numbers []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, rows.Err()
 }
 
 // GetUserBalance функция получения сумм начислений и списаний пользователя
 func (s *Storage) GetUserBalance(ctx context.Context, userID int) (float64, float64, error) {
-	row := s.DBConn.QueryRowContext(ctx, "SELECT (select sum(amount) from withdrawals where user_id=users.id), (select sum(accrual) from orders where user_id=users.id) FROM users WHERE id = $1", userID)
+	const sqlStmt = `
+    SELECT (select sum(amount) from withdrawals where user_id = users.id),
+           coalesce((select sum(accrual) from orders where user_id = users.id), 0) +
+           coalesce((select sum(amount) from balance_adjustments where user_id = users.id), 0)
+    FROM users WHERE id = $1
+`
+	row := s.DBConn.QueryRowContext(ctx, sqlStmt, userID)
 	var withdrawals sql.NullFloat64
 	var accruals sql.NullFloat64
 
@@ -142,70 +496,212 @@ func (s *Storage) GetUserBalance(ctx context.Context, userID int) (float64, floa
 }
 
 // InsertWithdrawal функция сохранения в базе данных списания баланса пользователя
-func (s *Storage) InsertWithdrawal(ctx context.Context, orderNumber string, sum float64, userID int) error {
-	const sqlStmt = `
-    INSERT INTO withdrawals (number, amount, user_id) 
-    select $3, $2, id from users
-    where id = $1 and  coalesce((select sum(accrual) from orders where user_id=users.id),0) -
-                          coalesce((select sum(amount) from withdrawals where user_id=users.id),0) >= $2;
-`
-	tx, err := s.DBConn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+// с проверкой баланса и ограничений на списания в одной транзакции
+func (s *Storage) InsertWithdrawal(ctx context.Context, orderNumber string, sum float64, userID int, limits repository.WithdrawalLimits) error {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(ctx, sqlStmt)
+	// блокировка строки пользователя - параллельные списания одного пользователя выполняются последовательно,
+	// поэтому баланс и суммы списаний за период ниже читаются уже после завершения конкурирующих транзакций
+	var debtFlaggedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT debt_flagged_at FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&debtFlaggedAt)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	defer stmt.Close()
 
-	res, err := stmt.ExecContext(ctx, userID, sum, orderNumber)
-	if err != nil {
-		tx.Rollback()
+	// пока на счету есть задолженность после корректировки начислений - списания заблокированы
+	if debtFlaggedAt.Valid {
+		return repository.ErrNegativeBalance
+	}
+
+	// персональные ограничения пользователя имеют приоритет над глобальными
+	var maxSingle, maxDaily, maxWeekly, minBalance sql.NullFloat64
+	err = tx.QueryRowContext(ctx, "SELECT max_single, max_daily, max_weekly, min_balance FROM withdrawal_limits WHERE user_id = $1", userID).
+		Scan(&maxSingle, &maxDaily, &maxWeekly, &minBalance)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
+	limits.MaxSingle = nullFloatOr(maxSingle, limits.MaxSingle)
+	limits.MaxDaily = nullFloatOr(maxDaily, limits.MaxDaily)
+	limits.MaxWeekly = nullFloatOr(maxWeekly, limits.MaxWeekly)
+	limits.MinBalance = nullFloatOr(minBalance, limits.MinBalance)
 
-	err = tx.Commit()
+	const sqlStmt = `
+    SELECT ` + balanceSQL + `,
+           coalesce((select sum(amount) from withdrawals where user_id = $1 and processed_at > now() - interval '1 day'), 0),
+           coalesce((select sum(amount) from withdrawals where user_id = $1 and processed_at > now() - interval '7 days'), 0)
+`
+	var balance, withdrawnDay, withdrawnWeek float64
+	err = tx.QueryRowContext(ctx, sqlStmt, userID).Scan(&balance, &withdrawnDay, &withdrawnWeek)
 	if err != nil {
 		return err
 	}
 
-	affected, err := res.RowsAffected()
+	if balance < sum {
+		return repository.ErrInsufficientFunds
+	}
+
+	if limits.MaxSingle > 0 && sum > limits.MaxSingle {
+		return &repository.WithdrawalLimitError{Rule: repository.LimitRuleMaxSingle, Limit: limits.MaxSingle, Available: limits.MaxSingle}
+	}
+
+	if limits.MaxDaily > 0 && withdrawnDay+sum > limits.MaxDaily {
+		return &repository.WithdrawalLimitError{Rule: repository.LimitRuleMaxDaily, Limit: limits.MaxDaily, Available: max(limits.MaxDaily-withdrawnDay, 0)}
+	}
+
+	if limits.MaxWeekly > 0 && withdrawnWeek+sum > limits.MaxWeekly {
+		return &repository.WithdrawalLimitError{Rule: repository.LimitRuleMaxWeekly, Limit: limits.MaxWeekly, Available: max(limits.MaxWeekly-withdrawnWeek, 0)}
+	}
+
+	if limits.MinBalance > 0 && balance-sum < limits.MinBalance {
+		return &repository.WithdrawalLimitError{Rule: repository.LimitRuleMinBalance, Limit: limits.MinBalance, Available: max(balance-limits.MinBalance, 0)}
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO withdrawals (number, amount, user_id) VALUES ($1, $2, $3)", orderNumber, sum, userID)
 	if err != nil {
 		return err
 	}
 
-	if affected == 0 {
-		return sql.ErrNoRows
+	return tx.Commit()
+}
+
+// nullFloatOr возвращает значение из базы данных или значение по умолчанию, если в базе NULL
+func nullFloatOr(value sql.NullFloat64, def float64) float64 {
+	if value.Valid {
+		return value.Float64
 	}
+	return def
+}
 
-	return nil
+// SetUserWithdrawalLimits функция сохранения персональных ограничений на списания пользователя
+// с заменой ранее заданных, возвращает false, если пользователь не найден
+func (s *Storage) SetUserWithdrawalLimits(ctx context.Context, userID int, limits repository.UserWithdrawalLimits) (bool, error) {
+	const sqlStmt = `
+    INSERT INTO withdrawal_limits (user_id, max_single, max_daily, max_weekly, min_balance)
+    SELECT id, $2, $3, $4, $5 FROM users WHERE id = $1
+    ON CONFLICT (user_id) DO UPDATE
+    SET max_single = excluded.max_single, max_daily = excluded.max_daily,
+        max_weekly = excluded.max_weekly, min_balance = excluded.min_balance
+`
+	return s.execAffected(ctx, sqlStmt, userID, limits.MaxSingle, limits.MaxDaily, limits.MaxWeekly, limits.MinBalance)
+}
+
+// DeleteUserWithdrawalLimits функция удаления персональных ограничений на списания пользователя,
+// возвращает false, если ограничения не заданы
+func (s *Storage) DeleteUserWithdrawalLimits(ctx context.Context, userID int) (bool, error) {
+	return s.execAffected(ctx, "DELETE FROM withdrawal_limits WHERE user_id = $1", userID)
 }
 
 // GetWithdrawals функция получения списка списаний пользователя
 func (s *Storage) GetWithdrawals(ctx context.Context, userID int) ([]repository.WithdrawalsResult, error) {
-	rows, err := s.DBConn.QueryContext(ctx, "SELECT number, amount, processed_at FROM withdrawals WHERE user_id = $1 ORDER BY processed_at DESC", userID)
-	if err != nil {
-		return nil, err
+	withdrawals, _, err := s.GetWithdrawalsPage(ctx, userID, repository.WithdrawalsFilter{})
+	return withdrawals, err
+}
+
+// GetWithdrawalsPage функция постраничного получения списаний пользователя,
+// возвращает курсор следующей страницы или nil, если страница последняя
+func (s *Storage) GetWithdrawalsPage(ctx context.Context, userID int, filter repository.WithdrawalsFilter) ([]repository.WithdrawalsResult, *repository.Cursor, error) {
+	sqlStmt := "SELECT id, number, amount, processed_at FROM withdrawals WHERE user_id = $1"
+	args := []any{userID}
+
+	where, args := timeRangeCondition("processed_at", filter.From, filter.To, args)
+	sqlStmt += where
+
+	if filter.Cursor != nil {
+		args = append(args, filter.Cursor.Time, filter.Cursor.ID)
+		sqlStmt += fmt.Sprintf(" AND (processed_at, id) < ($%d, $%d)", len(args)-1, len(args))
 	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
+
+	sqlStmt += " ORDER BY processed_at DESC, id DESC"
+
+	// запрашивается на одну запись больше страницы, чтобы определить, есть ли следующая страница
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit+1)
+		sqlStmt += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, args...)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	var withdrawals []repository.WithdrawalsResult
+	var ids []int
 
 	for rows.Next() {
+		var id int
 		var withdrawal repository.WithdrawalsResult
-		err := rows.Scan(&withdrawal.OrderNumber, &withdrawal.Sum, &withdrawal.ProcessedAt)
+		err := rows.Scan(&id, &withdrawal.OrderNumber, &withdrawal.Sum, &withdrawal.ProcessedAt)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		withdrawals = append(withdrawals, withdrawal)
+		ids = append(ids, id)
 	}
-	return withdrawals, nil
+	if rows.Err() != nil {
+		return nil, nil, rows.Err()
+	}
+
+	if filter.Limit > 0 && len(withdrawals) > filter.Limit {
+		withdrawals = withdrawals[:filter.Limit]
+		last := filter.Limit - 1
+		return withdrawals, &repository.Cursor{Time: withdrawals[last].ProcessedAt, ID: ids[last]}, nil
+	}
+
+	return withdrawals, nil, nil
+}
+
+// GetWithdrawalsAggregates функция получения сумм списаний пользователя по периодам groupBy
+// в диапазоне времени [from, to), нулевое время - без ограничения
+func (s *Storage) GetWithdrawalsAggregates(ctx context.Context, userID int, groupBy string, from time.Time, to time.Time) ([]repository.WithdrawalsAggregate, error) {
+	periodFormat := "YYYY-MM-DD"
+	if groupBy == repository.GroupByMonth {
+		periodFormat = "YYYY-MM"
+	}
+
+	args := []any{userID, groupBy, periodFormat}
+	where, args := timeRangeCondition("processed_at", from, to, args)
+
+	sqlStmt := `
+    SELECT to_char(date_trunc($2, processed_at), $3), sum(amount), count(*)
+    FROM withdrawals WHERE user_id = $1` + where + `
+    GROUP BY date_trunc($2, processed_at)
+    ORDER BY date_trunc($2, processed_at) DESC`
+
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aggregates []repository.WithdrawalsAggregate
+	for rows.Next() {
+		var aggregate repository.WithdrawalsAggregate
+		if err := rows.Scan(&aggregate.Period, &aggregate.Sum, &aggregate.Count); err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, rows.Err()
+}
+
+// timeRangeCondition функция построения условия на диапазон времени [from, to) по столбцу column,
+// возвращает условие и аргументы запроса с добавленными границами
+func timeRangeCondition(column string, from time.Time, to time.Time, args []any) (string, []any) {
+	where := ""
+	if !from.IsZero() {
+		args = append(args, from)
+		where += fmt.Sprintf(" AND %s >= $%d", column, len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		where += fmt.Sprintf(" AND %s < $%d", column, len(args))
+	}
+	return where, args
 }
 
 // SetOrderStatusAccrual функция установления статуса заказа и суммы начислений
@@ -216,6 +712,148 @@ func (s *Storage) SetOrderStatusAccrual(ctx context.Context, orderNumber string,
 		return err
 	}
 
-	_, err = s.DBConn.ExecContext(ctx, "UPDATE orders SET status_id = $1, accrual = $2 WHERE number = $3", statusID, accrual, orderNumber)
+	// для окончательных статусов запоминается время завершения расчета - от него отсчитывается окно сверки,
+	// следующий запрос в систему начислений планируется только для заказа в расчете, опрос заказов
+	// с окончательным статусом и заказов NEW, не известных системе начислений, прекращается,
+	// заказ может одновременно обрабатываться воркером канала и воркером очереди опроса,
+	// поэтому окончательный статус не заменяется промежуточным
+	const sqlStmt = `
+    UPDATE orders SET status_id = $1, accrual = $2,
+                      processed_at = CASE WHEN $4 THEN now() ELSE NULL END,
+                      next_poll_at = CASE WHEN $5 THEN next_poll_at ELSE NULL END
+    WHERE number = $3 AND ($4 OR status_id IN (select id from statuses where name in ('NEW', 'PROCESSING')))
+    RETURNING coalesce(user_id, 0)
+`
+	var userID int
+	err = s.DBConn.QueryRowContext(ctx, sqlStmt, statusID, accrual, orderNumber, isFinalStatus(status), status == "PROCESSING").Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.refreshDebtFlag(ctx, s.DBConn, userID)
+}
+
+// GetUserDebtFlag функция получения признака задолженности пользователя
+func (s *Storage) GetUserDebtFlag(ctx context.Context, userID int) (bool, error) {
+	var debtFlaggedAt sql.NullTime
+	err := s.DBConn.QueryRowContext(ctx, "SELECT debt_flagged_at FROM users WHERE id = $1", userID).Scan(&debtFlaggedAt)
+	if err != nil {
+		return false, err
+	}
+	return debtFlaggedAt.Valid, nil
+}
+
+// GetOrdersForReconcile функция получения номеров завершенных в пределах window заказов,
+// которые не сверялись с системой начислений дольше interval
+func (s *Storage) GetOrdersForReconcile(ctx context.Context, window time.Duration, interval time.Duration, limit int) ([]string, error) {
+	const sqlStmt = `
+    SELECT number FROM orders
+    WHERE status_id IN (select id from statuses where name in ('INVALID', 'PROCESSED'))
+      AND processed_at > now() - make_interval(secs => $1)
+      AND (reconciled_at IS NULL OR reconciled_at < now() - make_interval(secs => $2))
+    ORDER BY reconciled_at NULLS FIRST, processed_at
+    LIMIT $3
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, window.Seconds(), interval.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var numbers []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, rows.Err()
+}
+
+// SetOrderReconciled функция отметки попытки сверки заказа без изменения начислений,
+// чтобы заказ, по которому система начислений не дала окончательного ответа, не задерживал очередь сверки
+func (s *Storage) SetOrderReconciled(ctx context.Context, orderNumber string) error {
+	_, err := s.DBConn.ExecContext(ctx, "UPDATE orders SET reconciled_at = now() WHERE number = $1", orderNumber)
 	return err
 }
+
+// ReconcileOrder функция сверки заказа с актуальными данными системы начислений,
+// записывает корректировку баланса на разницу начислений и возвращает ее сумму
+func (s *Storage) ReconcileOrder(ctx context.Context, orderNumber string, status string, accrual float64) (float64, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// начисление, учтенное в балансе: исходное начисление и ранее записанные корректировки сверки
+	const selectStmt = `
+    SELECT o.id, o.user_id, os.name,
+           o.accrual + coalesce((select sum(amount) from balance_adjustments where order_id = o.id and source = $2), 0)
+    FROM orders o JOIN statuses os ON o.status_id = os.id
+    WHERE o.number = $1
+    FOR UPDATE OF o
+`
+	var orderID int
+	var userID sql.NullInt64
+	var oldStatus string
+	var booked float64
+	err = tx.QueryRowContext(ctx, selectStmt, orderNumber, repository.AdjustmentSourceReconcile).Scan(&orderID, &userID, &oldStatus, &booked)
+	if err != nil {
+		return 0, err
+	}
+
+	delta := math.Round((accrual-booked)*100) / 100
+	if delta != 0 {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO balance_adjustments (user_id, order_id, amount, source, reason) VALUES ($1, $2, $3, $4, $5)",
+			userID, orderID, delta, repository.AdjustmentSourceReconcile,
+			fmt.Sprintf("пересмотр начисления: %s %.2f -> %s %.2f", oldStatus, booked, status, accrual),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	const updateStmt = `
+    UPDATE orders SET status_id = (select id from statuses where name = $2), reconciled_at = now(), last_polled_at = now()
+    WHERE id = $1
+`
+	_, err = tx.ExecContext(ctx, updateStmt, orderID, status)
+	if err != nil {
+		return 0, err
+	}
+
+	if delta != 0 && userID.Valid {
+		err = s.refreshDebtFlag(ctx, tx, int(userID.Int64))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return delta, tx.Commit()
+}
+
+// execer общий интерфейс подключения к базе данных и транзакции
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// refreshDebtFlag функция установки или снятия признака задолженности пользователя по текущему балансу
+func (s *Storage) refreshDebtFlag(ctx context.Context, conn execer, userID int) error {
+	const sqlStmt = `
+    UPDATE users SET debt_flagged_at = CASE WHEN ` + balanceSQL + ` < 0 THEN coalesce(debt_flagged_at, now()) END
+    WHERE id = $1
+`
+	_, err := conn.ExecContext(ctx, sqlStmt, userID)
+	return err
+}
+
+// isFinalStatus проверка, является ли статус расчета начислений окончательным
+func isFinalStatus(status string) bool {
+	return status == "INVALID" || status == "PROCESSED"
+}
@@ -0,0 +1,75 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// CheckSecondFactorLockout функция проверки блокировки проверок второго фактора пользователя,
+// возвращает оставшееся время блокировки, 0 - проверка разрешена
+func (s *Storage) CheckSecondFactorLockout(ctx context.Context, userID int) (time.Duration, error) {
+	var seconds float64
+	const sqlStmt = `
+    SELECT coalesce(extract(epoch FROM max(locked_until) - now()), 0)
+    FROM second_factor_lockouts
+    WHERE user_id = $1 AND locked_until > now()
+`
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, userID).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// RecordSecondFactorFailure функция учета неудачной проверки второго фактора пользователя:
+// при превышении порога проверки блокируются с удвоением блокировки на каждую следующую неудачу,
+// возвращает установленное время блокировки
+func (s *Storage) RecordSecondFactorFailure(ctx context.Context, userID int, policy repository.SecondFactorLockoutPolicy) (time.Duration, error) {
+	if policy.Threshold <= 0 {
+		return 0, nil
+	}
+
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// счетчик сбрасывается, если предыдущая неудача была раньше окна ResetAfter
+	const upsertStmt = `
+    INSERT INTO second_factor_lockouts (user_id, failures, last_failure_at) VALUES ($1, 1, now())
+    ON CONFLICT (user_id) DO UPDATE SET
+        failures = CASE WHEN second_factor_lockouts.last_failure_at < now() - make_interval(secs => $2) THEN 1 ELSE second_factor_lockouts.failures + 1 END,
+        last_failure_at = now()
+    RETURNING failures
+`
+	var failures int
+	err = tx.QueryRowContext(ctx, upsertStmt, userID, policy.ResetAfter.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	if failures < policy.Threshold {
+		return 0, tx.Commit()
+	}
+
+	lockout := lockoutDuration(policy.BaseLockout, policy.MaxLockout, failures-policy.Threshold)
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE second_factor_lockouts SET locked_until = now() + make_interval(secs => $2) WHERE user_id = $1",
+		userID, lockout.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return lockout, tx.Commit()
+}
+
+// ResetSecondFactorFailures функция сброса счетчика неудачных проверок второго фактора после успешной проверки
+func (s *Storage) ResetSecondFactorFailures(ctx context.Context, userID int) error {
+	_, err := s.DBConn.ExecContext(ctx, "DELETE FROM second_factor_lockouts WHERE user_id = $1", userID)
+	return err
+}
@@ -0,0 +1,215 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// CreateRefreshToken функция создания семьи токенов - сессии session пользователя с первым refresh токеном,
+// хранится только хэш токена
+func (s *Storage) CreateRefreshToken(ctx context.Context, userID int, session repository.Session, tokenHash string, ttl time.Duration) error {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO token_families (id, user_id, device, ip, user_agent) VALUES ($1, $2, $3, $4, $5)",
+		session.ID, userID, session.Device, session.IP, session.UserAgent,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertRefreshToken(ctx, tx, session.ID, tokenHash, ttl)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RotateRefreshToken функция замены refresh токена oldHash на newHash в той же семье,
+// возвращает пользователя и семью токенов, при повторном использовании токена
+// отзывает всю семью и возвращает ErrRefreshTokenReused
+func (s *Storage) RotateRefreshToken(ctx context.Context, oldHash string, newHash string, ttl time.Duration) (int, string, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var tokenID int64
+	var userID int
+	var familyID string
+	var used, revoked, expired bool
+	const selectStmt = `
+    SELECT t.id, f.user_id, f.id, t.used_at IS NOT NULL, f.revoked_at IS NOT NULL, t.expires_at <= now()
+    FROM refresh_tokens t JOIN token_families f ON t.family_id = f.id
+    WHERE t.token_hash = $1
+    FOR UPDATE OF t, f
+`
+	err = tx.QueryRowContext(ctx, selectStmt, oldHash).Scan(&tokenID, &userID, &familyID, &used, &revoked, &expired)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", repository.ErrRefreshTokenInvalid
+		}
+		return 0, "", err
+	}
+
+	if revoked {
+		return 0, "", repository.ErrRefreshTokenInvalid
+	}
+
+	// токен уже был заменен - возможна кража токена, отзываем вход целиком
+	if used {
+		_, err = tx.ExecContext(ctx, "UPDATE token_families SET revoked_at = now() WHERE id = $1", familyID)
+		if err != nil {
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return userID, familyID, repository.ErrRefreshTokenReused
+	}
+
+	if expired {
+		return 0, "", repository.ErrRefreshTokenInvalid
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = now() WHERE id = $1", tokenID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE token_families SET last_seen_at = now() WHERE id = $1", familyID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = insertRefreshToken(ctx, tx, familyID, newHash, ttl)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return userID, familyID, tx.Commit()
+}
+
+// RevokeTokenFamily функция отзыва семьи токенов
+func (s *Storage) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	_, err := s.DBConn.ExecContext(ctx, "UPDATE token_families SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", familyID)
+	return err
+}
+
+// RevokeRefreshToken функция отзыва семьи токенов по refresh токену,
+// возвращает отозванную семью или пустую строку, если токен не найден
+func (s *Storage) RevokeRefreshToken(ctx context.Context, tokenHash string) (string, error) {
+	var familyID string
+	const sqlStmt = `
+    UPDATE token_families SET revoked_at = coalesce(revoked_at, now())
+    WHERE id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)
+    RETURNING id
+`
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, tokenHash).Scan(&familyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return familyID, nil
+}
+
+// TouchSession функция проверки, что сессия familyID не отозвана, с отметкой времени запроса,
+// время обновляется не чаще interval, чтобы не записывать строку на каждый запрос,
+// неизвестная сессия считается отозванной
+func (s *Storage) TouchSession(ctx context.Context, familyID string, interval time.Duration) (bool, error) {
+	const sqlStmt = `
+    WITH touched AS (
+        UPDATE token_families SET last_seen_at = now()
+        WHERE id = $1 AND revoked_at IS NULL AND last_seen_at < now() - make_interval(secs => $2)
+    )
+    SELECT revoked_at IS NULL FROM token_families WHERE id = $1
+`
+	var active bool
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, familyID, interval.Seconds()).Scan(&active)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return active, nil
+}
+
+// GetSessions функция получения действующих сессий пользователя: не отозванных и с неистекшим refresh токеном,
+// последние активные - первыми
+func (s *Storage) GetSessions(ctx context.Context, userID int) ([]repository.Session, error) {
+	const sqlStmt = `
+    SELECT f.id, f.device, f.ip, f.user_agent, f.created_at, f.last_seen_at
+    FROM token_families f
+    WHERE f.user_id = $1 AND f.revoked_at IS NULL
+      AND EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.family_id = f.id AND t.used_at IS NULL AND t.expires_at > now())
+    ORDER BY f.last_seen_at DESC, f.created_at DESC
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []repository.Session
+	for rows.Next() {
+		var session repository.Session
+		if err := rows.Scan(&session.ID, &session.Device, &session.IP, &session.UserAgent, &session.CreatedAt, &session.LastSeenAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession функция отзыва сессии пользователя, возвращает false, если сессия не найдена или уже отозвана
+func (s *Storage) RevokeSession(ctx context.Context, userID int, familyID string) (bool, error) {
+	return s.execAffected(ctx, "UPDATE token_families SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", familyID, userID)
+}
+
+// RevokeOtherSessions функция отзыва всех сессий пользователя, кроме keepFamilyID
+func (s *Storage) RevokeOtherSessions(ctx context.Context, userID int, keepFamilyID string) error {
+	_, err := s.DBConn.ExecContext(
+		ctx,
+		"UPDATE token_families SET revoked_at = now() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL",
+		userID, keepFamilyID,
+	)
+	return err
+}
+
+// IsSessionFresh функция проверки, что действующая сессия familyID пользователя начата не ранее maxAge назад:
+// семья токенов создается при входе и сохраняется при обновлении токенов, поэтому ее время создания - время входа
+func (s *Storage) IsSessionFresh(ctx context.Context, userID int, familyID string, maxAge time.Duration) (bool, error) {
+	const sqlStmt = `
+    SELECT EXISTS (
+        SELECT 1 FROM token_families
+        WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND created_at >= now() - make_interval(secs => $3)
+    )
+`
+	var fresh bool
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, familyID, userID, maxAge.Seconds()).Scan(&fresh)
+	return fresh, err
+}
+
+// insertRefreshToken добавление хэша refresh токена в семью токенов
+func insertRefreshToken(ctx context.Context, tx *sql.Tx, familyID string, tokenHash string, ttl time.Duration) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO refresh_tokens (family_id, token_hash, expires_at) VALUES ($1, $2, now() + make_interval(secs => $3))",
+		familyID, tokenHash, ttl.Seconds(),
+	)
+	return err
+}
@@ -0,0 +1,166 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// SaveTOTPSecret функция сохранения неподтвержденного секрета TOTP пользователя, заменяет прежний неподтвержденный секрет,
+// возвращает ErrTOTPEnabled, если двухфакторная аутентификация уже подключена
+func (s *Storage) SaveTOTPSecret(ctx context.Context, userID int, secret string) error {
+	const sqlStmt = `
+    INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = now()
+    WHERE user_totp.enabled_at IS NULL
+    RETURNING user_id
+`
+	var savedUserID int
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, userID, secret).Scan(&savedUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrTOTPEnabled
+	}
+	return err
+}
+
+// GetTOTP функция получения секрета TOTP пользователя, возвращает nil, если секрета нет
+func (s *Storage) GetTOTP(ctx context.Context, userID int) (*repository.TOTPState, error) {
+	var state repository.TOTPState
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"SELECT secret, enabled_at IS NOT NULL, last_step FROM user_totp WHERE user_id = $1",
+		userID,
+	).Scan(&state.Secret, &state.Enabled, &state.LastStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &state, nil
+}
+
+// EnableTOTP функция подтверждения подключения TOTP с принятым шагом времени и заменой кодов восстановления,
+// возвращает ErrTOTPEnabled, если двухфакторная аутентификация уже подключена
+func (s *Storage) EnableTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE user_totp SET enabled_at = now(), last_step = $2 WHERE user_id = $1 AND enabled_at IS NULL", userID, step)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return repository.ErrTOTPEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep функция отметки шага времени принятого кода, возвращает false, если код этого
+// или более позднего шага уже использован
+func (s *Storage) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	return s.execAffected(ctx, "UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND enabled_at IS NOT NULL AND last_step < $2", userID, step)
+}
+
+// UseRecoveryCode функция однократного использования кода восстановления по хэшу,
+// возвращает false, если код не найден или использован
+func (s *Storage) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	return s.execAffected(ctx, "UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userID, codeHash)
+}
+
+// DisableTOTP функция отключения двухфакторной аутентификации с удалением секрета и кодов восстановления
+func (s *Storage) DisableTOTP(ctx context.Context, userID int) error {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateLoginChallenge функция сохранения входа, ожидающего второго фактора, по хэшу токена на время ttl,
+// истекшие входы удаляются
+func (s *Storage) CreateLoginChallenge(ctx context.Context, userID int, tokenHash string, ttl time.Duration) error {
+	_, err := s.DBConn.ExecContext(ctx, "DELETE FROM login_challenges WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DBConn.ExecContext(
+		ctx,
+		"INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, now() + make_interval(secs => $3))",
+		tokenHash, userID, ttl.Seconds(),
+	)
+	return err
+}
+
+// CheckLoginChallenge функция учета попытки ввода второго фактора по хэшу токена входа,
+// возвращает 0, если вход не найден, истек или попытки исчерпаны
+func (s *Storage) CheckLoginChallenge(ctx context.Context, tokenHash string, maxAttempts int) (int, error) {
+	var userID int
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = $1 AND expires_at > now() AND attempts < $2 RETURNING user_id",
+		tokenHash, maxAttempts,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// DeleteLoginChallenge функция удаления завершенного входа
+func (s *Storage) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	_, err := s.DBConn.ExecContext(ctx, "DELETE FROM login_challenges WHERE token_hash = $1", tokenHash)
+	return err
+}
+
+// execAffected выполнение изменяющего запроса, возвращает true, если запрос изменил хотя бы одну запись
+func (s *Storage) execAffected(ctx context.Context, query string, args ...any) (bool, error) {
+	result, err := s.DBConn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
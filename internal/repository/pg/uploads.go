@@ -0,0 +1,263 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// классы рекомендательных блокировок загрузки заказов пользователем и с IP-адреса
+const (
+	uploadLockUser = 1
+	uploadLockIP   = 2
+)
+
+// CheckOrderUploads функция проверки возможности загрузки count заказов пользователем с IP-адреса ip:
+// возвращает действующую блокировку или превышение частоты загрузок, nil - загрузка разрешена,
+// разрешенная загрузка резервирует count записей журнала, которые затем заполняет RecordOrderUploads
+func (s *Storage) CheckOrderUploads(ctx context.Context, userID int, ip string, count int, policy repository.UploadAbusePolicy) (*repository.UploadBlock, error) {
+	var block repository.UploadBlock
+	const blockStmt = `
+    SELECT reason, blocked_until FROM upload_blocks
+    WHERE (user_id = $1 OR ip = $2) AND blocked_until > now()
+    ORDER BY blocked_until DESC
+    LIMIT 1
+`
+	err := s.DBConn.QueryRowContext(ctx, blockStmt, userID, ip).Scan(&block.Reason, &block.Until)
+	if err == nil {
+		return &block, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if policy.Window <= 0 {
+		return nil, nil
+	}
+
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// подсчет и резервирование выполняются под блокировкой пользователя и IP-адреса до конца транзакции,
+	// поэтому параллельные запросы не проходят проверку по одному и тому же количеству загрузок,
+	// блокировки берутся в одном порядке во всех запросах
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)", uploadLockUser, userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", uploadLockIP, ip); err != nil {
+		return nil, err
+	}
+
+	// частота загрузок считается по количеству номеров заказов за окно,
+	// ограничение снимается, когда самая ранняя загрузка выходит за пределы окна
+	const velocityStmt = `
+    SELECT count(*), coalesce(min(created_at), now()) + make_interval(secs => $2)
+    FROM order_upload_attempts
+    WHERE %s = $1 AND created_at > now() - make_interval(secs => $2)
+`
+	rules := []struct {
+		column string
+		value  any
+		limit  int
+		reason string
+	}{
+		{"user_id", userID, policy.MaxPerUser, repository.UploadBlockUserVelocity},
+		{"ip", ip, policy.MaxPerIP, repository.UploadBlockIPVelocity},
+	}
+
+	for _, rule := range rules {
+		if rule.limit <= 0 {
+			continue
+		}
+
+		var uploaded int
+		var until time.Time
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(velocityStmt, rule.column), rule.value, policy.Window.Seconds()).Scan(&uploaded, &until)
+		if err != nil {
+			return nil, err
+		}
+
+		if uploaded+count > rule.limit {
+			return &repository.UploadBlock{Reason: rule.reason, Until: until}, nil
+		}
+	}
+
+	const reserveStmt = `
+    INSERT INTO order_upload_attempts (user_id, ip, order_number, result)
+    SELECT $1, $2, '', 'pending' FROM generate_series(1, $3)
+`
+	_, err = tx.ExecContext(ctx, reserveStmt, userID, ip, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
+}
+
+// RecordOrderUploads функция записи результатов загрузки заказов в зарезервированные при проверке записи журнала
+// и проверки долей конфликтов и некорректных номеров по пользователю и IP-адресу,
+// возвращает блокировку, если она была установлена по результатам проверки
+func (s *Storage) RecordOrderUploads(ctx context.Context, userID int, ip string, numbers []string, results []string, policy repository.UploadAbusePolicy) (*repository.UploadBlock, error) {
+	tx, err := s.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const fillStmt = `
+    UPDATE order_upload_attempts SET order_number = $3, result = $4
+    WHERE id = (
+        SELECT id FROM order_upload_attempts
+        WHERE user_id = $1 AND ip = $2 AND result = 'pending'
+        ORDER BY id
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED
+    )
+`
+	const insertStmt = "INSERT INTO order_upload_attempts (user_id, ip, order_number, result) VALUES ($1, $2, $3, $4)"
+
+	// без резерва, например при отключенном ограничении частоты, запись добавляется в журнал
+	for i, number := range numbers {
+		result, err := tx.ExecContext(ctx, fillStmt, userID, ip, number, results[i])
+		if err != nil {
+			return nil, err
+		}
+		filled, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if filled > 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, insertStmt, userID, ip, number, results[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.RatioWindow <= 0 || policy.BlockDuration <= 0 {
+		return nil, tx.Commit()
+	}
+
+	const statsStmt = `
+    SELECT count(*),
+           count(*) FILTER (WHERE result = 'conflict'),
+           count(*) FILTER (WHERE result = 'invalid')
+    FROM order_upload_attempts
+    WHERE %s = $1 AND created_at > now() - make_interval(secs => $2) AND result <> 'pending'
+`
+	const blockStmt = `
+    INSERT INTO upload_blocks (user_id, ip, reason, blocked_until)
+    VALUES ($1, $2, $3, now() + make_interval(secs => $4))
+    RETURNING blocked_until
+`
+	// при превышении долей по пользователю блокируется пользователь, по IP-адресу - адрес
+	scopes := []struct {
+		column string
+		value  any
+		userID sql.NullInt64
+		ip     sql.NullString
+	}{
+		{"user_id", userID, sql.NullInt64{Int64: int64(userID), Valid: true}, sql.NullString{}},
+		{"ip", ip, sql.NullInt64{}, sql.NullString{String: ip, Valid: true}},
+	}
+
+	var block *repository.UploadBlock
+	for _, scope := range scopes {
+		var attempts, conflicts, invalid int
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(statsStmt, scope.column), scope.value, policy.RatioWindow.Seconds()).Scan(&attempts, &conflicts, &invalid)
+		if err != nil {
+			return nil, err
+		}
+
+		if attempts == 0 || attempts < policy.MinAttempts {
+			continue
+		}
+
+		reason := ""
+		switch {
+		case policy.MaxConflictRatio > 0 && float64(conflicts)/float64(attempts) > policy.MaxConflictRatio:
+			reason = repository.UploadBlockConflicts
+		case policy.MaxInvalidRatio > 0 && float64(invalid)/float64(attempts) > policy.MaxInvalidRatio:
+			reason = repository.UploadBlockInvalid
+		default:
+			continue
+		}
+
+		var until time.Time
+		err = tx.QueryRowContext(ctx, blockStmt, scope.userID, scope.ip, reason, policy.BlockDuration.Seconds()).Scan(&until)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			block = &repository.UploadBlock{Reason: reason, Until: until}
+		}
+	}
+
+	return block, tx.Commit()
+}
+
+// PurgeOrderUploadAttempts функция удаления записей журнала загрузок заказов старше retention,
+// возвращает количество удаленных записей
+func (s *Storage) PurgeOrderUploadAttempts(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := s.DBConn.ExecContext(
+		ctx,
+		"DELETE FROM order_upload_attempts WHERE created_at < now() - make_interval(secs => $1)",
+		retention.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetUploadAbuseReport функция получения статистики загрузок заказов за window по пользователям
+// с конфликтами, некорректными номерами или блокировками, наиболее подозрительные - первыми
+func (s *Storage) GetUploadAbuseReport(ctx context.Context, window time.Duration, limit int) ([]repository.UploadAbuseReport, error) {
+	const sqlStmt = `
+    SELECT u.id, u.login, a.attempts, a.accepted, a.conflicts, a.invalid, a.ips,
+           (SELECT max(blocked_until) FROM upload_blocks b WHERE b.user_id = u.id AND b.blocked_until > now())
+    FROM (
+        SELECT user_id,
+               count(*) AS attempts,
+               count(*) FILTER (WHERE result = 'accepted') AS accepted,
+               count(*) FILTER (WHERE result = 'conflict') AS conflicts,
+               count(*) FILTER (WHERE result = 'invalid') AS invalid,
+               count(DISTINCT ip) AS ips
+        FROM order_upload_attempts
+        WHERE created_at > now() - make_interval(secs => $1) AND result <> 'pending'
+        GROUP BY user_id
+    ) a JOIN users u ON a.user_id = u.id
+    WHERE a.conflicts + a.invalid > 0
+       OR EXISTS (SELECT 1 FROM upload_blocks b WHERE b.user_id = u.id AND b.blocked_until > now())
+    ORDER BY (a.conflicts + a.invalid)::float / a.attempts DESC, a.attempts DESC
+    LIMIT $2
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, window.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var report []repository.UploadAbuseReport
+	for rows.Next() {
+		var item repository.UploadAbuseReport
+		var blockedUntil sql.NullTime
+		err := rows.Scan(&item.UserID, &item.Login, &item.Attempts, &item.Accepted, &item.Conflicts, &item.Invalid, &item.IPs, &blockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if blockedUntil.Valid {
+			item.BlockedUntil = &blockedUntil.Time
+		}
+		report = append(report, item)
+	}
+
+	return report, rows.Err()
+}
@@ -0,0 +1,140 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SaveWebAuthnChallenge функция сохранения начатой церемонии WebAuthn по хэшу вызова на время ttl,
+// истекшие церемонии удаляются
+func (s *Storage) SaveWebAuthnChallenge(ctx context.Context, challengeHash string, challenge repository.WebAuthnChallenge, ttl time.Duration) error {
+	_, err := s.DBConn.ExecContext(ctx, "DELETE FROM webauthn_challenges WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DBConn.ExecContext(
+		ctx,
+		"INSERT INTO webauthn_challenges (challenge_hash, ceremony, user_id, expires_at) VALUES ($1, $2, $3, now() + make_interval(secs => $4))",
+		challengeHash, challenge.Ceremony, sql.NullInt64{Int64: int64(challenge.UserID), Valid: challenge.UserID > 0}, ttl.Seconds(),
+	)
+	return err
+}
+
+// TakeWebAuthnChallenge функция однократного получения начатой церемонии по хэшу вызова,
+// возвращает nil, если церемония не найдена, истекла или другого типа
+func (s *Storage) TakeWebAuthnChallenge(ctx context.Context, challengeHash string, ceremony string) (*repository.WebAuthnChallenge, error) {
+	challenge := repository.WebAuthnChallenge{Ceremony: ceremony}
+	var userID sql.NullInt64
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"DELETE FROM webauthn_challenges WHERE challenge_hash = $1 AND ceremony = $2 AND expires_at > now() RETURNING user_id",
+		challengeHash, ceremony,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	challenge.UserID = int(userID.Int64)
+	return &challenge, nil
+}
+
+// CreateWebAuthnCredential функция сохранения ключа доступа пользователя,
+// возвращает ErrCredentialExists, если ключ уже зарегистрирован
+func (s *Storage) CreateWebAuthnCredential(ctx context.Context, credential repository.WebAuthnCredential) (*repository.WebAuthnCredential, error) {
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		credential.UserID, credential.CredentialID, credential.PublicKey, int64(credential.SignCount), credential.Name,
+	).Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, repository.ErrCredentialExists
+		}
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// GetWebAuthnCredentials функция получения ключей доступа пользователя
+func (s *Storage) GetWebAuthnCredentials(ctx context.Context, userID int) ([]repository.WebAuthnCredential, error) {
+	const sqlStmt = `
+    SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+    FROM webauthn_credentials WHERE user_id = $1 ORDER BY id
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []repository.WebAuthnCredential
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *credential)
+	}
+	return credentials, rows.Err()
+}
+
+// GetWebAuthnCredential функция получения ключа доступа по идентификатору ключа аутентификатора,
+// возвращает nil, если ключ не найден
+func (s *Storage) GetWebAuthnCredential(ctx context.Context, credentialID string) (*repository.WebAuthnCredential, error) {
+	const sqlStmt = `
+    SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+    FROM webauthn_credentials WHERE credential_id = $1
+`
+	credential, err := scanWebAuthnCredential(s.DBConn.QueryRowContext(ctx, sqlStmt, credentialID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return credential, nil
+}
+
+// UpdateWebAuthnSignCount функция сохранения счетчика подписей после входа с отметкой времени использования,
+// счетчик должен расти, кроме аутентификаторов без счетчика, всегда передающих 0, возвращает false,
+// если счетчик не больше сохраненного, например, при параллельном входе копией ключа
+func (s *Storage) UpdateWebAuthnSignCount(ctx context.Context, id int, signCount uint32) (bool, error) {
+	return s.execAffected(
+		ctx,
+		"UPDATE webauthn_credentials SET sign_count = $2, last_used_at = now() WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))",
+		id, int64(signCount),
+	)
+}
+
+// DeleteWebAuthnCredential функция удаления ключа доступа пользователя, возвращает false, если ключ не найден
+func (s *Storage) DeleteWebAuthnCredential(ctx context.Context, userID int, id int) (bool, error) {
+	return s.execAffected(ctx, "DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2", id, userID)
+}
+
+// scanWebAuthnCredential чтение ключа доступа из строки результата запроса
+func scanWebAuthnCredential(row interface{ Scan(dest ...any) error }) (*repository.WebAuthnCredential, error) {
+	var credential repository.WebAuthnCredential
+	var signCount int64
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&credential.ID, &credential.UserID, &credential.CredentialID, &credential.PublicKey,
+		&signCount, &credential.Name, &credential.CreatedAt, &lastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	credential.SignCount = uint32(signCount)
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = &lastUsedAt.Time
+	}
+	return &credential, nil
+}
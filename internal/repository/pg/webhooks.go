@@ -0,0 +1,187 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/repository"
+)
+
+// CreateWebhook функция сохранения вебхука пользователя
+func (s *Storage) CreateWebhook(ctx context.Context, userID int, url string, secret string, eventTypes []string) (*repository.Webhook, error) {
+	webhook := repository.Webhook{URL: url, Secret: secret, EventTypes: eventTypes}
+	err := s.DBConn.QueryRowContext(
+		ctx,
+		"INSERT INTO webhooks (user_id, url, secret, event_types) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		userID, url, secret, eventTypes,
+	).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// GetWebhooks функция получения вебхуков пользователя без секретов
+func (s *Storage) GetWebhooks(ctx context.Context, userID int) ([]repository.Webhook, error) {
+	rows, err := s.DBConn.QueryContext(ctx, "SELECT id, url, array_to_string(event_types, ','), created_at FROM webhooks WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []repository.Webhook
+	for rows.Next() {
+		var webhook repository.Webhook
+		var eventTypes string
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &eventTypes, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhook.EventTypes = strings.Split(eventTypes, ",")
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook функция удаления вебхука пользователя, возвращает false, если вебхук не найден
+func (s *Storage) DeleteWebhook(ctx context.Context, userID int, webhookID int) (bool, error) {
+	res, err := s.DBConn.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1 AND user_id = $2", webhookID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// GetWebhookDeliveries функция получения последних limit доставок вебхука пользователя,
+// возвращает false, если вебхук не найден
+func (s *Storage) GetWebhookDeliveries(ctx context.Context, userID int, webhookID int, limit int) ([]repository.WebhookDelivery, bool, error) {
+	var ownerID int
+	err := s.DBConn.QueryRowContext(ctx, "SELECT user_id FROM webhooks WHERE id = $1", webhookID).Scan(&ownerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if ownerID != userID {
+		return nil, false, nil
+	}
+
+	const sqlStmt = `
+    SELECT id, event_type, status, attempts, last_status_code, last_error,
+           CASE WHEN status = 'pending' THEN next_attempt_at END, redelivery_of, created_at, delivered_at
+    FROM webhook_deliveries
+    WHERE webhook_id = $1
+    ORDER BY created_at DESC, id DESC
+    LIMIT $2
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, webhookID, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var deliveries []repository.WebhookDelivery
+	for rows.Next() {
+		var delivery repository.WebhookDelivery
+		var lastStatusCode, redeliveryOf sql.NullInt64
+		var lastError sql.NullString
+		var nextAttemptAt, deliveredAt sql.NullTime
+		err := rows.Scan(&delivery.ID, &delivery.EventType, &delivery.Status, &delivery.Attempts, &lastStatusCode, &lastError,
+			&nextAttemptAt, &redeliveryOf, &delivery.CreatedAt, &deliveredAt)
+		if err != nil {
+			return nil, false, err
+		}
+
+		delivery.LastStatusCode = int(lastStatusCode.Int64)
+		delivery.LastError = lastError.String
+		delivery.RedeliveryOf = int(redeliveryOf.Int64)
+		if nextAttemptAt.Valid {
+			delivery.NextAttemptAt = &nextAttemptAt.Time
+		}
+		if deliveredAt.Valid {
+			delivery.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, true, rows.Err()
+}
+
+// RedeliverWebhookDelivery функция постановки в очередь повторной доставки с тем же содержимым,
+// возвращает ID новой доставки или 0, если исходная доставка не найдена
+func (s *Storage) RedeliverWebhookDelivery(ctx context.Context, userID int, webhookID int, deliveryID int) (int, error) {
+	const sqlStmt = `
+    INSERT INTO webhook_deliveries (webhook_id, event_type, payload, redelivery_of)
+    SELECT d.webhook_id, d.event_type, d.payload, d.id
+    FROM webhook_deliveries d JOIN webhooks w ON d.webhook_id = w.id
+    WHERE d.id = $1 AND w.id = $2 AND w.user_id = $3
+    RETURNING id
+`
+	var newID int
+	err := s.DBConn.QueryRowContext(ctx, sqlStmt, deliveryID, webhookID, userID).Scan(&newID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return newID, nil
+}
+
+// ClaimWebhookDeliveries функция взятия в работу до limit доставок, время отправки которых наступило,
+// взятые доставки не выдаются другим экземплярам сервиса в течение lease
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]repository.PendingDelivery, error) {
+	const sqlStmt = `
+    UPDATE webhook_deliveries d SET next_attempt_at = now() + make_interval(secs => $2)
+    FROM webhooks w
+    WHERE d.webhook_id = w.id AND d.id IN (
+        SELECT id FROM webhook_deliveries
+        WHERE status = 'pending' AND next_attempt_at <= now()
+        ORDER BY next_attempt_at
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING d.id, w.url, w.secret, d.event_type, d.payload, d.attempts, d.created_at
+`
+	rows, err := s.DBConn.QueryContext(ctx, sqlStmt, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []repository.PendingDelivery
+	for rows.Next() {
+		var delivery repository.PendingDelivery
+		err := rows.Scan(&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.EventType, &delivery.Payload, &delivery.Attempts, &delivery.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// SetWebhookDeliveryResult функция сохранения результата попытки доставки,
+// при retryAfter > 0 доставка будет повторена, при retryAfter == 0 неуспешная доставка завершается
+func (s *Storage) SetWebhookDeliveryResult(ctx context.Context, deliveryID int, delivered bool, statusCode int, errText string, retryAfter time.Duration) error {
+	status := repository.DeliveryStatusPending
+	if delivered {
+		status = repository.DeliveryStatusDelivered
+	} else if retryAfter <= 0 {
+		status = repository.DeliveryStatusFailed
+	}
+
+	const sqlStmt = `
+    UPDATE webhook_deliveries
+    SET status = $2, attempts = attempts + 1,
+        last_status_code = nullif($3, 0), last_error = nullif($4, ''),
+        next_attempt_at = now() + make_interval(secs => $5),
+        delivered_at = CASE WHEN $2 = 'delivered' THEN now() END
+    WHERE id = $1
+`
+	_, err := s.DBConn.ExecContext(ctx, sqlStmt, deliveryID, status, statusCode, errText, retryAfter.Seconds())
+	return err
+}
@@ -3,9 +3,341 @@ package repository
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ErrInsufficientFunds ошибка, возвращаемая при нехватке средств для списания
+var ErrInsufficientFunds = errors.New("на счету недостаточно средств")
+
+// ErrNegativeBalance ошибка, возвращаемая при попытке списания со счета с задолженностью
+var ErrNegativeBalance = errors.New("на счету задолженность, списания заблокированы")
+
+// источники корректировок баланса
+const (
+	AdjustmentSourceReconcile = "reconcile"
+	AdjustmentSourceDispute   = "dispute"
+)
+
+// статусы спора по начислению
+const (
+	DisputeStatusOpen        = "open"
+	DisputeStatusUnderReview = "under_review"
+	DisputeStatusResolved    = "resolved"
+	DisputeStatusRejected    = "rejected"
+)
+
+// ошибки работы со спорами
+var (
+	// ErrDisputeNotFound спор не найден
+	ErrDisputeNotFound = errors.New("спор не найден")
+	// ErrDisputeState переход спора в новый статус из текущего статуса невозможен
+	ErrDisputeState = errors.New("недопустимый переход статуса спора")
+	// ErrDisputeExists по заказу уже есть незавершенный спор
+	ErrDisputeExists = errors.New("по заказу уже есть незавершенный спор")
+	// ErrOrderNotFinished расчет начисления по заказу не завершен
+	ErrOrderNotFinished = errors.New("расчет начисления по заказу не завершен")
+)
+
+// Dispute тип, описывающий спор пользователя по начислению за заказ,
+// ReviewedBy - администратор, взявший спор в работу, ResolvedBy - администратор, принявший решение
+type Dispute struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id,omitempty"`
+	Order      string     `json:"order"`
+	Reason     string     `json:"reason"`
+	Status     string     `json:"status"`
+	Resolution string     `json:"resolution,omitempty"`
+	Adjustment float64    `json:"adjustment,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	ReviewedBy int        `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	ResolvedBy int        `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// ошибки работы с refresh токенами
+var (
+	// ErrRefreshTokenInvalid refresh токен не найден, истек или отозван
+	ErrRefreshTokenInvalid = errors.New("refresh токен недействителен")
+	// ErrRefreshTokenReused повторное использование refresh токена, семья токенов отозвана
+	ErrRefreshTokenReused = errors.New("refresh токен использован повторно, вход отозван")
+)
+
+// Session тип, описывающий сессию пользователя - вход, которому принадлежит семья токенов:
+// устройство, IP-адрес и user agent входа, Current - сессия текущего запроса
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+// результаты попыток входа в журнале
+const (
+	LoginResultSuccess = "success"
+	LoginResultFailure = "failure"
+	LoginResultLocked  = "locked"
+)
+
+// LoginLockoutPolicy тип, описывающий блокировку входа после неудачных попыток:
+// после LoginThreshold неудач по логину или IPThreshold неудач с IP-адреса вход блокируется на BaseLockout,
+// каждая следующая неудача удваивает блокировку до MaxLockout,
+// счетчик сбрасывается, если неудач не было дольше ResetAfter, нулевой порог отключает правило
+type LoginLockoutPolicy struct {
+	LoginThreshold int
+	IPThreshold    int
+	BaseLockout    time.Duration
+	MaxLockout     time.Duration
+	ResetAfter     time.Duration
+}
+
+// SecondFactorLockoutPolicy тип, описывающий блокировку проверок второго фактора пользователя:
+// после Threshold неверных кодов TOTP или кодов восстановления проверки блокируются на BaseLockout,
+// каждая следующая неудача удваивает блокировку до MaxLockout,
+// счетчик сбрасывается успешной проверкой или если неудач не было дольше ResetAfter, нулевой порог отключает блокировку
+type SecondFactorLockoutPolicy struct {
+	Threshold   int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	ResetAfter  time.Duration
+}
+
+// области доступа API ключей
+const (
+	ScopeOrdersWrite = "orders:write"
+	ScopeBalanceRead = "balance:read"
+	ScopeWithdraw    = "withdraw"
+)
+
+// APIKeyScopes допустимые области доступа API ключей
+var APIKeyScopes = []string{ScopeOrdersWrite, ScopeBalanceRead, ScopeWithdraw}
+
+// APIKey тип, описывающий API ключ пользователя, Key заполняется только при создании ключа
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	UserRole   string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// ошибки входа через провайдера OpenID Connect
+var (
+	// ErrIdentityLinked внешняя учетная запись уже связана с другим пользователем
+	ErrIdentityLinked = errors.New("внешняя учетная запись уже связана с другим пользователем")
+	// ErrLoginTaken логин для создаваемого пользователя уже занят
+	ErrLoginTaken = errors.New("логин уже занят")
+)
+
+// OIDCAuthRequest тип, описывающий начатый вход через провайдера OpenID Connect:
+// nonce и code_verifier для проверки возврата и пользователь LinkUserID, к которому привязывается
+// внешняя учетная запись, 0 - вход без привязки
+type OIDCAuthRequest struct {
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   int
+}
+
+// Identity тип, описывающий внешнюю учетную запись провайдера OpenID Connect
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+}
+
+// ErrTOTPEnabled двухфакторная аутентификация уже подключена
+var ErrTOTPEnabled = errors.New("двухфакторная аутентификация уже подключена")
+
+// TOTPState тип, описывающий секрет TOTP пользователя: Enabled - подключение подтверждено кодом,
+// LastStep - последний принятый шаг времени
+type TOTPState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// церемонии WebAuthn
+const (
+	WebAuthnRegistration = "registration"
+	WebAuthnLogin        = "login"
+)
+
+// ErrCredentialExists ключ доступа уже зарегистрирован
+var ErrCredentialExists = errors.New("ключ доступа уже зарегистрирован")
+
+// WebAuthnCredential тип, описывающий ключ доступа WebAuthn пользователя,
+// CredentialID - идентификатор ключа аутентификатора в base64url, PublicKey - открытый ключ COSE
+type WebAuthnCredential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"-"`
+	CredentialID string     `json:"credential_id"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"sign_count"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnChallenge тип, описывающий начатую церемонию WebAuthn: пользователь UserID,
+// для входа 0 - пользователь определяется по ключу
+type WebAuthnChallenge struct {
+	Ceremony string
+	UserID   int
+}
+
+// типы записей журнала движения баллов в выгрузке данных пользователя
+const (
+	LedgerAccrual    = "accrual"
+	LedgerWithdrawal = "withdrawal"
+	LedgerAdjustment = "adjustment"
+)
+
+// UserExport тип, описывающий выгрузку персональных данных пользователя: профиль, заказы,
+// списания и журнал движения баллов, сформированные на один момент времени ExportedAt
+type UserExport struct {
+	ExportedAt  time.Time           `json:"exported_at"`
+	Profile     ExportProfile       `json:"profile"`
+	Orders      []ExportOrder       `json:"orders"`
+	Withdrawals []WithdrawalsResult `json:"withdrawals"`
+	Ledger      []LedgerEntry       `json:"ledger"`
+}
+
+// ExportProfile тип, описывающий профиль пользователя в выгрузке,
+// DeletionScheduledAt - время удаления учетной записи, если удаление запрошено
+type ExportProfile struct {
+	ID                  int              `json:"id"`
+	Login               string           `json:"login"`
+	Role                string           `json:"role"`
+	CreatedAt           time.Time        `json:"created_at"`
+	DeletionScheduledAt *time.Time       `json:"deletion_scheduled_at,omitempty"`
+	Identities          []ExportIdentity `json:"identities"`
+}
+
+// ExportIdentity тип, описывающий связанную внешнюю учетную запись в выгрузке
+type ExportIdentity struct {
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// ExportOrder тип, описывающий заказ в выгрузке с составом, Accrual - исходное начисление
+// без корректировок, которые отражены в журнале
+type ExportOrder struct {
+	OrderNumber string      `json:"number"`
+	Status      string      `json:"status"`
+	Accrual     float64     `json:"accrual"`
+	UploadedAt  time.Time   `json:"uploaded_at"`
+	ProcessedAt *time.Time  `json:"processed_at,omitempty"`
+	Goods       []OrderGood `json:"goods,omitempty"`
+}
+
+// LedgerEntry тип, описывающий запись журнала движения баллов: начисление за заказ, списание
+// или корректировку баланса, Amount - изменение баланса со знаком, Balance - баланс после записи
+type LedgerEntry struct {
+	Type    string    `json:"type"`
+	Order   string    `json:"order,omitempty"`
+	Amount  float64   `json:"amount"`
+	Balance float64   `json:"balance"`
+	Source  string    `json:"source,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// причины ограничения загрузки заказов
+const (
+	UploadBlockUserVelocity = "user_velocity"
+	UploadBlockIPVelocity   = "ip_velocity"
+	UploadBlockConflicts    = "conflict_ratio"
+	UploadBlockInvalid      = "invalid_ratio"
+)
+
+// UploadAbusePolicy тип, описывающий правила обнаружения злоупотреблений при загрузке заказов:
+// ограничения частоты загрузок пользователем и с IP-адреса за окно Window
+// и допустимые доли конфликтов и некорректных номеров за окно RatioWindow при не менее MinAttempts загрузок,
+// при превышении долей загрузка блокируется на BlockDuration, нулевое значение поля отключает правило
+type UploadAbusePolicy struct {
+	Window           time.Duration
+	MaxPerUser       int
+	MaxPerIP         int
+	RatioWindow      time.Duration
+	MinAttempts      int
+	MaxConflictRatio float64
+	MaxInvalidRatio  float64
+	BlockDuration    time.Duration
+}
+
+// UploadBlock тип, описывающий ограничение загрузки заказов до момента Until
+type UploadBlock struct {
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// UploadAbuseReport тип, описывающий статистику загрузок заказов пользователя для отчета о подозрительных аккаунтах
+type UploadAbuseReport struct {
+	UserID       int        `json:"user_id"`
+	Login        string     `json:"login"`
+	Attempts     int        `json:"attempts"`
+	Accepted     int        `json:"accepted"`
+	Conflicts    int        `json:"conflicts"`
+	Invalid      int        `json:"invalid"`
+	IPs          int        `json:"ips"`
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+}
+
+// правила ограничений на списания, нарушение которых возвращается в WithdrawalLimitError
+const (
+	LimitRuleMaxSingle  = "max_single"
+	LimitRuleMaxDaily   = "max_daily"
+	LimitRuleMaxWeekly  = "max_weekly"
+	LimitRuleMinBalance = "min_balance"
+)
+
+// WithdrawalLimits тип, описывающий ограничения на списания,
+// нулевое значение поля означает отсутствие ограничения
+type WithdrawalLimits struct {
+	MaxSingle  float64
+	MaxDaily   float64
+	MaxWeekly  float64
+	MinBalance float64
+}
+
+// UserWithdrawalLimits тип, описывающий персональные ограничения на списания пользователя,
+// пустое поле - действует ограничение из конфигурации, ноль - ограничения нет
+type UserWithdrawalLimits struct {
+	MaxSingle  *float64 `json:"max_single"`
+	MaxDaily   *float64 `json:"max_daily"`
+	MaxWeekly  *float64 `json:"max_weekly"`
+	MinBalance *float64 `json:"min_balance"`
+}
+
+// WithdrawalLimitError ошибка нарушения ограничения на списание
+// Rule - нарушенное правило, Limit - значение ограничения, Available - сумма, доступная к списанию по этому правилу
+type WithdrawalLimitError struct {
+	Rule      string
+	Limit     float64
+	Available float64
+}
+
+func (e *WithdrawalLimitError) Error() string {
+	return fmt.Sprintf("превышено ограничение на списание %s: лимит %.2f, доступно %.2f", e.Rule, e.Limit, e.Available)
+}
+
 // OrdersResult тип, описывающий результат запроса заказов пользователя
 type OrdersResult struct {
 	OrderNumber string    `json:"number"`
@@ -14,6 +346,145 @@ type OrdersResult struct {
 	UploadedAt  time.Time `json:"uploaded_at"`
 }
 
+// OrderGood тип, описывающий товар в составе заказа
+type OrderGood struct {
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+}
+
+// OrderDetails тип, описывающий состояние отдельного заказа пользователя
+// LastPolledAt - время последнего запроса в систему начислений, NextPollAt - время следующего запроса,
+// не заполняется, если опрос заказа окончен: для заказов с окончательным статусом и заказов NEW,
+// не известных системе начислений
+type OrderDetails struct {
+	OrderNumber  string     `json:"number"`
+	Status       string     `json:"status"`
+	Accrual      float64    `json:"accrual,omitempty"`
+	UploadedAt   time.Time  `json:"uploaded_at"`
+	LastPolledAt *time.Time `json:"last_polled_at,omitempty"`
+	NextPollAt   *time.Time `json:"next_poll_at,omitempty"`
+}
+
+// типы событий пользователя
+const (
+	UserEventOrderStatus = "order_status"
+	UserEventAccrual     = "accrual"
+	UserEventWithdrawal  = "withdrawal"
+)
+
+// UserEvent тип, описывающий событие по заказам и балансу пользователя
+type UserEvent struct {
+	Type    string    `json:"type"`
+	UserID  int       `json:"-"`
+	Order   string    `json:"order,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Accrual float64   `json:"accrual,omitempty"`
+	Sum     float64   `json:"sum,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// статусы доставки вебхука
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+)
+
+// Webhook тип, описывающий зарегистрированный пользователем вебхук,
+// секрет для подписи выдается только при создании
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"events"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery тип, описывающий запись журнала доставок вебхука
+type WebhookDelivery struct {
+	ID             int        `json:"id"`
+	EventType      string     `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	RedeliveryOf   int        `json:"redelivery_of,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// PendingDelivery тип, описывающий доставку вебхука, взятую в работу
+type PendingDelivery struct {
+	ID        int
+	URL       string
+	Secret    string
+	EventType string
+	Payload   []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// результаты обработки номера заказа при пакетной загрузке
+const (
+	OrderResultAccepted     = "accepted"
+	OrderResultAlreadyYours = "already_yours"
+	OrderResultConflict     = "conflict"
+	OrderResultInvalid      = "invalid"
+)
+
+// Cursor тип, описывающий позицию последней выданной записи при постраничной выдаче:
+// записи упорядочены по времени и ID, следующая страница начинается строго после курсора
+type Cursor struct {
+	Time time.Time
+	ID   int
+}
+
+// ErrInvalidCursor ошибка разбора курсора постраничной выдачи
+var ErrInvalidCursor = errors.New("некорректный курсор")
+
+// Encode функция кодирования курсора в непрозрачную строку для передачи клиенту
+func (c Cursor) Encode() string {
+	raw := c.Time.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor функция разбора курсора, полученного от клиента
+func DecodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	timePart, idPart, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timePart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &Cursor{Time: t, ID: id}, nil
+}
+
+// OrdersFilter тип, описывающий параметры постраничного запроса заказов пользователя
+// Limit - размер страницы (0 - без ограничения), Cursor - позиция предыдущей страницы,
+// Status - статус заказа, From и To - диапазон времени загрузки [From, To)
+type OrdersFilter struct {
+	Limit  int
+	Cursor *Cursor
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
 // WithdrawalsResult тип, описывающий результат запроса списания бонусов пользователя
 type WithdrawalsResult struct {
 	OrderNumber string    `json:"order"`
@@ -21,6 +492,29 @@ type WithdrawalsResult struct {
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
+// WithdrawalsFilter тип, описывающий параметры постраничного запроса списаний пользователя
+// Limit - размер страницы (0 - без ограничения), Cursor - позиция предыдущей страницы,
+// From и To - диапазон времени списания [From, To)
+type WithdrawalsFilter struct {
+	Limit  int
+	Cursor *Cursor
+	From   time.Time
+	To     time.Time
+}
+
+// периоды группировки списаний
+const (
+	GroupByDay   = "day"
+	GroupByMonth = "month"
+)
+
+// WithdrawalsAggregate тип, описывающий сумму и количество списаний пользователя за период
+type WithdrawalsAggregate struct {
+	Period string  `json:"period"`
+	Sum    float64 `json:"sum"`
+	Count  int     `json:"count"`
+}
+
 type StorageInterface interface {
 	// GetUserIDByLogin функция получение ID пользователя по его логину
 	GetUserIDByLogin(ctx context.Context, login string) (int, error)
@@ -28,18 +522,244 @@ type StorageInterface interface {
 	CreateUser(ctx context.Context, login string, pwdHash string) (int, error)
 	// GetUserIDPasswordHashByLogin функция получение ID пользователя и хеша пароля по его логину
 	GetUserIDPasswordHashByLogin(ctx context.Context, login string) (int, string, error)
+	// CheckLoginLockout функция проверки блокировки входа по логину и IP-адресу,
+	// возвращает оставшееся время блокировки, 0 - вход разрешен
+	CheckLoginLockout(ctx context.Context, login string, ip string) (time.Duration, error)
+	// RecordLoginAttempt функция записи попытки входа в журнал и учета неудачных попыток,
+	// возвращает установленное время блокировки после неудачной попытки
+	RecordLoginAttempt(ctx context.Context, login string, ip string, result string, policy LoginLockoutPolicy) (time.Duration, error)
+	// PurgeLoginAttempts функция удаления записей журнала попыток входа старше retention,
+	// возвращает количество удаленных записей
+	PurgeLoginAttempts(ctx context.Context, retention time.Duration) (int64, error)
+	// PurgeLoginLockouts функция удаления счетчиков неудачных попыток входа без действующей блокировки,
+	// неудач по которым не было дольше resetAfter, возвращает количество удаленных счетчиков
+	PurgeLoginLockouts(ctx context.Context, resetAfter time.Duration) (int64, error)
+	// CreateAPIKey функция создания API ключа пользователя по хэшу ключа
+	CreateAPIKey(ctx context.Context, userID int, name string, prefix string, keyHash string, scopes []string) (*APIKey, error)
+	// GetAPIKeys функция получения API ключей пользователя, включая отозванные
+	GetAPIKeys(ctx context.Context, userID int) ([]APIKey, error)
+	// RevokeAPIKey функция отзыва API ключа пользователя, возвращает false, если ключ не найден
+	RevokeAPIKey(ctx context.Context, userID int, keyID int) (bool, error)
+	// AuthenticateAPIKey функция поиска действующего API ключа по хэшу с отметкой времени использования,
+	// возвращает nil, если ключ не найден или отозван
+	AuthenticateAPIKey(ctx context.Context, keyHash string) (*APIKey, error)
+	// GetUserLoginPasswordHash функция получения логина и хеша пароля пользователя
+	GetUserLoginPasswordHash(ctx context.Context, userID int) (string, string, error)
+	// GetUserRole функция получения роли пользователя
+	GetUserRole(ctx context.Context, userID int) (string, error)
+	// SetUserRole функция смены роли пользователя с отзывом его семей токенов,
+	// возвращает false, если пользователь не найден
+	SetUserRole(ctx context.Context, userID int, role string) (bool, error)
+	// SetUserRoleByLogin функция смены роли пользователя по логину,
+	// возвращает false, если пользователь не найден
+	SetUserRoleByLogin(ctx context.Context, login string, role string) (bool, error)
+	// UpdateUserPassword функция смены хеша пароля пользователя с отзывом всех его семей токенов
+	UpdateUserPassword(ctx context.Context, userID int, pwdHash string) error
+	// SetUserOrderValidator функция сохранения схемы проверки номеров заказов пользователя-партнера,
+	// пустая строка удаляет персональную схему, возвращает false, если пользователь не найден
+	SetUserOrderValidator(ctx context.Context, userID int, spec string) (bool, error)
+	// GetUserOrderValidator функция получения схемы проверки номеров заказов пользователя-партнера,
+	// пустая строка - схема не задана
+	GetUserOrderValidator(ctx context.Context, userID int) (string, error)
 	// GetUserIDOfOrder функция получение ID пользователя в заказе
 	GetUserIDOfOrder(ctx context.Context, orderNumber string) (int, error)
-	// InsertNewOrder функция сохранения в базе данных нового заказа
+	// InsertNewOrder функция сохранения в базе данных нового заказа, заказ сразу ставится в очередь опроса
 	InsertNewOrder(ctx context.Context, orderNumber string, userID int) error
+	// InsertNewOrderWithGoods функция сохранения в базе данных нового заказа с товарами,
+	// такой заказ регистрируется в системе начислений перед запросом начислений, заказ сразу ставится в очередь опроса
+	InsertNewOrderWithGoods(ctx context.Context, orderNumber string, userID int, goods []OrderGood) error
+	// GetUnregisteredOrderGoods функция получения товаров заказа, еще не зарегистрированного в системе начислений,
+	// возвращает nil, если регистрация не требуется
+	GetUnregisteredOrderGoods(ctx context.Context, orderNumber string) ([]OrderGood, error)
+	// SetOrderRegistered функция сохранения признака регистрации заказа в системе начислений
+	SetOrderRegistered(ctx context.Context, orderNumber string) error
+	// InsertOrdersBatch функция сохранения пакета новых заказов в одной транзакции с постановкой в очередь опроса,
+	// возвращает результат по каждому номеру: accepted, already_yours или conflict
+	InsertOrdersBatch(ctx context.Context, orderNumbers []string, userID int) ([]string, error)
 	// GetOrders функция получения заказов пользователя
-	GetOrders(userID int) ([]OrdersResult, error)
+	GetOrders(ctx context.Context, userID int) ([]OrdersResult, error)
+	// GetOrdersPage функция постраничного получения заказов пользователя с фильтрами,
+	// возвращает курсор следующей страницы или nil, если страница последняя
+	GetOrdersPage(ctx context.Context, userID int, filter OrdersFilter) ([]OrdersResult, *Cursor, error)
+	// GetOrder функция получения заказа пользователя по номеру,
+	// возвращает nil, если заказ не найден или принадлежит другому пользователю
+	GetOrder(ctx context.Context, userID int, orderNumber string) (*OrderDetails, error)
+	// SetOrderPolled функция сохранения времени запроса заказа в систему начислений
+	// и времени следующего запроса через nextPoll
+	SetOrderPolled(ctx context.Context, orderNumber string, nextPoll time.Duration) error
+	// ClaimOrdersForPoll функция получения номеров заказов, время следующего запроса в систему начислений
+	// которых наступило, взятые заказы не выдаются другим воркерам на время lease
+	ClaimOrdersForPoll(ctx context.Context, limit int, lease time.Duration) ([]string, error)
 	// GetUserBalance функция получения сумм начислений и списаний пользователя
 	GetUserBalance(ctx context.Context, userID int) (float64, float64, error)
 	// InsertWithdrawal функция сохранения в базе данных списания баланса пользователя
-	InsertWithdrawal(ctx context.Context, orderNumber string, sum float64, userID int) error
+	// с проверкой баланса и ограничений на списания в одной транзакции
+	InsertWithdrawal(ctx context.Context, orderNumber string, sum float64, userID int, limits WithdrawalLimits) error
+	// SetUserWithdrawalLimits функция сохранения персональных ограничений на списания пользователя,
+	// возвращает false, если пользователь не найден
+	SetUserWithdrawalLimits(ctx context.Context, userID int, limits UserWithdrawalLimits) (bool, error)
+	// DeleteUserWithdrawalLimits функция удаления персональных ограничений на списания пользователя,
+	// возвращает false, если ограничения не заданы
+	DeleteUserWithdrawalLimits(ctx context.Context, userID int) (bool, error)
 	// GetWithdrawals функция получения списка списаний пользователя
 	GetWithdrawals(ctx context.Context, userID int) ([]WithdrawalsResult, error)
+	// GetWithdrawalsPage функция постраничного получения списаний пользователя,
+	// возвращает курсор следующей страницы или nil, если страница последняя
+	GetWithdrawalsPage(ctx context.Context, userID int, filter WithdrawalsFilter) ([]WithdrawalsResult, *Cursor, error)
+	// GetWithdrawalsAggregates функция получения сумм списаний пользователя по периодам groupBy
+	// в диапазоне времени [from, to), нулевое время - без ограничения
+	GetWithdrawalsAggregates(ctx context.Context, userID int, groupBy string, from time.Time, to time.Time) ([]WithdrawalsAggregate, error)
 	// SetOrderStatusAccrual функция установления статуса заказа и суммы начислений
 	SetOrderStatusAccrual(ctx context.Context, orderNumber string, status string, accrual float64) error
+	// ListenUserEvents функция получения событий пользователей, опубликованных любым экземпляром сервиса,
+	// вызывает ready после подписки и fn для каждого события, блокируется до отмены контекста или ошибки подключения
+	ListenUserEvents(ctx context.Context, ready func(), fn func(UserEvent)) error
+	// CreateWebhook функция сохранения вебхука пользователя
+	CreateWebhook(ctx context.Context, userID int, url string, secret string, eventTypes []string) (*Webhook, error)
+	// GetWebhooks функция получения вебхуков пользователя без секретов
+	GetWebhooks(ctx context.Context, userID int) ([]Webhook, error)
+	// DeleteWebhook функция удаления вебхука пользователя, возвращает false, если вебхук не найден
+	DeleteWebhook(ctx context.Context, userID int, webhookID int) (bool, error)
+	// GetWebhookDeliveries функция получения последних limit доставок вебхука пользователя,
+	// возвращает false, если вебхук не найден
+	GetWebhookDeliveries(ctx context.Context, userID int, webhookID int, limit int) ([]WebhookDelivery, bool, error)
+	// RedeliverWebhookDelivery функция постановки в очередь повторной доставки с тем же содержимым,
+	// возвращает ID новой доставки или 0, если исходная доставка не найдена
+	RedeliverWebhookDelivery(ctx context.Context, userID int, webhookID int, deliveryID int) (int, error)
+	// ClaimWebhookDeliveries функция взятия в работу до limit доставок, время отправки которых наступило,
+	// взятые доставки не выдаются другим экземплярам сервиса в течение lease
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]PendingDelivery, error)
+	// SetWebhookDeliveryResult функция сохранения результата попытки доставки,
+	// при retryAfter > 0 доставка будет повторена, при retryAfter == 0 неуспешная доставка завершается
+	SetWebhookDeliveryResult(ctx context.Context, deliveryID int, delivered bool, statusCode int, errText string, retryAfter time.Duration) error
+	// CreateDispute функция открытия спора пользователя по начислению за заказ,
+	// возвращает nil, если заказ не найден или принадлежит другому пользователю
+	CreateDispute(ctx context.Context, userID int, orderNumber string, reason string) (*Dispute, error)
+	// GetUserDisputes функция получения споров пользователя
+	GetUserDisputes(ctx context.Context, userID int) ([]Dispute, error)
+	// GetDisputes функция получения очереди споров с фильтром по статусу, пустой статус - все споры
+	GetDisputes(ctx context.Context, status string, limit int) ([]Dispute, error)
+	// SetDisputeStatus функция перевода спора в новый статус с решением администратором actorID,
+	// при amount > 0 пользователю начисляется корректировка баланса по заказу спора
+	SetDisputeStatus(ctx context.Context, disputeID int, actorID int, status string, resolution string, amount float64) (*Dispute, error)
+	// CheckOrderUploads функция проверки возможности загрузки count заказов пользователем с IP-адреса ip:
+	// возвращает действующую блокировку или превышение частоты загрузок, nil - загрузка разрешена,
+	// разрешенная загрузка резервирует count записей журнала загрузок под результаты RecordOrderUploads
+	CheckOrderUploads(ctx context.Context, userID int, ip string, count int, policy UploadAbusePolicy) (*UploadBlock, error)
+	// RecordOrderUploads функция записи результатов загрузки заказов в зарезервированные записи журнала
+	// и проверки долей конфликтов и некорректных номеров, возвращает блокировку, если она была установлена
+	// по результатам проверки
+	RecordOrderUploads(ctx context.Context, userID int, ip string, numbers []string, results []string, policy UploadAbusePolicy) (*UploadBlock, error)
+	// PurgeOrderUploadAttempts функция удаления записей журнала загрузок заказов старше retention,
+	// возвращает количество удаленных записей
+	PurgeOrderUploadAttempts(ctx context.Context, retention time.Duration) (int64, error)
+	// GetUploadAbuseReport функция получения статистики загрузок заказов за window по пользователям
+	// с конфликтами, некорректными номерами или блокировками, наиболее подозрительные - первыми
+	GetUploadAbuseReport(ctx context.Context, window time.Duration, limit int) ([]UploadAbuseReport, error)
+	// CreateRefreshToken функция создания семьи токенов - сессии session пользователя с первым refresh токеном,
+	// хранится только хэш токена
+	CreateRefreshToken(ctx context.Context, userID int, session Session, tokenHash string, ttl time.Duration) error
+	// RotateRefreshToken функция замены refresh токена oldHash на newHash в той же семье,
+	// при повторном использовании токена отзывает всю семью и возвращает ErrRefreshTokenReused
+	RotateRefreshToken(ctx context.Context, oldHash string, newHash string, ttl time.Duration) (int, string, error)
+	// RevokeTokenFamily функция отзыва семьи токенов
+	RevokeTokenFamily(ctx context.Context, familyID string) error
+	// RevokeRefreshToken функция отзыва семьи токенов по refresh токену, возвращает отозванную семью
+	RevokeRefreshToken(ctx context.Context, tokenHash string) (string, error)
+	// TouchSession функция проверки, что сессия familyID не отозвана, с отметкой времени запроса
+	// не чаще interval, неизвестная сессия считается отозванной
+	TouchSession(ctx context.Context, familyID string, interval time.Duration) (bool, error)
+	// GetSessions функция получения действующих сессий пользователя, последние активные - первыми
+	GetSessions(ctx context.Context, userID int) ([]Session, error)
+	// RevokeSession функция отзыва сессии пользователя, возвращает false, если сессия не найдена или уже отозвана
+	RevokeSession(ctx context.Context, userID int, familyID string) (bool, error)
+	// RevokeOtherSessions функция отзыва всех сессий пользователя, кроме keepFamilyID
+	RevokeOtherSessions(ctx context.Context, userID int, keepFamilyID string) error
+	// IsSessionFresh функция проверки, что действующая сессия familyID пользователя начата не ранее maxAge назад
+	IsSessionFresh(ctx context.Context, userID int, familyID string, maxAge time.Duration) (bool, error)
+	// GetUserDebtFlag функция получения признака задолженности пользователя
+	GetUserDebtFlag(ctx context.Context, userID int) (bool, error)
+	// GetOrdersForReconcile функция получения номеров завершенных в пределах window заказов,
+	// которые не сверялись с системой начислений дольше interval
+	GetOrdersForReconcile(ctx context.Context, window time.Duration, interval time.Duration, limit int) ([]string, error)
+	// SetOrderReconciled функция отметки попытки сверки заказа без изменения начислений
+	SetOrderReconciled(ctx context.Context, orderNumber string) error
+	// ReconcileOrder функция сверки заказа с актуальными данными системы начислений,
+	// записывает корректировку баланса на разницу начислений и возвращает ее сумму
+	ReconcileOrder(ctx context.Context, orderNumber string, status string, accrual float64) (float64, error)
+	// SaveOIDCAuthRequest функция сохранения начатого входа через провайдера по хэшу state на время ttl
+	SaveOIDCAuthRequest(ctx context.Context, stateHash string, request OIDCAuthRequest, ttl time.Duration) error
+	// TakeOIDCAuthRequest функция однократного получения начатого входа по хэшу state,
+	// возвращает nil, если вход не найден или истек
+	TakeOIDCAuthRequest(ctx context.Context, stateHash string) (*OIDCAuthRequest, error)
+	// GetUserIDByIdentity функция получения пользователя, связанного с внешней учетной записью,
+	// с отметкой времени входа, возвращает 0, если связи нет
+	GetUserIDByIdentity(ctx context.Context, identity Identity) (int, error)
+	// LinkIdentity функция связи внешней учетной записи с пользователем,
+	// возвращает ErrIdentityLinked, если запись связана с другим пользователем
+	LinkIdentity(ctx context.Context, userID int, identity Identity) error
+	// CreateUserWithIdentity функция создания пользователя без пароля, связанного с внешней учетной записью,
+	// возвращает ErrLoginTaken, если логин занят
+	CreateUserWithIdentity(ctx context.Context, login string, identity Identity) (int, error)
+	// SaveTOTPSecret функция сохранения неподтвержденного секрета TOTP пользователя,
+	// возвращает ErrTOTPEnabled, если двухфакторная аутентификация уже подключена
+	SaveTOTPSecret(ctx context.Context, userID int, secret string) error
+	// GetTOTP функция получения секрета TOTP пользователя, возвращает nil, если секрета нет
+	GetTOTP(ctx context.Context, userID int) (*TOTPState, error)
+	// EnableTOTP функция подтверждения подключения TOTP с принятым шагом времени и заменой кодов восстановления,
+	// возвращает ErrTOTPEnabled, если двухфакторная аутентификация уже подключена
+	EnableTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error
+	// UseTOTPStep функция отметки шага времени принятого кода, возвращает false, если код этого
+	// или более позднего шага уже использован
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	// UseRecoveryCode функция однократного использования кода восстановления по хэшу,
+	// возвращает false, если код не найден или использован
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	// DisableTOTP функция отключения двухфакторной аутентификации с удалением секрета и кодов восстановления
+	DisableTOTP(ctx context.Context, userID int) error
+	// CheckSecondFactorLockout функция проверки блокировки проверок второго фактора пользователя,
+	// возвращает оставшееся время блокировки, 0 - проверка разрешена
+	CheckSecondFactorLockout(ctx context.Context, userID int) (time.Duration, error)
+	// RecordSecondFactorFailure функция учета неудачной проверки второго фактора пользователя,
+	// возвращает установленное время блокировки
+	RecordSecondFactorFailure(ctx context.Context, userID int, policy SecondFactorLockoutPolicy) (time.Duration, error)
+	// ResetSecondFactorFailures функция сброса счетчика неудачных проверок второго фактора после успешной проверки
+	ResetSecondFactorFailures(ctx context.Context, userID int) error
+	// CreateLoginChallenge функция сохранения входа, ожидающего второго фактора, по хэшу токена на время ttl
+	CreateLoginChallenge(ctx context.Context, userID int, tokenHash string, ttl time.Duration) error
+	// CheckLoginChallenge функция учета попытки ввода второго фактора по хэшу токена входа,
+	// возвращает 0, если вход не найден, истек или попытки исчерпаны
+	CheckLoginChallenge(ctx context.Context, tokenHash string, maxAttempts int) (int, error)
+	// DeleteLoginChallenge функция удаления завершенного входа
+	DeleteLoginChallenge(ctx context.Context, tokenHash string) error
+	// SaveWebAuthnChallenge функция сохранения начатой церемонии WebAuthn по хэшу вызова на время ttl
+	SaveWebAuthnChallenge(ctx context.Context, challengeHash string, challenge WebAuthnChallenge, ttl time.Duration) error
+	// TakeWebAuthnChallenge функция однократного получения начатой церемонии по хэшу вызова,
+	// возвращает nil, если церемония не найдена, истекла или другого типа
+	TakeWebAuthnChallenge(ctx context.Context, challengeHash string, ceremony string) (*WebAuthnChallenge, error)
+	// CreateWebAuthnCredential функция сохранения ключа доступа пользователя,
+	// возвращает ErrCredentialExists, если ключ уже зарегистрирован
+	CreateWebAuthnCredential(ctx context.Context, credential WebAuthnCredential) (*WebAuthnCredential, error)
+	// GetWebAuthnCredentials функция получения ключей доступа пользователя
+	GetWebAuthnCredentials(ctx context.Context, userID int) ([]WebAuthnCredential, error)
+	// GetWebAuthnCredential функция получения ключа доступа по идентификатору ключа аутентификатора,
+	// возвращает nil, если ключ не найден
+	GetWebAuthnCredential(ctx context.Context, credentialID string) (*WebAuthnCredential, error)
+	// UpdateWebAuthnSignCount функция сохранения счетчика подписей после входа, возвращает false,
+	// если счетчик не больше сохраненного
+	UpdateWebAuthnSignCount(ctx context.Context, id int, signCount uint32) (bool, error)
+	// DeleteWebAuthnCredential функция удаления ключа доступа пользователя, возвращает false, если ключ не найден
+	DeleteWebAuthnCredential(ctx context.Context, userID int, id int) (bool, error)
+	// GetUserExport функция получения выгрузки персональных данных пользователя
+	GetUserExport(ctx context.Context, userID int) (*UserExport, error)
+	// ScheduleUserDeletion функция планирования удаления учетной записи через grace,
+	// повторный запрос не переносит запланированное время, возвращает время удаления
+	ScheduleUserDeletion(ctx context.Context, userID int, grace time.Duration) (time.Time, error)
+	// CancelUserDeletion функция отмены запланированного удаления, возвращает false, если удаление не запланировано
+	CancelUserDeletion(ctx context.Context, userID int) (bool, error)
+	// GetUsersForPurge функция получения пользователей, время удаления которых наступило
+	GetUsersForPurge(ctx context.Context, limit int) ([]int, error)
+	// PurgeUser функция удаления учетной записи с обезличиванием финансовых записей,
+	// возвращает false, если удаление отменено или время удаления не наступило
+	PurgeUser(ctx context.Context, userID int) (bool, error)
 }
@@ -0,0 +1,113 @@
+// Package totp одноразовые коды по времени по RFC 6238 (HMAC-SHA1, 6 цифр, шаг 30 секунд),
+// совместимые с приложениями-аутентификаторами
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits количество цифр кода
+	Digits = 6
+	// Period длительность шага времени
+	Period = 30 * time.Second
+	// Skew количество соседних шагов, коды которых принимаются из-за расхождения часов
+	Skew = 1
+	// secretBytes длина секрета в байтах, рекомендуемая RFC 4226
+	secretBytes = 20
+)
+
+// encoding кодирование секрета в base32 без дополнения, принятое в приложениях-аутентификаторах
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret создание случайного секрета в base32
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// ProvisioningURI адрес otpauth:// для добавления секрета в приложение-аутентификатор по QR коду
+func ProvisioningURI(issuer string, account string, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period.Seconds()))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step номер шага времени t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code код для секрета в base32 на момент t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(Step(t)), Digits), nil
+}
+
+// Validate проверка кода на момент t с допуском Skew шагов,
+// возвращает шаг, которому соответствует код, для защиты от повторного использования
+func Validate(secret string, code string, t time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+	for step := current - Skew; step <= current+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// decodeSecret декодирование секрета из base32 без учета регистра, пробелов и дополнения
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	return encoding.DecodeString(secret)
+}
+
+// hotp код HMAC-SHA1 по RFC 4226 для счетчика counter с динамическим усечением до digits цифр
+func hotp(key []byte, counter uint64, digits int) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for range digits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
@@ -0,0 +1,66 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRFCVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	// RFC 4226, приложение D
+	for counter, want := range []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"} {
+		assert.Equal(t, want, hotp(key, uint64(counter), 6))
+	}
+
+	// RFC 6238, приложение B, SHA1
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		assert.Equal(t, want, hotp(key, uint64(Step(time.Unix(unix, 0))), 8), unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, now)
+	require.NoError(t, err)
+
+	step, ok := Validate(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// код предыдущего шага принимается из-за расхождения часов, более старый - нет
+	_, ok = Validate(secret, code, now.Add(Period))
+	assert.True(t, ok)
+	_, ok = Validate(secret, code, now.Add(2*Period))
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "000000", now)
+	assert.Equal(t, code == "000000", ok)
+	_, ok = Validate(secret, "12345", now)
+	assert.False(t, ok)
+
+	// секрет принимается в нижнем регистре
+	_, ok = Validate(strings.ToLower(secret), code, now)
+	assert.True(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Gophermart", "user@example.com", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Gophermart:user@example.com?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=Gophermart")
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/rand"
-	"strconv"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -25,6 +27,21 @@ func GenerateRandomNumberString(length int) string {
 	return string(b[:])
 }
 
+// GenerateSecureToken генерирует криптографически стойкую случайную строку из n байт в шестнадцатеричном виде
+func GenerateSecureToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken возвращает SHA-256 хэш токена в шестнадцатеричном виде для хранения вместо самого токена
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func DigitString(minLen, maxLen int) string {
 	var letters = "0123456789"
 
@@ -55,26 +72,32 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
+// CheckNumberLuhn проверка номера по алгоритму Луна, последняя цифра - контрольная,
+// номер проверяется поразрядно, поэтому его длина не ограничена, допускаются только цифры
 func CheckNumberLuhn(s string) bool {
 	if len(s) < 3 {
 		return false
 	}
 
-	checkDigit := s[len(s)-1]
-	numberPart := s[:len(s)-1]
-
-	number, err := strconv.Atoi(numberPart)
-	if err != nil {
-		return false
-	}
-
-	checkNumber := CalcChecksumLuhn(number)
+	sum := 0
+	for i := 0; i < len(s); i++ {
+		char := s[len(s)-1-i]
+		if char < '0' || char > '9' {
+			return false
+		}
 
-	if checkNumber != 0 {
-		checkNumber = 10 - checkNumber
+		digit := int(char - '0')
+		// удваивается каждая вторая цифра справа, начиная с цифры перед контрольной
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
 	}
 
-	return checkDigit == byte('0'+checkNumber)
+	return sum%10 == 0
 }
 
 func CalcChecksumLuhn(number int) int {
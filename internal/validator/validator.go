@@ -0,0 +1,156 @@
+// Package validator проверка номеров заказов по алгоритмам контрольных сумм и регулярным выражениям
+package validator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// Validator интерфейс проверки номера заказа
+type Validator interface {
+	// Name имя схемы проверки в том виде, в котором она задается в конфигурации
+	Name() string
+	// Valid проверка номера заказа
+	Valid(number string) bool
+}
+
+// Parse создание проверки номера заказа по ее описанию:
+// luhn, damm, verhoeff или regex:<выражение>, выражение должно совпадать с номером целиком
+func Parse(spec string) (Validator, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+
+	switch strings.ToLower(name) {
+	case "", "luhn":
+		return Luhn{}, nil
+	case "damm":
+		return Damm{}, nil
+	case "verhoeff":
+		return Verhoeff{}, nil
+	case "regex":
+		re, err := regexp.Compile(`^(?:` + arg + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("некорректное регулярное выражение проверки номера: %w", err)
+		}
+		return Regex{re: re, spec: spec}, nil
+	}
+
+	return nil, fmt.Errorf("неизвестная схема проверки номера заказа: %s", name)
+}
+
+// Luhn проверка номера по алгоритму Луна
+type Luhn struct{}
+
+// Name имя схемы проверки
+func (Luhn) Name() string { return "luhn" }
+
+// Valid проверка номера заказа
+func (Luhn) Valid(number string) bool { return util.CheckNumberLuhn(number) }
+
+// dammTable таблица квазигруппы порядка 10 для алгоритма Дамма
+var dammTable = [10][10]int{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// Damm проверка номера по алгоритму Дамма
+type Damm struct{}
+
+// Name имя схемы проверки
+func (Damm) Name() string { return "damm" }
+
+// Valid проверка номера заказа
+func (Damm) Valid(number string) bool {
+	if len(number) < 2 || !isDigits(number) {
+		return false
+	}
+
+	interim := 0
+	for i := 0; i < len(number); i++ {
+		interim = dammTable[interim][number[i]-'0']
+	}
+	return interim == 0
+}
+
+// таблицы умножения и перестановок диэдральной группы D5 для алгоритма Верхуффа
+var (
+	verhoeffMultiplication = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffPermutation = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+)
+
+// Verhoeff проверка номера по алгоритму Верхуффа
+type Verhoeff struct{}
+
+// Name имя схемы проверки
+func (Verhoeff) Name() string { return "verhoeff" }
+
+// Valid проверка номера заказа
+func (Verhoeff) Valid(number string) bool {
+	if len(number) < 2 || !isDigits(number) {
+		return false
+	}
+
+	check := 0
+	for i := 0; i < len(number); i++ {
+		digit := number[len(number)-1-i] - '0'
+		check = verhoeffMultiplication[check][verhoeffPermutation[i%8][digit]]
+	}
+	return check == 0
+}
+
+// Regex проверка номера регулярным выражением, например префиксом партнера
+type Regex struct {
+	re   *regexp.Regexp
+	spec string
+}
+
+// Name имя схемы проверки
+func (v Regex) Name() string { return v.spec }
+
+// Valid проверка номера заказа, номер должен состоять только из цифр независимо от выражения
+func (v Regex) Valid(number string) bool {
+	if number == "" || !isDigits(number) {
+		return false
+	}
+	return v.re.MatchString(number)
+}
+
+// isDigits проверка, что строка состоит только из цифр
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package validator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		number string
+		want   bool
+	}{
+		{name: "luhn valid", spec: "luhn", number: "79927398713", want: true},
+		{name: "luhn invalid", spec: "luhn", number: "79927398710", want: false},
+		{name: "luhn longer than int64", spec: "luhn", number: "12345678901234567890123456789019", want: true},
+		{name: "luhn sign rejected", spec: "luhn", number: "+79927398713", want: false},
+		{name: "luhn minus rejected", spec: "luhn", number: "-79927398713", want: false},
+		{name: "damm valid", spec: "damm", number: "5724", want: true},
+		{name: "damm invalid", spec: "damm", number: "5727", want: false},
+		{name: "verhoeff valid", spec: "verhoeff", number: "2363", want: true},
+		{name: "verhoeff invalid", spec: "verhoeff", number: "2364", want: false},
+		{name: "regex prefix valid", spec: `regex:42\d{6}`, number: "42123456", want: true},
+		{name: "regex prefix invalid", spec: `regex:42\d{6}`, number: "43123456", want: false},
+		{name: "regex full match", spec: `regex:42\d{6}`, number: "421234567", want: false},
+		{name: "regex non digits rejected", spec: `regex:42.+`, number: "42abc", want: false},
+		{name: "regex any digits valid", spec: `regex:.*`, number: "1234", want: true},
+		{name: "regex empty rejected", spec: `regex:.*`, number: "", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := Parse(test.spec)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, v.Valid(test.number))
+		})
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	_, err := Parse("crc32")
+	assert.Error(t, err)
+}
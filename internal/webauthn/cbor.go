@@ -0,0 +1,174 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// errCBOR ошибка разбора CBOR
+var errCBOR = errors.New("некорректные данные CBOR")
+
+// maxCBORDepth ограничение вложенности CBOR, защищающее от переполнения стека
+const maxCBORDepth = 16
+
+// cborDecoder минимальный декодер CBOR (RFC 8949) для объекта аттестации и ключей COSE:
+// целые числа, строки байтов и текста, массивы, словари и простые значения без неопределенной длины
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeCBOR разбор одного значения CBOR, возвращает значение и количество прочитанных байт:
+// uint64 или int64 для чисел, []byte, string, []any, map[any]any, bool или nil
+func decodeCBOR(data []byte) (any, int, error) {
+	d := &cborDecoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, d.pos, nil
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("%w: слишком глубокая вложенность", errCBOR)
+	}
+
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("%w: неожиданный конец данных", errCBOR)
+	}
+	initial := d.data[d.pos]
+	d.pos++
+	major, info := initial>>5, initial&0x1f
+
+	// простые значения false, true и null
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("%w: неподдерживаемое простое значение %d", errCBOR, info)
+		}
+	}
+
+	argument, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		return argument, nil
+	case 1:
+		if argument > 1<<63-1 {
+			return nil, fmt.Errorf("%w: слишком большое отрицательное число", errCBOR)
+		}
+		return -1 - int64(argument), nil
+	case 2, 3:
+		value, err := d.bytes(argument)
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(value), nil
+		}
+		return value, nil
+	case 4:
+		if argument > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("%w: длина массива больше данных", errCBOR)
+		}
+		items := make([]any, 0, argument)
+		for range argument {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		if argument > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("%w: размер словаря больше данных", errCBOR)
+		}
+		items := make(map[any]any, argument)
+		for range argument {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case uint64, int64, string:
+			default:
+				return nil, fmt.Errorf("%w: неподдерживаемый тип ключа словаря", errCBOR)
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := items[key]; ok {
+				return nil, fmt.Errorf("%w: повторяющийся ключ словаря", errCBOR)
+			}
+			items[key] = value
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("%w: неподдерживаемый тип %d", errCBOR, major)
+	}
+}
+
+// argument чтение аргумента заголовка: значения до 23 или следующих 1, 2, 4 или 8 байт
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, fmt.Errorf("%w: неопределенная длина не поддерживается", errCBOR)
+	}
+
+	raw, err := d.bytes(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var buf [8]byte
+	copy(buf[8-size:], raw)
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// bytes чтение n байт
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: неожиданный конец данных", errCBOR)
+	}
+	value := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return value, nil
+}
+
+// cborInt получение целого числа из значения CBOR по ключу словаря
+func cborInt(m map[any]any, key any) (int64, bool) {
+	switch v := m[key].(type) {
+	case uint64:
+		if v > 1<<63-1 {
+			return 0, false
+		}
+		return int64(v), true
+	case int64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,442 @@
+// Package webauthn проверяющая сторона WebAuthn для входа по ключам доступа (passkeys):
+// параметры церемоний регистрации и входа, проверка аттестации формата none и подписей ES256,
+// контроль счетчика подписей
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/hardvlad/ypdiploma1/internal/util"
+)
+
+// алгоритм и параметры ключей COSE (RFC 9053)
+const (
+	coseAlgES256 = -7
+	coseKtyEC2   = 2
+	coseCrvP256  = 1
+)
+
+// флаги данных аутентификатора
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// Timeout время на выполнение церемонии пользователем
+const Timeout = 5 * time.Minute
+
+// ошибки проверки церемоний
+var (
+	// ErrVerification ответ аутентификатора не прошел проверку
+	ErrVerification = errors.New("ответ аутентификатора не прошел проверку")
+	// ErrSignCount счетчик подписей не увеличился, возможно, ключ скопирован
+	ErrSignCount = errors.New("счетчик подписей аутентификатора не увеличился")
+)
+
+// Config параметры проверяющей стороны
+type Config struct {
+	// RPID - идентификатор проверяющей стороны, домен сервиса
+	RPID string
+	// RPName - название сервиса, показываемое пользователю
+	RPName string
+	// Origins - допустимые источники страниц, выполняющих церемонии
+	Origins []string
+}
+
+// Credential ключ доступа, сохраняемый после регистрации
+type Credential struct {
+	// ID - идентификатор ключа аутентификатора
+	ID []byte
+	// PublicKey - открытый ключ в формате COSE
+	PublicKey []byte
+	SignCount uint32
+}
+
+// CredentialDescriptor описание ключа в параметрах церемоний
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// RegistrationOptions параметры церемонии регистрации для navigator.credentials.create
+type RegistrationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+}
+
+// LoginOptions параметры церемонии входа для navigator.credentials.get
+type LoginOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int                    `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse ответ браузера на церемонию регистрации, значения в base64url
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// LoginResponse ответ браузера на церемонию входа, значения в base64url
+type LoginResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Assertion результат проверенного входа
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+	// UserHandle - идентификатор пользователя, сохраненный аутентификатором, пустой для недискаверабельных ключей
+	UserHandle []byte
+}
+
+// clientData данные клиента, подписываемые аутентификатором
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData разобранные данные аутентификатора
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewChallenge создание случайного вызова церемонии в base64url
+func NewChallenge() (string, error) {
+	token, err := util.GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(token)), nil
+}
+
+// NewRegistrationOptions параметры регистрации ключа для пользователя с идентификатором userHandle,
+// уже зарегистрированные ключи exclude повторно не создаются
+func (c Config) NewRegistrationOptions(challenge string, userHandle []byte, name string, exclude [][]byte) RegistrationOptions {
+	var options RegistrationOptions
+	options.Challenge = challenge
+	options.RP.ID = c.RPID
+	options.RP.Name = c.RPName
+	options.User.ID = base64.RawURLEncoding.EncodeToString(userHandle)
+	options.User.Name = name
+	options.User.DisplayName = name
+	options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}{Type: "public-key", Alg: coseAlgES256})
+	options.Timeout = int(Timeout.Milliseconds())
+	options.Attestation = "none"
+	options.ExcludeCredentials = descriptors(exclude)
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	return options
+}
+
+// NewLoginOptions параметры входа, пустой allow - вход по ключам, хранящим пользователя на аутентификаторе
+func (c Config) NewLoginOptions(challenge string, allow [][]byte) LoginOptions {
+	return LoginOptions{
+		Challenge:        challenge,
+		RPID:             c.RPID,
+		Timeout:          int(Timeout.Milliseconds()),
+		AllowCredentials: descriptors(allow),
+		UserVerification: "preferred",
+	}
+}
+
+// Challenge получение вызова из данных клиента ответа для поиска начатой церемонии
+func Challenge(clientDataJSON string) (string, error) {
+	data, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return data.Challenge, nil
+}
+
+// VerifyRegistration проверка ответа на церемонию регистрации с вызовом challenge:
+// данные клиента, идентификатор проверяющей стороны, присутствие пользователя,
+// аттестация формата none и ключ ES256, возвращает ключ для сохранения
+func (c Config) VerifyRegistration(challenge string, response RegistrationResponse) (*Credential, error) {
+	if response.Type != "public-key" {
+		return nil, fmt.Errorf("%w: неверный тип ключа", ErrVerification)
+	}
+
+	if err := c.verifyClientData(response.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAttestation, err := base64.RawURLEncoding.DecodeString(response.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+	decoded, n, err := decodeCBOR(rawAttestation)
+	if err != nil || n != len(rawAttestation) {
+		return nil, fmt.Errorf("%w: объект аттестации: %v", ErrVerification, err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: объект аттестации не словарь", ErrVerification)
+	}
+
+	// принимается только аттестация none: проверяется ключ, а не модель аутентификатора
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[any]any)
+	if format != "none" || len(statement) != 0 {
+		return nil, fmt.Errorf("%w: неподдерживаемый формат аттестации %q", ErrVerification, format)
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: нет данных аутентификатора", ErrVerification)
+	}
+	authData, err := c.parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedData == 0 || authData.credentialID == nil {
+		return nil, fmt.Errorf("%w: нет данных ключа", ErrVerification)
+	}
+
+	if _, err := parsePublicKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	rawID, err := base64.RawURLEncoding.DecodeString(response.RawID)
+	if err != nil || !bytes.Equal(rawID, authData.credentialID) {
+		return nil, fmt.Errorf("%w: идентификатор ключа не совпадает с данными аутентификатора", ErrVerification)
+	}
+
+	return &Credential{ID: authData.credentialID, PublicKey: authData.publicKey, SignCount: authData.signCount}, nil
+}
+
+// VerifyLogin проверка ответа на церемонию входа с вызовом challenge ключом credential:
+// данные клиента, идентификатор проверяющей стороны, присутствие пользователя, подпись и счетчик подписей
+func (c Config) VerifyLogin(challenge string, credential Credential, response LoginResponse) (*Assertion, error) {
+	if response.Type != "public-key" {
+		return nil, fmt.Errorf("%w: неверный тип ключа", ErrVerification)
+	}
+
+	rawID, err := base64.RawURLEncoding.DecodeString(response.RawID)
+	if err != nil || !bytes.Equal(rawID, credential.ID) {
+		return nil, fmt.Errorf("%w: ответ другого ключа", ErrVerification)
+	}
+
+	if err := c.verifyClientData(response.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAuthData, err := base64.RawURLEncoding.DecodeString(response.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+	authData, err := c.parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	rawClientData, err := base64.RawURLEncoding.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(response.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+
+	publicKey, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// подписываются данные аутентификатора и хэш данных клиента
+	clientDataHash := sha256.Sum256(rawClientData)
+	digest := sha256.Sum256(append(slices.Clone(rawAuthData), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return nil, fmt.Errorf("%w: неверная подпись", ErrVerification)
+	}
+
+	// аутентификаторы без счетчика всегда передают 0, иначе счетчик должен расти
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return nil, ErrSignCount
+	}
+
+	userHandle, err := base64.RawURLEncoding.DecodeString(response.Response.UserHandle)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+
+	return &Assertion{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+		UserHandle:   userHandle,
+	}, nil
+}
+
+// verifyClientData проверка типа церемонии, вызова и источника в данных клиента
+func (c Config) verifyClientData(clientDataJSON string, ceremony string, challenge string) error {
+	data, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case data.Type != ceremony:
+		return fmt.Errorf("%w: неверный тип церемонии %q", ErrVerification, data.Type)
+	case challenge == "" || data.Challenge != challenge:
+		return fmt.Errorf("%w: неверный вызов", ErrVerification)
+	case !slices.Contains(c.Origins, data.Origin):
+		return fmt.Errorf("%w: недопустимый источник %q", ErrVerification, data.Origin)
+	}
+	return nil
+}
+
+// parseClientData разбор данных клиента из base64url
+func parseClientData(clientDataJSON string) (*clientData, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(clientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+	return &data, nil
+}
+
+// parseAuthData разбор данных аутентификатора с проверкой хэша идентификатора проверяющей стороны
+// и присутствия пользователя
+func (c Config) parseAuthData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: короткие данные аутентификатора", ErrVerification)
+	}
+
+	data := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: ключ создан для другого сервиса", ErrVerification)
+	}
+	if data.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: не подтверждено присутствие пользователя", ErrVerification)
+	}
+
+	if data.flags&flagAttestedData == 0 {
+		return data, nil
+	}
+
+	// данные ключа: AAGUID (16 байт), длина идентификатора (2 байта), идентификатор и открытый ключ COSE
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: короткие данные ключа", ErrVerification)
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || len(rest) < idLength {
+		return nil, fmt.Errorf("%w: некорректный идентификатор ключа", ErrVerification)
+	}
+	data.credentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: открытый ключ: %v", ErrVerification, err)
+	}
+	data.publicKey = rest[:n]
+
+	return data, nil
+}
+
+// parsePublicKey разбор открытого ключа COSE: поддерживается только ES256 на кривой P-256
+func parsePublicKey(raw []byte) (*ecdsa.PublicKey, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: открытый ключ: %v", ErrVerification, err)
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: открытый ключ не словарь COSE", ErrVerification)
+	}
+
+	kty, _ := cborInt(key, uint64(1))
+	alg, _ := cborInt(key, uint64(3))
+	crv, _ := cborInt(key, int64(-1))
+	if kty != coseKtyEC2 || alg != coseAlgES256 || crv != coseCrvP256 {
+		return nil, fmt.Errorf("%w: поддерживаются только ключи ES256", ErrVerification)
+	}
+
+	x, okX := key[int64(-2)].([]byte)
+	y, okY := key[int64(-3)].([]byte)
+	if !okX || !okY || len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("%w: некорректные координаты ключа", ErrVerification)
+	}
+
+	// проверка, что точка лежит на кривой
+	if _, err := ecdh.P256().NewPublicKey(slices.Concat([]byte{4}, x, y)); err != nil {
+		return nil, fmt.Errorf("%w: точка ключа не на кривой", ErrVerification)
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// descriptors описания ключей для параметров церемоний
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	result := make([]CredentialDescriptor, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, CredentialDescriptor{Type: "public-key", ID: base64.RawURLEncoding.EncodeToString(id)})
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+package webauthn_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hardvlad/ypdiploma1/internal/webauthn"
+	"github.com/hardvlad/ypdiploma1/internal/webauthn/webauthntest"
+)
+
+var config = webauthn.Config{RPID: "localhost", RPName: "Gophermart", Origins: []string{"http://localhost:8080"}}
+
+func register(t *testing.T, authenticator *webauthntest.Authenticator) *webauthn.Credential {
+	challenge, err := webauthn.NewChallenge()
+	require.NoError(t, err)
+
+	response, err := authenticator.Register(config.NewRegistrationOptions(challenge, []byte("user-1"), "user", nil))
+	require.NoError(t, err)
+
+	credential, err := config.VerifyRegistration(challenge, *response)
+	require.NoError(t, err)
+	return credential
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	authenticator := webauthntest.NewAuthenticator("http://localhost:8080")
+	credential := register(t, authenticator)
+	assert.Equal(t, authenticator.Credentials[0].ID, credential.ID)
+	assert.Equal(t, uint32(0), credential.SignCount)
+
+	for i := 1; i <= 2; i++ {
+		challenge, err := webauthn.NewChallenge()
+		require.NoError(t, err)
+
+		response, err := authenticator.Login(config.NewLoginOptions(challenge, [][]byte{credential.ID}))
+		require.NoError(t, err)
+
+		got, err := webauthn.Challenge(response.Response.ClientDataJSON)
+		require.NoError(t, err)
+		assert.Equal(t, challenge, got)
+
+		assertion, err := config.VerifyLogin(challenge, *credential, *response)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), assertion.SignCount)
+		assert.True(t, assertion.UserVerified)
+		assert.Equal(t, []byte("user-1"), assertion.UserHandle)
+		credential.SignCount = assertion.SignCount
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	challenge, err := webauthn.NewChallenge()
+	require.NoError(t, err)
+	options := config.NewRegistrationOptions(challenge, []byte("user-1"), "user", nil)
+
+	// страница с другого источника
+	response, err := webauthntest.NewAuthenticator("https://evil.example").Register(options)
+	require.NoError(t, err)
+	_, err = config.VerifyRegistration(challenge, *response)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+
+	// ответ на другой вызов
+	response, err = webauthntest.NewAuthenticator("http://localhost:8080").Register(options)
+	require.NoError(t, err)
+	_, err = config.VerifyRegistration("other", *response)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+
+	// ключ для другого сервиса
+	other := webauthn.Config{RPID: "example.com", Origins: config.Origins}
+	_, err = other.VerifyRegistration(challenge, *response)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+
+	// испорченный объект аттестации
+	response.Response.AttestationObject = base64.RawURLEncoding.EncodeToString([]byte{0xbf, 0x00})
+	_, err = config.VerifyRegistration(challenge, *response)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+}
+
+func TestLoginRejected(t *testing.T) {
+	authenticator := webauthntest.NewAuthenticator("http://localhost:8080")
+	credential := register(t, authenticator)
+
+	challenge, err := webauthn.NewChallenge()
+	require.NoError(t, err)
+	options := config.NewLoginOptions(challenge, nil)
+
+	// подпись другим ключом
+	other := webauthntest.NewAuthenticator("http://localhost:8080")
+	otherCredential := register(t, other)
+	response, err := authenticator.Login(options)
+	require.NoError(t, err)
+	_, err = config.VerifyLogin(challenge, *otherCredential, *response)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+
+	// испорченная подпись
+	signature, err := base64.RawURLEncoding.DecodeString(response.Response.Signature)
+	require.NoError(t, err)
+	signature[len(signature)-1] ^= 0xff
+	tampered := *response
+	tampered.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	_, err = config.VerifyLogin(challenge, *credential, tampered)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+
+	// ответ на другой вызов
+	_, err = config.VerifyLogin("other", *credential, *response)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+
+	// корректный ответ принимается
+	assertion, err := config.VerifyLogin(challenge, *credential, *response)
+	require.NoError(t, err)
+	credential.SignCount = assertion.SignCount
+
+	// копия ключа со старым счетчиком
+	authenticator.Credentials[0].SignCount = 0
+	response, err = authenticator.Login(options)
+	require.NoError(t, err)
+	_, err = config.VerifyLogin(challenge, *credential, *response)
+	assert.ErrorIs(t, err, webauthn.ErrSignCount)
+}
+
+func TestLoginWithoutCounter(t *testing.T) {
+	authenticator := webauthntest.NewAuthenticator("http://localhost:8080")
+	authenticator.NoCounter = true
+	credential := register(t, authenticator)
+
+	// аутентификатор без счетчика всегда передает 0
+	for range 2 {
+		challenge, err := webauthn.NewChallenge()
+		require.NoError(t, err)
+		response, err := authenticator.Login(config.NewLoginOptions(challenge, nil))
+		require.NoError(t, err)
+		assertion, err := config.VerifyLogin(challenge, *credential, *response)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(0), assertion.SignCount)
+	}
+}
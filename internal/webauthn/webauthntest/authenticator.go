@@ -0,0 +1,227 @@
+// Package webauthntest программный аутентификатор WebAuthn для тестов: создает ключи ES256
+// с аттестацией none, хранит пользователя ключа и подписывает вход с увеличением счетчика
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/hardvlad/ypdiploma1/internal/webauthn"
+)
+
+// флаги данных аутентификатора: присутствие и проверка пользователя, данные ключа
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// ErrNoCredential у аутентификатора нет ключа для сервиса
+var ErrNoCredential = errors.New("нет подходящего ключа")
+
+// Credential ключ программного аутентификатора
+type Credential struct {
+	ID         []byte
+	RPID       string
+	UserHandle []byte
+	Key        *ecdsa.PrivateKey
+	SignCount  uint32
+}
+
+// Authenticator программный аутентификатор, выполняющий церемонии со страницы с источником Origin
+type Authenticator struct {
+	Origin string
+	// UserVerified - подтверждать проверку пользователя (PIN или биометрия)
+	UserVerified bool
+	// NoCounter - не вести счетчик подписей и всегда передавать 0
+	NoCounter   bool
+	Credentials []*Credential
+}
+
+// NewAuthenticator создание аутентификатора для страницы с источником origin
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Register выполнение церемонии регистрации по параметрам сервиса, возвращает ответ браузера
+func (a *Authenticator) Register(options webauthn.RegistrationOptions) (*webauthn.RegistrationResponse, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := &Credential{ID: id, RPID: options.RP.ID, UserHandle: userHandle, Key: key}
+	a.Credentials = append(a.Credentials, credential)
+
+	clientDataJSON, err := a.clientData("webauthn.create", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	// данные ключа: нулевой AAGUID, длина и идентификатор ключа, открытый ключ COSE
+	attested := make([]byte, 16, 16+2+len(id))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, coseKey(&key.PublicKey)...)
+
+	authData := a.authData(credential, flagAttestedData)
+	authData = append(authData, attested...)
+
+	var attestation bytes.Buffer
+	writeHead(&attestation, 5, 3)
+	writeText(&attestation, "fmt")
+	writeText(&attestation, "none")
+	writeText(&attestation, "attStmt")
+	writeHead(&attestation, 5, 0)
+	writeText(&attestation, "authData")
+	writeHead(&attestation, 2, uint64(len(authData)))
+	attestation.Write(authData)
+
+	var response webauthn.RegistrationResponse
+	response.ID = base64.RawURLEncoding.EncodeToString(id)
+	response.RawID = response.ID
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	response.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(attestation.Bytes())
+	return &response, nil
+}
+
+// Login выполнение церемонии входа по параметрам сервиса ключом из списка разрешенных
+// или, если список пуст, любым ключом сервиса, возвращает ответ браузера
+func (a *Authenticator) Login(options webauthn.LoginOptions) (*webauthn.LoginResponse, error) {
+	credential := a.find(options)
+	if credential == nil {
+		return nil, ErrNoCredential
+	}
+
+	if !a.NoCounter {
+		credential.SignCount++
+	}
+
+	clientDataJSON, err := a.clientData("webauthn.get", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := a.authData(credential, 0)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(slices.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, credential.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var response webauthn.LoginResponse
+	response.ID = base64.RawURLEncoding.EncodeToString(credential.ID)
+	response.RawID = response.ID
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	response.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	response.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	response.Response.UserHandle = base64.RawURLEncoding.EncodeToString(credential.UserHandle)
+	return &response, nil
+}
+
+// find поиск ключа для церемонии входа
+func (a *Authenticator) find(options webauthn.LoginOptions) *Credential {
+	for _, credential := range a.Credentials {
+		if credential.RPID != options.RPID {
+			continue
+		}
+		if len(options.AllowCredentials) == 0 {
+			return credential
+		}
+		for _, allowed := range options.AllowCredentials {
+			if allowed.ID == base64.RawURLEncoding.EncodeToString(credential.ID) {
+				return credential
+			}
+		}
+	}
+	return nil
+}
+
+// clientData данные клиента, формируемые браузером
+func (a *Authenticator) clientData(ceremony string, challenge string) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+}
+
+// authData данные аутентификатора без данных ключа: хэш идентификатора сервиса, флаги и счетчик
+func (a *Authenticator) authData(credential *Credential, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(credential.RPID))
+	flags |= flagUserPresent
+	if a.UserVerified {
+		flags |= flagUserVerified
+	}
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, credential.SignCount)
+}
+
+// coseKey открытый ключ ES256 в формате COSE: {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+func coseKey(key *ecdsa.PublicKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+
+	var buf bytes.Buffer
+	writeHead(&buf, 5, 5)
+	writeHead(&buf, 0, 1)
+	writeHead(&buf, 0, 2)
+	writeHead(&buf, 0, 3)
+	writeHead(&buf, 1, 6)
+	writeHead(&buf, 1, 0)
+	writeHead(&buf, 0, 1)
+	writeHead(&buf, 1, 1)
+	writeHead(&buf, 2, 32)
+	buf.Write(x)
+	writeHead(&buf, 1, 2)
+	writeHead(&buf, 2, 32)
+	buf.Write(y)
+	return buf.Bytes()
+}
+
+// writeHead запись заголовка CBOR с основным типом major и аргументом n
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+// writeText запись текстовой строки CBOR
+func writeText(buf *bytes.Buffer, s string) {
+	writeHead(buf, 3, uint64(len(s)))
+	buf.WriteString(s)
+}
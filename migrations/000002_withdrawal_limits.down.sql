@@ -0,0 +1 @@
+drop table withdrawal_limits;
\ No newline at end of file
@@ -0,0 +1,8 @@
+create table withdrawal_limits
+(
+    user_id integer primary key references users(id) on delete cascade,
+    max_single numeric(10,2),
+    max_daily numeric(10,2),
+    max_weekly numeric(10,2),
+    min_balance numeric(10,2)
+);
@@ -0,0 +1,4 @@
+drop table balance_adjustments;
+alter table users drop column debt_flagged_at;
+alter table orders drop column reconciled_at;
+alter table orders drop column processed_at;
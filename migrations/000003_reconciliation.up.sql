@@ -0,0 +1,20 @@
+alter table orders add column processed_at timestamp;
+alter table orders add column reconciled_at timestamp;
+
+update orders set processed_at = uploaded_at where status_id in (3, 4);
+
+alter table users add column debt_flagged_at timestamp;
+
+create table balance_adjustments
+(
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    order_id integer references orders(id) on delete cascade,
+    amount numeric(10,2) not null,
+    source varchar(32) not null,
+    reason text not null,
+    created_at timestamp not null default now()
+);
+
+create index balance_adjustments_user_id_idx on balance_adjustments (user_id);
+create index balance_adjustments_order_id_idx on balance_adjustments (order_id);
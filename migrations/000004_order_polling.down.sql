@@ -0,0 +1,2 @@
+alter table orders drop column next_poll_at;
+alter table orders drop column last_polled_at;
@@ -0,0 +1,2 @@
+alter table orders add column last_polled_at timestamp;
+alter table orders add column next_poll_at timestamp;
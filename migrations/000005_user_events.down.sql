@@ -0,0 +1,4 @@
+drop trigger withdrawals_notify_user_event on withdrawals;
+drop function notify_withdrawal_event();
+drop trigger orders_notify_user_event on orders;
+drop function notify_order_event();
@@ -0,0 +1,54 @@
+create function notify_order_event() returns trigger as $$
+declare
+    status_name varchar;
+begin
+    select name into status_name from statuses where id = new.status_id;
+
+    if new.status_id is distinct from old.status_id then
+        perform pg_notify('user_events', json_build_object(
+            'type', 'order_status',
+            'user_id', new.user_id,
+            'order', new.number,
+            'status', status_name,
+            'accrual', new.accrual,
+            'at', now()
+        )::text);
+    end if;
+
+    if status_name = 'PROCESSED' and new.accrual > 0
+        and (new.status_id is distinct from old.status_id or new.accrual is distinct from old.accrual) then
+        perform pg_notify('user_events', json_build_object(
+            'type', 'accrual',
+            'user_id', new.user_id,
+            'order', new.number,
+            'status', status_name,
+            'accrual', new.accrual,
+            'at', now()
+        )::text);
+    end if;
+
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger orders_notify_user_event
+    after update on orders
+    for each row execute function notify_order_event();
+
+create function notify_withdrawal_event() returns trigger as $$
+begin
+    perform pg_notify('user_events', json_build_object(
+        'type', 'withdrawal',
+        'user_id', new.user_id,
+        'order', new.number,
+        'sum', new.amount,
+        'at', now()
+    )::text);
+
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger withdrawals_notify_user_event
+    after insert on withdrawals
+    for each row execute function notify_withdrawal_event();
@@ -0,0 +1,72 @@
+create table webhooks
+(
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    url text not null,
+    secret varchar(64) not null,
+    event_types text[] not null,
+    created_at timestamp not null default now()
+);
+
+create index webhooks_user_id_idx on webhooks (user_id);
+
+create table webhook_deliveries
+(
+    id serial primary key,
+    webhook_id integer not null references webhooks(id) on delete cascade,
+    event_type varchar(32) not null,
+    payload jsonb not null,
+    status varchar(16) not null default 'pending',
+    attempts integer not null default 0,
+    next_attempt_at timestamp not null default now(),
+    last_status_code integer,
+    last_error text,
+    redelivery_of integer references webhook_deliveries(id) on delete set null,
+    created_at timestamp not null default now(),
+    delivered_at timestamp
+);
+
+create index webhook_deliveries_webhook_id_idx on webhook_deliveries (webhook_id, created_at);
+create index webhook_deliveries_pending_idx on webhook_deliveries (next_attempt_at) where status = 'pending';
+
+-- публикация события пользователя: уведомление экземпляров сервиса и постановка в очередь доставок вебхуков
+create function publish_user_event(event_user_id integer, event_type varchar, payload jsonb) returns void as $$
+begin
+    perform pg_notify('user_events', (payload || jsonb_build_object('type', event_type, 'user_id', event_user_id))::text);
+
+    insert into webhook_deliveries (webhook_id, event_type, payload)
+    select id, event_type, payload || jsonb_build_object('type', event_type)
+    from webhooks
+    where user_id = event_user_id and event_type = any(event_types);
+end;
+$$ language plpgsql;
+
+create or replace function notify_order_event() returns trigger as $$
+declare
+    status_name varchar;
+    payload jsonb;
+begin
+    select name into status_name from statuses where id = new.status_id;
+    payload := jsonb_build_object('order', new.number, 'status', status_name, 'accrual', new.accrual, 'at', now());
+
+    if new.status_id is distinct from old.status_id then
+        perform publish_user_event(new.user_id, 'order_status', payload);
+    end if;
+
+    if status_name = 'PROCESSED' and new.accrual > 0
+        and (new.status_id is distinct from old.status_id or new.accrual is distinct from old.accrual) then
+        perform publish_user_event(new.user_id, 'accrual', payload);
+    end if;
+
+    return new;
+end;
+$$ language plpgsql;
+
+create or replace function notify_withdrawal_event() returns trigger as $$
+begin
+    perform publish_user_event(new.user_id, 'withdrawal',
+        jsonb_build_object('order', new.number, 'sum', new.amount, 'at', now()));
+
+    return new;
+end;
+$$ language plpgsql;
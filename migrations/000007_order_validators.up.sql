@@ -0,0 +1,3 @@
+-- схема проверки номеров заказов партнера (luhn, damm, verhoeff, regex:<выражение>),
+-- NULL - используется схема из конфигурации сервиса
+alter table users add column order_validator varchar(255);
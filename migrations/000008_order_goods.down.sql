@@ -0,0 +1,2 @@
+drop table order_goods;
+alter table orders drop column accrual_registered_at;
@@ -0,0 +1,11 @@
+alter table orders add column accrual_registered_at timestamp;
+
+create table order_goods
+(
+    id serial primary key,
+    order_id integer not null references orders(id) on delete cascade,
+    description text not null,
+    price numeric(12,2) not null
+);
+
+create index order_goods_order_id_idx on order_goods (order_id);
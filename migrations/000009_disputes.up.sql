@@ -0,0 +1,18 @@
+create table disputes
+(
+    id serial primary key,
+    order_id integer not null references orders(id) on delete cascade,
+    user_id integer not null references users(id) on delete cascade,
+    reason text not null,
+    status varchar(16) not null default 'open',
+    resolution text,
+    adjustment_id integer references balance_adjustments(id),
+    created_at timestamp not null default now(),
+    updated_at timestamp not null default now(),
+    resolved_at timestamp
+);
+
+create index disputes_user_id_idx on disputes (user_id);
+create index disputes_status_idx on disputes (status, created_at);
+-- по заказу может быть только один незавершенный спор
+create unique index disputes_active_order_idx on disputes (order_id) where status in ('open', 'under_review');
@@ -0,0 +1,2 @@
+drop table if exists upload_blocks;
+drop table if exists order_upload_attempts;
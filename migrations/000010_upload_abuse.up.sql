@@ -0,0 +1,27 @@
+create table order_upload_attempts
+(
+    id bigserial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    ip varchar(64) not null,
+    order_number varchar(255) not null,
+    result varchar(16) not null,
+    created_at timestamp not null default now()
+);
+
+create index order_upload_attempts_user_idx on order_upload_attempts (user_id, created_at);
+create index order_upload_attempts_ip_idx on order_upload_attempts (ip, created_at);
+
+-- временные блокировки загрузки заказов пользователем или с IP-адреса
+create table upload_blocks
+(
+    id serial primary key,
+    user_id integer references users(id) on delete cascade,
+    ip varchar(64),
+    reason varchar(32) not null,
+    blocked_until timestamp not null,
+    created_at timestamp not null default now(),
+    check (user_id is not null or ip is not null)
+);
+
+create index upload_blocks_user_idx on upload_blocks (user_id, blocked_until);
+create index upload_blocks_ip_idx on upload_blocks (ip, blocked_until);
@@ -0,0 +1,24 @@
+-- семья refresh токенов, полученных ротацией от одного входа пользователя,
+-- отзыв семьи завершает вход, в том числе для выданных в ней access токенов
+create table token_families
+(
+    id varchar(64) primary key,
+    user_id integer not null references users(id) on delete cascade,
+    created_at timestamp not null default now(),
+    revoked_at timestamp
+);
+
+create index token_families_user_id_idx on token_families (user_id);
+
+-- refresh токены хранятся только в виде хэша
+create table refresh_tokens
+(
+    id bigserial primary key,
+    family_id varchar(64) not null references token_families(id) on delete cascade,
+    token_hash varchar(64) not null unique,
+    created_at timestamp not null default now(),
+    expires_at timestamp not null,
+    used_at timestamp
+);
+
+create index refresh_tokens_family_id_idx on refresh_tokens (family_id);
@@ -0,0 +1,21 @@
+-- журнал попыток входа: успешные, неудачные и отклоненные из-за блокировки
+create table login_attempts
+(
+    id bigserial primary key,
+    login varchar(255) not null,
+    ip varchar(64) not null,
+    result varchar(16) not null,
+    created_at timestamp not null default now()
+);
+
+create index login_attempts_login_idx on login_attempts (login, created_at);
+create index login_attempts_ip_idx on login_attempts (ip, created_at);
+
+-- счетчики неудачных попыток входа по логину и IP-адресу, общие для всех реплик сервиса
+create table login_lockouts
+(
+    key varchar(320) primary key,
+    failures integer not null default 0,
+    last_failure_at timestamp not null default now(),
+    locked_until timestamp
+);
@@ -0,0 +1,16 @@
+-- API ключи пользователей для серверных клиентов, ключ хранится только в виде хэша,
+-- prefix - открытая часть ключа для отображения в списке
+create table api_keys
+(
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    name varchar(255) not null,
+    prefix varchar(16) not null,
+    key_hash varchar(64) not null unique,
+    scopes text[] not null,
+    created_at timestamp not null default now(),
+    last_used_at timestamp,
+    revoked_at timestamp
+);
+
+create index api_keys_user_id_idx on api_keys (user_id);
@@ -0,0 +1,2 @@
+alter table users add column role varchar(16) not null default 'user';
+alter table users add constraint users_role_check check (role in ('user', 'support', 'admin'));
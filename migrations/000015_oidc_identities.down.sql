@@ -0,0 +1,2 @@
+drop table if exists oidc_auth_requests;
+drop table if exists user_identities;
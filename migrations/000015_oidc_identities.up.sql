@@ -0,0 +1,25 @@
+-- внешние учетные записи провайдеров OpenID Connect, связанные с пользователями
+create table user_identities
+(
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    issuer varchar(255) not null,
+    subject varchar(255) not null,
+    email varchar(255),
+    created_at timestamp not null default now(),
+    last_login_at timestamp,
+    unique (issuer, subject)
+);
+
+create index user_identities_user_id_idx on user_identities (user_id);
+
+-- начатые входы через провайдера до возврата с кодом авторизации, state хранится только в виде хэша,
+-- link_user_id - пользователь, к которому привязывается внешняя учетная запись
+create table oidc_auth_requests
+(
+    state_hash varchar(64) primary key,
+    nonce varchar(64) not null,
+    code_verifier varchar(128) not null,
+    link_user_id integer references users(id) on delete cascade,
+    expires_at timestamp not null
+);
@@ -0,0 +1,29 @@
+-- секреты TOTP пользователей, enabled_at null - подключение не подтверждено кодом,
+-- last_step - последний принятый шаг времени для защиты от повторного использования кода
+create table user_totp
+(
+    user_id integer primary key references users(id) on delete cascade,
+    secret varchar(64) not null,
+    created_at timestamp not null default now(),
+    enabled_at timestamp,
+    last_step bigint not null default 0
+);
+
+-- одноразовые коды восстановления на случай потери аутентификатора, хранятся только в виде хэша
+create table recovery_codes
+(
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    code_hash varchar(64) not null,
+    used_at timestamp,
+    unique (user_id, code_hash)
+);
+
+-- входы, ожидающие второго фактора после проверки пароля, токен хранится только в виде хэша
+create table login_challenges
+(
+    token_hash varchar(64) primary key,
+    user_id integer not null references users(id) on delete cascade,
+    attempts integer not null default 0,
+    expires_at timestamp not null
+);
@@ -0,0 +1,25 @@
+-- ключи доступа WebAuthn (passkeys) пользователей: открытый ключ COSE и последний принятый счетчик подписей,
+-- credential_id - идентификатор ключа аутентификатора в base64url
+create table webauthn_credentials
+(
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    credential_id varchar(1400) not null unique,
+    public_key bytea not null,
+    sign_count bigint not null default 0,
+    name varchar(100) not null,
+    created_at timestamp not null default now(),
+    last_used_at timestamp
+);
+
+create index webauthn_credentials_user_id_idx on webauthn_credentials (user_id);
+
+-- начатые церемонии регистрации и входа, вызов хранится только в виде хэша,
+-- user_id null - вход без указания пользователя по ключу, хранящему пользователя на аутентификаторе
+create table webauthn_challenges
+(
+    challenge_hash varchar(64) primary key,
+    ceremony varchar(16) not null,
+    user_id integer references users(id) on delete cascade,
+    expires_at timestamp not null
+);
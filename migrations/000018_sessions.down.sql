@@ -0,0 +1,5 @@
+alter table token_families
+    drop column if exists device,
+    drop column if exists ip,
+    drop column if exists user_agent,
+    drop column if exists last_seen_at;
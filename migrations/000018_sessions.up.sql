@@ -0,0 +1,8 @@
+-- семья токенов - сессия пользователя: устройство, IP-адрес и user agent входа, время последнего запроса
+alter table token_families
+    add column device varchar(100) not null default '',
+    add column ip varchar(64) not null default '',
+    add column user_agent varchar(512) not null default '',
+    add column last_seen_at timestamp not null default now();
+
+update token_families set last_seen_at = created_at;
@@ -0,0 +1,25 @@
+-- откат необратим для удаленных пользователей: обезличенные финансовые записи без пользователя удаляются,
+-- иначе связь с пользователем нельзя сделать обязательной; споры удаляются первыми из-за ссылки на корректировки
+delete from disputes where user_id is null;
+delete from balance_adjustments where user_id is null;
+delete from withdrawals where user_id is null;
+delete from orders where user_id is null;
+
+alter table disputes drop constraint disputes_user_id_fkey;
+alter table disputes add constraint disputes_user_id_fkey foreign key (user_id) references users(id) on delete cascade;
+alter table disputes alter column user_id set not null;
+
+alter table balance_adjustments drop constraint balance_adjustments_user_id_fkey;
+alter table balance_adjustments add constraint balance_adjustments_user_id_fkey foreign key (user_id) references users(id) on delete cascade;
+alter table balance_adjustments alter column user_id set not null;
+
+alter table withdrawals drop constraint withdrawals_user_id_fkey;
+alter table withdrawals add constraint withdrawals_user_id_fkey foreign key (user_id) references users(id) on delete cascade;
+alter table withdrawals alter column user_id set not null;
+
+alter table orders drop constraint orders_user_id_fkey;
+alter table orders add constraint orders_user_id_fkey foreign key (user_id) references users(id) on delete cascade;
+alter table orders alter column user_id set not null;
+
+drop index if exists users_deletion_scheduled_at_idx;
+alter table users drop column if exists deletion_scheduled_at;
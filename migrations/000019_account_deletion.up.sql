@@ -0,0 +1,21 @@
+-- удаление учетной записи по запросу пользователя выполняется после льготного периода
+alter table users add column deletion_scheduled_at timestamp;
+
+create index users_deletion_scheduled_at_idx on users (deletion_scheduled_at) where deletion_scheduled_at is not null;
+
+-- финансовые записи удаленного пользователя сохраняются обезличенными: связь с пользователем обнуляется
+alter table orders alter column user_id drop not null;
+alter table orders drop constraint orders_user_id_fkey;
+alter table orders add constraint orders_user_id_fkey foreign key (user_id) references users(id) on delete set null;
+
+alter table withdrawals alter column user_id drop not null;
+alter table withdrawals drop constraint withdrawals_user_id_fkey;
+alter table withdrawals add constraint withdrawals_user_id_fkey foreign key (user_id) references users(id) on delete set null;
+
+alter table balance_adjustments alter column user_id drop not null;
+alter table balance_adjustments drop constraint balance_adjustments_user_id_fkey;
+alter table balance_adjustments add constraint balance_adjustments_user_id_fkey foreign key (user_id) references users(id) on delete set null;
+
+alter table disputes alter column user_id drop not null;
+alter table disputes drop constraint disputes_user_id_fkey;
+alter table disputes add constraint disputes_user_id_fkey foreign key (user_id) references users(id) on delete set null;
@@ -0,0 +1 @@
+drop index if exists orders_next_poll_at_idx;
@@ -0,0 +1,2 @@
+-- очередь опроса системы начислений: заказы, для которых запланирован следующий запрос
+create index orders_next_poll_at_idx on orders (next_poll_at) where next_poll_at is not null;
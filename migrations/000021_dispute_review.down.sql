@@ -0,0 +1,6 @@
+alter table balance_adjustments drop column if exists created_by;
+
+alter table disputes
+    drop column if exists reviewed_by,
+    drop column if exists reviewed_at,
+    drop column if exists resolved_by;
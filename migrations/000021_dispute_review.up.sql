@@ -0,0 +1,8 @@
+-- администраторы, разобравшие спор: взявший спор в работу и принявший решение
+alter table disputes
+    add column reviewed_by integer references users(id) on delete set null,
+    add column reviewed_at timestamp,
+    add column resolved_by integer references users(id) on delete set null;
+
+-- автор корректировки баланса, null - корректировка записана сервисом при сверке
+alter table balance_adjustments add column created_by integer references users(id) on delete set null;
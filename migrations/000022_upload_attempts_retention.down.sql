@@ -0,0 +1 @@
+drop index if exists order_upload_attempts_created_at_idx;
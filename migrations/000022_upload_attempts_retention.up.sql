@@ -0,0 +1,3 @@
+-- журнал загрузок заказов периодически очищается от записей старше окон проверки злоупотреблений,
+-- индексы по (user_id, created_at) и (ip, created_at) для удаления по времени не подходят
+create index order_upload_attempts_created_at_idx on order_upload_attempts (created_at);
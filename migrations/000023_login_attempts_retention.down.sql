@@ -0,0 +1 @@
+drop index if exists login_attempts_created_at_idx;
@@ -0,0 +1,3 @@
+-- журнал попыток входа периодически очищается от записей старше срока хранения,
+-- индексы по (login, created_at) и (ip, created_at) для удаления по времени не подходят
+create index login_attempts_created_at_idx on login_attempts (created_at);
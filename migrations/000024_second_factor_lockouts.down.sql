@@ -0,0 +1 @@
+drop table if exists second_factor_lockouts;
@@ -0,0 +1,9 @@
+-- счетчики неудачных проверок второго фактора по пользователям: списания, повторная аутентификация,
+-- отключение TOTP и второй шаг входа, общие для всех реплик сервиса
+create table second_factor_lockouts
+(
+    user_id integer primary key references users(id) on delete cascade,
+    failures integer not null default 0,
+    last_failure_at timestamp not null default now(),
+    locked_until timestamp
+);